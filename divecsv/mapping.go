@@ -0,0 +1,309 @@
+package divecsv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Column headers of the dive list that Subsurface exports as CSV, in metric
+// units. They are the default mapping, and Bluefin writes them as well. The
+// headers of cylinder columns are numbered, e.g. "o2 (2) [%]".
+const (
+	HeaderNumber        = "dive number"
+	HeaderDate          = "date"
+	HeaderTime          = "time"
+	HeaderDuration      = "duration [min]"
+	HeaderDepthMax      = "maxdepth [m]"
+	HeaderDepthMean     = "avgdepth [m]"
+	HeaderAirTemp       = "airtemp [C]"
+	HeaderWaterTemp     = "watertemp [C]"
+	HeaderCylinderSize  = "cylinder size (%d) [l]"
+	HeaderStartPressure = "startpressure (%d) [bar]"
+	HeaderEndPressure   = "endpressure (%d) [bar]"
+	HeaderO2            = "o2 (%d) [%%]"
+	HeaderHe            = "he (%d) [%%]"
+	HeaderLocation      = "location"
+	HeaderGPS           = "gps"
+	HeaderDiveMaster    = "divemaster"
+	HeaderBuddy         = "buddy"
+	HeaderSuit          = "suit"
+	HeaderRating        = "rating"
+	HeaderVisibility    = "visibility"
+	HeaderNotes         = "notes"
+	HeaderWeight        = "weight [kg]"
+	HeaderTags          = "tags"
+
+	// dive profile export
+	HeaderSampleTime        = "sample time (min)"
+	HeaderSampleDepth       = "sample depth (m)"
+	HeaderSampleTemperature = "sample temperature (C)"
+	HeaderSamplePressure    = "sample pressure (bar)"
+)
+
+// Field names used as keys of Mapping.Columns.
+const (
+	FieldNumber         = "number"
+	FieldDate           = "date"
+	FieldTime           = "time"
+	FieldDuration       = "duration"
+	FieldDepthMax       = "maxdepth"
+	FieldDepthMean      = "meandepth"
+	FieldAirTemp        = "airtemp"
+	FieldWaterTemp      = "watertemp"
+	FieldCylinderSize   = "cylindersize"
+	FieldStartPressure  = "startpressure"
+	FieldEndPressure    = "endpressure"
+	FieldO2             = "o2"
+	FieldHe             = "he"
+	FieldLocation       = "location"
+	FieldGPS            = "gps"
+	FieldDiveMaster     = "divemaster"
+	FieldBuddy          = "buddy"
+	FieldSuit           = "suit"
+	FieldRating         = "rating"
+	FieldVisibility     = "visibility"
+	FieldNotes          = "notes"
+	FieldWeight         = "weight"
+	FieldTags           = "tags"
+	FieldSampleTime     = "sampletime"
+	FieldSampleDepth    = "sampledepth"
+	FieldSampleTemp     = "sampletemp"
+	FieldSamplePressure = "samplepressure"
+)
+
+// Options of the Subsurface CSV import dialog.
+const (
+	UnitsMetric   = "metric"
+	UnitsImperial = "imperial"
+
+	DateYMD      = "yyyy-mm-dd"
+	DateDMYDots  = "dd.mm.yyyy"
+	DateMDYSlash = "mm/dd/yyyy"
+	DateDMYSlash = "dd/mm/yyyy"
+
+	DurationMinSec  = "min:sec"
+	DurationMinutes = "minutes"
+	DurationSeconds = "seconds"
+)
+
+// maxCylinders is how many numbered cylinder columns the default mapping looks for.
+const maxCylinders = 8
+
+var ErrInvalidMapping = errors.New("invalid CSV column mapping")
+
+var dateLayouts = map[string]string{
+	DateYMD:      "2006-01-02",
+	DateDMYDots:  "2.1.2006",
+	DateMDYSlash: "1/2/2006",
+	DateDMYSlash: "2/1/2006",
+}
+
+var fields = []string{
+	FieldNumber, FieldDate, FieldTime, FieldDuration, FieldDepthMax, FieldDepthMean,
+	FieldAirTemp, FieldWaterTemp, FieldCylinderSize, FieldStartPressure, FieldEndPressure,
+	FieldO2, FieldHe, FieldLocation, FieldGPS, FieldDiveMaster, FieldBuddy, FieldSuit,
+	FieldRating, FieldVisibility, FieldNotes, FieldWeight, FieldTags,
+	FieldSampleTime, FieldSampleDepth, FieldSampleTemp, FieldSamplePressure,
+}
+
+// Mapping describes a CSV file the way the Subsurface CSV import dialog does:
+// the separator, units, date and duration formats, and which column holds
+// which field. A column is given by its header, or by its 1-based position
+// as "#3". Cylinder fields take a list of columns, one per cylinder.
+//
+// A mapping is loaded from a JSON file such as:
+//
+//	{
+//	  "separator": ";",
+//	  "units": "metric",
+//	  "date_format": "dd.mm.yyyy",
+//	  "duration_format": "minutes",
+//	  "columns": {
+//	    "number": "Dive #",
+//	    "date": "Date",
+//	    "location": "#4",
+//	    "o2": ["O2 1", "O2 2"]
+//	  }
+//	}
+type Mapping struct {
+	Separator      string             `json:"separator"`
+	Units          string             `json:"units"`
+	DateFormat     string             `json:"date_format"`
+	DurationFormat string             `json:"duration_format"`
+	Columns        map[string]Columns `json:"columns"`
+}
+
+// Columns are the columns of a field. A single column can be given as a string.
+type Columns []string
+
+func (c *Columns) UnmarshalJSON(data []byte) error {
+	var column string
+	if err := json.Unmarshal(data, &column); err == nil {
+		*c = Columns{column}
+		return nil
+	}
+	var columns []string
+	if err := json.Unmarshal(data, &columns); err != nil {
+		return fmt.Errorf("columns must be a string or a list of strings")
+	}
+	*c = columns
+	return nil
+}
+
+// DefaultMapping reads CSV files exported by Subsurface (and by Bluefin):
+// a comma-separated dive list or dive profile in metric units.
+func DefaultMapping() *Mapping {
+	m := &Mapping{
+		Separator:      ",",
+		Units:          UnitsMetric,
+		DateFormat:     DateYMD,
+		DurationFormat: DurationMinSec,
+		Columns: map[string]Columns{
+			FieldNumber:         {HeaderNumber},
+			FieldDate:           {HeaderDate},
+			FieldTime:           {HeaderTime},
+			FieldDuration:       {HeaderDuration},
+			FieldDepthMax:       {HeaderDepthMax},
+			FieldDepthMean:      {HeaderDepthMean},
+			FieldAirTemp:        {HeaderAirTemp},
+			FieldWaterTemp:      {HeaderWaterTemp},
+			FieldLocation:       {HeaderLocation},
+			FieldGPS:            {HeaderGPS},
+			FieldDiveMaster:     {HeaderDiveMaster},
+			FieldBuddy:          {HeaderBuddy},
+			FieldSuit:           {HeaderSuit},
+			FieldRating:         {HeaderRating},
+			FieldVisibility:     {HeaderVisibility},
+			FieldNotes:          {HeaderNotes},
+			FieldWeight:         {HeaderWeight},
+			FieldTags:           {HeaderTags},
+			FieldSampleTime:     {HeaderSampleTime},
+			FieldSampleDepth:    {HeaderSampleDepth},
+			FieldSampleTemp:     {HeaderSampleTemperature},
+			FieldSamplePressure: {HeaderSamplePressure},
+		},
+	}
+	for field, header := range map[string]string{
+		FieldCylinderSize:  HeaderCylinderSize,
+		FieldStartPressure: HeaderStartPressure,
+		FieldEndPressure:   HeaderEndPressure,
+		FieldO2:            HeaderO2,
+		FieldHe:            HeaderHe,
+	} {
+		for i := 1; i <= maxCylinders; i++ {
+			m.Columns[field] = append(m.Columns[field], fmt.Sprintf(header, i))
+		}
+	}
+	return m
+}
+
+// LoadMapping reads a mapping from a JSON file. Options that are not set
+// keep their default values.
+func LoadMapping(path string) (*Mapping, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defaults := DefaultMapping()
+	m := &Mapping{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMapping, err)
+	}
+	if m.Separator == "" {
+		m.Separator = defaults.Separator
+	}
+	if m.Units == "" {
+		m.Units = defaults.Units
+	}
+	if m.DateFormat == "" {
+		m.DateFormat = defaults.DateFormat
+	}
+	if m.DurationFormat == "" {
+		m.DurationFormat = defaults.DurationFormat
+	}
+	if len(m.Columns) == 0 {
+		m.Columns = defaults.Columns
+	}
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Mapping) validate() error {
+	if m.Separator == "tab" || m.Separator == `\t` {
+		m.Separator = "\t"
+	}
+	if utf8.RuneCountInString(m.Separator) != 1 {
+		return fmt.Errorf("%w: separator %q is not a single character", ErrInvalidMapping, m.Separator)
+	}
+	if m.Units != UnitsMetric && m.Units != UnitsImperial {
+		return fmt.Errorf("%w: units %q", ErrInvalidMapping, m.Units)
+	}
+	if _, ok := dateLayouts[m.DateFormat]; !ok {
+		return fmt.Errorf("%w: date format %q", ErrInvalidMapping, m.DateFormat)
+	}
+	switch m.DurationFormat {
+	case DurationMinSec, DurationMinutes, DurationSeconds:
+	default:
+		return fmt.Errorf("%w: duration format %q", ErrInvalidMapping, m.DurationFormat)
+	}
+	for field := range m.Columns {
+		if !isField(field) {
+			return fmt.Errorf("%w: unknown field %q", ErrInvalidMapping, field)
+		}
+	}
+	if len(m.Columns[FieldDate]) == 0 {
+		return fmt.Errorf("%w: no column for %q", ErrInvalidMapping, FieldDate)
+	}
+	return nil
+}
+
+func isField(name string) bool {
+	for _, field := range fields {
+		if field == name {
+			return true
+		}
+	}
+	return false
+}
+
+// columnIndices resolves the columns of every field against the header row.
+// Columns that are not in the file have the index -1, so that the columns of
+// cylinder fields keep their positions.
+func (m *Mapping) columnIndices(header []string) map[string][]int {
+	positions := make(map[string]int, len(header))
+	for i, name := range header {
+		key := strings.ToLower(strings.TrimSpace(name))
+		if _, ok := positions[key]; !ok {
+			positions[key] = i
+		}
+	}
+
+	indices := make(map[string][]int)
+	for field, columns := range m.Columns {
+		for _, column := range columns {
+			index := -1
+			if n, err := strconv.Atoi(strings.TrimPrefix(column, "#")); err == nil && strings.HasPrefix(column, "#") {
+				if n >= 1 && n <= len(header) {
+					index = n - 1
+				}
+			} else if i, ok := positions[strings.ToLower(strings.TrimSpace(column))]; ok {
+				index = i
+			}
+			indices[field] = append(indices[field], index)
+		}
+	}
+	return indices
+}
+
+func (m *Mapping) parseDate(s string) (time.Time, error) {
+	return time.Parse(dateLayouts[m.DateFormat], s)
+}
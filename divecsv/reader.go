@@ -0,0 +1,444 @@
+package divecsv
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"src.acicovic.me/divelog/subsurface"
+)
+
+// Program is reported in the header, as CSV files do not name the program
+// that wrote them.
+const Program = "CSV"
+
+const (
+	unknownSite  = "Unknown site"
+	feetToMeters = 0.3048
+	psiToBar     = 0.0689475729
+	poundsToKg   = 0.45359237
+	zeroCelsius  = 273.15
+)
+
+var timeLayouts = []string{
+	"15:04:05",
+	"15:04",
+	"3:04:05 PM",
+	"3:04 PM",
+}
+
+var ErrNoHeader = errors.New("CSV file has no header row")
+
+// IsCSV reports whether the file is a CSV file, which unlike the other formats
+// can only be told by its name (.csv or .csv.gz).
+func IsCSV(path string) bool {
+	name := strings.ToLower(path)
+	return strings.HasSuffix(strings.TrimSuffix(name, ".gz"), ".csv")
+}
+
+// Decode decodes a CSV dive list or dive profile and reports its contents to
+// the handler, in the same way subsurface.DecodeSubsurfaceDatabase does for
+// Subsurface databases.
+func Decode(r io.Reader, m *Mapping, h subsurface.Handler) error {
+	if r == nil {
+		return subsurface.ErrNilReader
+	}
+	if h == nil {
+		return subsurface.ErrNilHandler
+	}
+
+	records, err := ReadRecords(r, m)
+	if err != nil {
+		return err
+	}
+	return subsurface.ReportRecordSlice(records, h)
+}
+
+// ReadRecords decodes a CSV file with a header row into the records that
+// subsurface.Reader produces for Subsurface databases. Every row is a dive,
+// unless sample columns are mapped: then consecutive rows of the same dive
+// number, date and time are the samples of one dive, as in the dive profiles
+// Subsurface exports. Dive sites are made of distinct locations. Invalid values
+// are reported as a subsurface.DecodeError.
+func ReadRecords(r io.Reader, m *Mapping) ([]subsurface.Record, error) {
+	if m == nil {
+		m = DefaultMapping()
+	}
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+
+	cr := csv.NewReader(r)
+	cr.Comma, _ = utf8.DecodeRuneInString(m.Separator)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, &subsurface.DecodeError{Path: "csv", Err: ErrNoHeader}
+	}
+	if err != nil {
+		return nil, csvError(err)
+	}
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff") // byte order mark
+	}
+
+	c := &converter{
+		mapping: m,
+		header:  header,
+		columns: m.columnIndices(header),
+		sites:   make(map[string]int),
+	}
+	c.profile = c.mapped(FieldSampleTime) && c.mapped(FieldSampleDepth)
+
+	for row := 1; ; row++ {
+		fields, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, csvError(err)
+		}
+		line, _ := cr.FieldPos(0)
+		c.row, c.line, c.fields = row, line, fields
+		if isBlank(fields) {
+			continue
+		}
+		c.convertRow()
+		if c.err != nil {
+			return nil, c.err
+		}
+	}
+	c.finishDive()
+
+	records := []subsurface.Record{&subsurface.HeaderRecord{Program: Program}}
+	records = append(records, c.siteRecords...)
+	for _, dive := range c.dives {
+		records = append(records, dive)
+	}
+	return records, nil
+}
+
+type converter struct {
+	mapping *Mapping
+	header  []string
+	columns map[string][]int
+	profile bool
+
+	// the row being converted
+	row    int
+	line   int
+	fields []string
+
+	sites       map[string]int // site index by location and GPS
+	siteRecords []subsurface.Record
+	dives       []*subsurface.DiveRecord
+	diveKey     string
+	err         error
+}
+
+func (c *converter) convertRow() {
+	key := c.value(FieldNumber, 0) + "\x00" + c.value(FieldDate, 0) + "\x00" + c.value(FieldTime, 0)
+	if !c.profile || key != c.diveKey || len(c.dives) == 0 {
+		c.finishDive()
+		c.diveKey = key
+		c.dives = append(c.dives, c.convertDive())
+	}
+	if c.profile {
+		dive := c.dives[len(c.dives)-1]
+		dive.Samples = append(dive.Samples, c.convertSample())
+	}
+}
+
+func (c *converter) convertDive() *subsurface.DiveRecord {
+	ddh := subsurface.DiveDataHolder{
+		DiveTripID:           subsurface.IntNull,
+		DiveSiteUUID:         c.site(),
+		DiveMasterOrOperator: c.value(FieldDiveMaster, 0),
+		Buddy:                c.value(FieldBuddy, 0),
+		Suit:                 c.value(FieldSuit, 0),
+		Notes:                c.value(FieldNotes, 0),
+		DepthMax:             c.depth(FieldDepthMax, 0),
+		DepthMean:            c.depth(FieldDepthMean, 0),
+		TemperatureAir:       c.temperature(FieldAirTemp, 0),
+		TemperatureWaterMin:  c.temperature(FieldWaterTemp, 0),
+		Duration:             c.duration(FieldDuration),
+		Weight:               subsurface.Weight(c.scaled(FieldWeight, 0, poundsToKg)),
+		DiveNumber:           int(c.number(FieldNumber, 0)),
+		Rating:               int(c.number(FieldRating, 0)),
+		Visibility:           int(c.number(FieldVisibility, 0)),
+	}
+	for _, tag := range strings.Split(c.value(FieldTags, 0), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			ddh.Tags = append(ddh.Tags, tag)
+		}
+	}
+	ddh.DateTime = c.dateTime()
+
+	cylinders := 0
+	for _, field := range []string{FieldCylinderSize, FieldStartPressure, FieldEndPressure, FieldO2, FieldHe} {
+		cylinders = max(cylinders, len(c.columns[field]))
+	}
+	for i := 0; i < cylinders; i++ {
+		cyl := subsurface.CylinderDataHolder{
+			Size:          subsurface.Volume(c.number(FieldCylinderSize, i)),
+			StartPressure: subsurface.Pressure(c.scaled(FieldStartPressure, i, psiToBar)),
+			EndPressure:   subsurface.Pressure(c.scaled(FieldEndPressure, i, psiToBar)),
+			O2:            subsurface.Fraction(c.number(FieldO2, i)),
+			He:            subsurface.Fraction(c.number(FieldHe, i)),
+		}
+		if cyl != (subsurface.CylinderDataHolder{}) {
+			ddh.Cylinders = append(ddh.Cylinders, cyl)
+		}
+	}
+	return &subsurface.DiveRecord{DiveDataHolder: ddh}
+}
+
+func (c *converter) convertSample() subsurface.Sample {
+	return subsurface.Sample{
+		Time:        c.sampleTime(),
+		Depth:       c.depth(FieldSampleDepth, 0),
+		Temperature: c.temperature(FieldSampleTemp, 0),
+		Pressure:    subsurface.Pressure(c.scaled(FieldSamplePressure, 0, psiToBar)),
+	}
+}
+
+// finishDive completes the last dive with the values that can be derived
+// from its samples.
+func (c *converter) finishDive() {
+	if len(c.dives) == 0 {
+		return
+	}
+	ddh := &c.dives[len(c.dives)-1].DiveDataHolder
+	for _, sample := range ddh.Samples {
+		if sample.Depth > ddh.DepthMax {
+			ddh.DepthMax = sample.Depth
+		}
+		if sample.Temperature != 0 && (ddh.TemperatureWaterMin == 0 || sample.Temperature < ddh.TemperatureWaterMin) {
+			ddh.TemperatureWaterMin = sample.Temperature
+		}
+	}
+	if ddh.Duration == 0 && len(ddh.Samples) > 0 {
+		ddh.Duration = ddh.Samples[len(ddh.Samples)-1].Time
+	}
+	if len(ddh.Samples) > 0 && len(ddh.DiveComputers) == 0 {
+		ddh.DiveComputers = []subsurface.DiveComputerDataHolder{{
+			Primary:             true,
+			DepthMax:            ddh.DepthMax,
+			DepthMean:           ddh.DepthMean,
+			TemperatureWaterMin: ddh.TemperatureWaterMin,
+			Samples:             ddh.Samples,
+		}}
+	}
+}
+
+// site returns the UUID of the dive site of the row, which is reported the
+// first time its location is seen.
+func (c *converter) site() string {
+	name := c.value(FieldLocation, 0)
+	gps := c.value(FieldGPS, 0)
+	if name == "" {
+		name = unknownSite
+	}
+
+	key := name + "\x00" + gps
+	index, ok := c.sites[key]
+	if !ok {
+		index = len(c.sites) + 1
+		c.sites[key] = index
+		c.siteRecords = append(c.siteRecords, &subsurface.SiteRecord{
+			Index:  index,
+			UUID:   siteUUID(index),
+			Name:   name,
+			Coords: c.coordinates(gps),
+		})
+	}
+	return siteUUID(index)
+}
+
+func siteUUID(index int) string {
+	return fmt.Sprintf("csv-%d", index)
+}
+
+// coordinates accepts "lat long" and "lat, long" in decimal degrees.
+func (c *converter) coordinates(gps string) string {
+	parts := strings.FieldsFunc(gps, func(r rune) bool {
+		return r == ' ' || r == ',' || r == ';' || r == '\t'
+	})
+	if len(parts) == 0 {
+		return ""
+	}
+	if len(parts) != 2 {
+		c.fail(FieldGPS, 0, gps)
+		return ""
+	}
+	lat, errLat := strconv.ParseFloat(parts[0], 64)
+	lon, errLon := strconv.ParseFloat(parts[1], 64)
+	if errLat != nil || errLon != nil {
+		c.fail(FieldGPS, 0, gps)
+		return ""
+	}
+	return fmt.Sprintf("%.6f %.6f", lat, lon)
+}
+
+func (c *converter) dateTime() time.Time {
+	date := c.value(FieldDate, 0)
+	t, err := c.mapping.parseDate(date)
+	if err != nil {
+		c.fail(FieldDate, 0, date)
+		return time.Time{}
+	}
+	clock := c.value(FieldTime, 0)
+	if clock == "" {
+		return t
+	}
+	for _, layout := range timeLayouts {
+		if tod, err := time.Parse(layout, clock); err == nil {
+			return t.Add(time.Duration(tod.Hour())*time.Hour + time.Duration(tod.Minute())*time.Minute + time.Duration(tod.Second())*time.Second)
+		}
+	}
+	c.fail(FieldTime, 0, clock)
+	return time.Time{}
+}
+
+func (c *converter) duration(field string) time.Duration {
+	s := c.value(field, 0)
+	if s == "" {
+		return 0
+	}
+	switch c.mapping.DurationFormat {
+	case DurationMinutes:
+		return time.Duration(c.number(field, 0) * float64(time.Minute)).Round(time.Second)
+	case DurationSeconds:
+		return time.Duration(c.number(field, 0) * float64(time.Second)).Round(time.Second)
+	default:
+		d, err := subsurface.ParseDuration(s)
+		if err != nil {
+			c.fail(field, 0, s)
+		}
+		return d
+	}
+}
+
+// sampleTime is read in the duration format, but sample times with a colon
+// are always minutes and seconds, as in the dive profiles Subsurface exports.
+func (c *converter) sampleTime() time.Duration {
+	s := c.value(FieldSampleTime, 0)
+	if strings.Contains(s, ":") {
+		d, err := subsurface.ParseDuration(s)
+		if err != nil {
+			c.fail(FieldSampleTime, 0, s)
+		}
+		return d
+	}
+	return c.duration(FieldSampleTime)
+}
+
+func (c *converter) depth(field string, i int) subsurface.Depth {
+	return subsurface.Depth(c.scaled(field, i, feetToMeters))
+}
+
+func (c *converter) temperature(field string, i int) subsurface.Temperature {
+	if c.value(field, i) == "" {
+		return 0
+	}
+	v := c.number(field, i)
+	if c.mapping.Units == UnitsImperial {
+		v = thousandths((v - 32) * 5 / 9)
+	}
+	return subsurface.Temperature(v + zeroCelsius)
+}
+
+// scaled returns a number, multiplied by the conversion factor to metric
+// units if the file is in imperial units.
+func (c *converter) scaled(field string, i int, imperial float64) float64 {
+	v := c.number(field, i)
+	if c.mapping.Units == UnitsImperial {
+		v = thousandths(v * imperial)
+	}
+	return v
+}
+
+// number parses a decimal value. An empty string yields zero. Decimal commas
+// are accepted if the separator is not a comma. The first invalid value is
+// kept as the error of the conversion.
+func (c *converter) number(field string, i int) float64 {
+	s := c.value(field, i)
+	if s == "" || c.err != nil {
+		return 0
+	}
+	if c.mapping.Separator != "," && !strings.Contains(s, ".") {
+		s = strings.Replace(s, ",", ".", 1)
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		c.fail(field, i, s)
+		return 0
+	}
+	return v
+}
+
+// value returns the trimmed value of the i-th column of a field in the
+// current row, or an empty string if the column is not in the file.
+func (c *converter) value(field string, i int) string {
+	columns := c.columns[field]
+	if i >= len(columns) || columns[i] < 0 || columns[i] >= len(c.fields) {
+		return ""
+	}
+	return strings.TrimSpace(c.fields[columns[i]])
+}
+
+func (c *converter) mapped(field string) bool {
+	for _, column := range c.columns[field] {
+		if column >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *converter) fail(field string, i int, s string) {
+	if c.err != nil {
+		return
+	}
+	c.err = &subsurface.DecodeError{
+		Path: fmt.Sprintf("csv/row[%d]/%s", c.row, c.header[c.columns[field][i]]),
+		Line: c.line,
+		Err:  fmt.Errorf("%w: %s %q", subsurface.ErrInvalidValue, field, s),
+	}
+}
+
+// thousandths rounds a converted value to the resolution Subsurface stores,
+// e.g. millimeters and millibar.
+func thousandths(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+func csvError(err error) error {
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return &subsurface.DecodeError{
+			Path:   "csv",
+			Line:   parseErr.Line,
+			Column: parseErr.Column,
+			Err:    parseErr.Err,
+		}
+	}
+	return err
+}
+
+func isBlank(fields []string) bool {
+	for _, field := range fields {
+		if strings.TrimSpace(field) != "" {
+			return false
+		}
+	}
+	return true
+}
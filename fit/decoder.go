@@ -0,0 +1,382 @@
+package fit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"src.acicovic.me/divelog/subsurface"
+)
+
+// FIT (Flexible and Interoperable Data Transfer) files are a header followed by
+// records, which are either definitions or data messages. A definition assigns
+// a layout to one of 16 local message types, and the data messages that follow
+// are read with it. Only the messages that the caller asks for are kept; the
+// rest are skipped by their definitions.
+
+const (
+	headerSizeNoCRC = 12
+	headerSizeCRC   = 14
+
+	// record header bits
+	compressedTimestampFlag = 0x80
+	definitionFlag          = 0x40
+	developerDataFlag       = 0x20
+	localTypeMask           = 0x0f
+
+	fieldTimestamp    = 253
+	fieldMessageIndex = 254
+)
+
+var (
+	ErrNotFIT       = errors.New("not a FIT file")
+	ErrChecksum     = errors.New("checksum mismatch")
+	ErrNoDefinition = errors.New("data message without a definition")
+)
+
+var fitSignature = []byte(".FIT")
+
+type fieldDefinition struct {
+	num      uint8
+	size     int
+	baseType uint8
+}
+
+type definition struct {
+	num       uint16
+	bigEndian bool
+	fields    []fieldDefinition
+	size      int // data message size, including developer fields
+}
+
+type field struct {
+	baseType  uint8
+	bigEndian bool
+	data      []byte
+}
+
+// message is a decoded data message. Fields hold raw bytes, which are
+// converted by the accessors; invalid values are reported as missing.
+type message struct {
+	num    uint16
+	fields map[uint8]field
+}
+
+// readMessages decodes the data messages of a FIT file, keeping those for which
+// keep returns true. Chained FIT files are read one after another. The checksum
+// of every file is verified, so an incomplete file is never taken for a valid
+// one.
+func readMessages(data []byte, keep func(num uint16) bool) ([]*message, error) {
+	var (
+		messages []*message
+		records  int
+	)
+	for start := 0; start < len(data); {
+		headerSize, dataSize, err := readHeader(data[start:])
+		if err != nil {
+			return nil, &subsurface.DecodeError{Path: "fit", Offset: int64(start), Err: err}
+		}
+		end := start + headerSize + dataSize
+		if end+2 > len(data) {
+			return nil, &subsurface.DecodeError{Path: "fit", Offset: int64(len(data)), Err: fmt.Errorf("file is truncated")}
+		}
+		if crc := binary.LittleEndian.Uint16(data[end:]); crc != checksum(0, data[start:end]) {
+			return nil, &subsurface.DecodeError{Path: "fit", Offset: int64(end), Err: ErrChecksum}
+		}
+
+		r := recordReader{data: data[:end], pos: start + headerSize, keep: keep, records: records}
+		for r.pos < end {
+			msg, err := r.next()
+			if err != nil {
+				return nil, &subsurface.DecodeError{
+					Path:   fmt.Sprintf("fit/record[%d]", r.records),
+					Offset: int64(r.pos),
+					Err:    err,
+				}
+			}
+			if msg != nil {
+				messages = append(messages, msg)
+			}
+		}
+		records = r.records
+		start = end + 2
+	}
+	return messages, nil
+}
+
+func readHeader(data []byte) (headerSize int, dataSize int, err error) {
+	if len(data) < headerSizeNoCRC {
+		return 0, 0, ErrNotFIT
+	}
+	headerSize = int(data[0])
+	if headerSize < headerSizeNoCRC || len(data) < headerSize || !bytes.Equal(data[8:12], fitSignature) {
+		return 0, 0, ErrNotFIT
+	}
+	if headerSize >= headerSizeCRC {
+		// a zero header checksum means that it was not computed
+		if crc := binary.LittleEndian.Uint16(data[12:]); crc != 0 && crc != checksum(0, data[:12]) {
+			return 0, 0, fmt.Errorf("header %w", ErrChecksum)
+		}
+	}
+	return headerSize, int(binary.LittleEndian.Uint32(data[4:])), nil
+}
+
+type recordReader struct {
+	data        []byte
+	pos         int
+	keep        func(num uint16) bool
+	definitions [localTypeMask + 1]*definition
+	timestamp   uint32 // of the last message with one, for compressed timestamps
+	records     int
+}
+
+// next reads a record and returns its message, or nil for definitions and for
+// messages that are not kept.
+func (r *recordReader) next() (*message, error) {
+	r.records++
+	header, err := r.bytes(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if header[0]&compressedTimestampFlag != 0 {
+		offset := uint32(header[0] & 0x1f)
+		r.timestamp += (offset - r.timestamp) & 0x1f
+		return r.readData(int(header[0]>>5)&0x03, true)
+	}
+	local := int(header[0] & localTypeMask)
+	if header[0]&definitionFlag != 0 {
+		return nil, r.readDefinition(local, header[0]&developerDataFlag != 0)
+	}
+	return r.readData(local, false)
+}
+
+func (r *recordReader) readDefinition(local int, developerData bool) error {
+	fixed, err := r.bytes(5)
+	if err != nil {
+		return err
+	}
+	def := &definition{bigEndian: fixed[1] == 1}
+	if def.bigEndian {
+		def.num = binary.BigEndian.Uint16(fixed[2:])
+	} else {
+		def.num = binary.LittleEndian.Uint16(fixed[2:])
+	}
+
+	fields, err := r.bytes(3 * int(fixed[4]))
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(fields); i += 3 {
+		fd := fieldDefinition{num: fields[i], size: int(fields[i+1]), baseType: fields[i+2]}
+		def.fields = append(def.fields, fd)
+		def.size += fd.size
+	}
+
+	if developerData {
+		count, err := r.bytes(1)
+		if err != nil {
+			return err
+		}
+		devFields, err := r.bytes(3 * int(count[0]))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(devFields); i += 3 {
+			def.size += int(devFields[i+1])
+		}
+	}
+
+	r.definitions[local] = def
+	return nil
+}
+
+func (r *recordReader) readData(local int, compressedTimestamp bool) (*message, error) {
+	def := r.definitions[local]
+	if def == nil {
+		return nil, ErrNoDefinition
+	}
+	data, err := r.bytes(def.size)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &message{num: def.num, fields: make(map[uint8]field, len(def.fields))}
+	for _, fd := range def.fields {
+		msg.fields[fd.num] = field{baseType: fd.baseType, bigEndian: def.bigEndian, data: data[:fd.size]}
+		data = data[fd.size:]
+	}
+
+	if compressedTimestamp {
+		var ts [4]byte
+		binary.LittleEndian.PutUint32(ts[:], r.timestamp)
+		msg.fields[fieldTimestamp] = field{baseType: baseUint32, data: ts[:]}
+	} else if ts, ok := msg.uint(fieldTimestamp); ok {
+		r.timestamp = uint32(ts)
+	}
+
+	if !r.keep(def.num) {
+		return nil, nil
+	}
+	return msg, nil
+}
+
+func (r *recordReader) bytes(n int) ([]byte, error) {
+	if r.pos+n > len(r.data) {
+		return nil, fmt.Errorf("record ends after the end of data")
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+// Base types, identified by the low bits of the base type number; the high bit
+// only tells whether the type is wider than a byte.
+const (
+	baseEnum    = 0x00
+	baseSint8   = 0x01
+	baseUint8   = 0x02
+	baseSint16  = 0x83
+	baseUint16  = 0x84
+	baseSint32  = 0x85
+	baseUint32  = 0x86
+	baseString  = 0x07
+	baseFloat32 = 0x88
+	baseFloat64 = 0x89
+	baseUint8z  = 0x0a
+	baseUint16z = 0x8b
+	baseUint32z = 0x8c
+	baseByte    = 0x0d
+	baseSint64  = 0x8e
+	baseUint64  = 0x8f
+	baseUint64z = 0x90
+)
+
+func (f field) size() int {
+	switch f.baseType {
+	case baseSint16, baseUint16, baseUint16z:
+		return 2
+	case baseSint32, baseUint32, baseUint32z, baseFloat32:
+		return 4
+	case baseSint64, baseUint64, baseUint64z, baseFloat64:
+		return 8
+	default:
+		return 1
+	}
+}
+
+// raw returns the first element of the field as an unsigned integer, and
+// whether it is valid. Every base type reserves one value for invalid.
+func (f field) raw() (uint64, bool) {
+	size := f.size()
+	if len(f.data) < size {
+		return 0, false
+	}
+
+	var v uint64
+	for i := 0; i < size; i++ {
+		b := f.data[i]
+		if f.bigEndian {
+			v = v<<8 | uint64(b)
+		} else {
+			v |= uint64(b) << (8 * i)
+		}
+	}
+
+	var invalid uint64
+	switch f.baseType {
+	case baseUint8z, baseUint16z, baseUint32z, baseUint64z:
+		invalid = 0
+	case baseSint8, baseSint16, baseSint32, baseSint64:
+		invalid = 1<<(8*size-1) - 1
+	default:
+		invalid = 1<<(8*size) - 1
+		if size == 8 {
+			invalid = math.MaxUint64
+		}
+	}
+	return v, v != invalid
+}
+
+func (m *message) uint(num uint8) (uint64, bool) {
+	f, ok := m.fields[num]
+	if !ok {
+		return 0, false
+	}
+	return f.raw()
+}
+
+func (m *message) int(num uint8) (int64, bool) {
+	f, ok := m.fields[num]
+	if !ok {
+		return 0, false
+	}
+	v, ok := f.raw()
+	if !ok {
+		return 0, false
+	}
+	switch f.baseType {
+	case baseSint8:
+		return int64(int8(v)), true
+	case baseSint16:
+		return int64(int16(v)), true
+	case baseSint32:
+		return int64(int32(v)), true
+	default:
+		return int64(v), true
+	}
+}
+
+// scaled returns a numeric field divided by the scale of its profile definition.
+func (m *message) scaled(num uint8, scale float64) (float64, bool) {
+	f, ok := m.fields[num]
+	if !ok {
+		return 0, false
+	}
+	switch f.baseType {
+	case baseFloat32, baseFloat64:
+		v, ok := f.raw()
+		if !ok {
+			return 0, false
+		}
+		if f.baseType == baseFloat32 {
+			return float64(math.Float32frombits(uint32(v))) / scale, true
+		}
+		return math.Float64frombits(v) / scale, true
+	default:
+		v, ok := m.int(num)
+		return float64(v) / scale, ok
+	}
+}
+
+func (m *message) string(num uint8) string {
+	f, ok := m.fields[num]
+	if !ok || f.baseType != baseString {
+		return ""
+	}
+	if i := bytes.IndexByte(f.data, 0); i != -1 {
+		return string(f.data[:i])
+	}
+	return string(f.data)
+}
+
+var checksumTable = [16]uint16{
+	0x0000, 0xcc01, 0xd801, 0x1400, 0xf001, 0x3c00, 0x2800, 0xe401,
+	0xa001, 0x6c00, 0x7800, 0xb401, 0x5000, 0x9c01, 0x8801, 0x4400,
+}
+
+// checksum computes the CRC-16 that FIT files use for the header and the file.
+func checksum(crc uint16, data []byte) uint16 {
+	for _, b := range data {
+		tmp := checksumTable[crc&0x0f]
+		crc = (crc >> 4) & 0x0fff
+		crc = crc ^ tmp ^ checksumTable[b&0x0f]
+
+		tmp = checksumTable[crc&0x0f]
+		crc = (crc >> 4) & 0x0fff
+		crc = crc ^ tmp ^ checksumTable[(b>>4)&0x0f]
+	}
+	return crc
+}
@@ -0,0 +1,200 @@
+package fit
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+
+	"src.acicovic.me/divelog/subsurface"
+)
+
+// fitBuilder writes FIT files for the tests, one record at a time.
+type fitBuilder struct {
+	records []byte
+	endian  [localTypeMask + 1]binary.AppendByteOrder
+}
+
+// def writes a definition of the local message type. Fields are given as
+// number, size and base type; devSizes are the sizes of developer fields.
+func (b *fitBuilder) def(local int, num uint16, bigEndian bool, fields [][3]byte, devSizes ...byte) {
+	header := byte(definitionFlag | local)
+	if len(devSizes) > 0 {
+		header |= developerDataFlag
+	}
+	var arch byte
+	b.endian[local] = binary.LittleEndian
+	if bigEndian {
+		b.endian[local], arch = binary.BigEndian, 1
+	}
+	b.records = append(b.records, header, 0, arch)
+	b.records = b.endian[local].AppendUint16(b.records, num)
+	b.records = append(b.records, byte(len(fields)))
+	for _, f := range fields {
+		b.records = append(b.records, f[:]...)
+	}
+	if len(devSizes) > 0 {
+		b.records = append(b.records, byte(len(devSizes)))
+		for i, size := range devSizes {
+			b.records = append(b.records, byte(i), size, 0)
+		}
+	}
+}
+
+// data writes a data message of the local type. Values are written in the
+// byte order of its definition, with the size of their Go type.
+func (b *fitBuilder) data(local int, values ...any) {
+	b.records = append(b.records, byte(local))
+	b.values(local, values)
+}
+
+// compressed writes a data message with a compressed timestamp, which is
+// the low five bits of its timestamp.
+func (b *fitBuilder) compressed(local int, timestamp uint32, values ...any) {
+	b.records = append(b.records, compressedTimestampFlag|byte(local)<<5|byte(timestamp&0x1f))
+	b.values(local, values)
+}
+
+func (b *fitBuilder) values(local int, values []any) {
+	order := b.endian[local]
+	if order == nil {
+		order = binary.LittleEndian
+	}
+	for _, v := range values {
+		switch v := v.(type) {
+		case uint8:
+			b.records = append(b.records, v)
+		case int8:
+			b.records = append(b.records, byte(v))
+		case uint16:
+			b.records = order.AppendUint16(b.records, v)
+		case uint32:
+			b.records = order.AppendUint32(b.records, v)
+		case int32:
+			b.records = order.AppendUint32(b.records, uint32(v))
+		case float32:
+			b.records = order.AppendUint32(b.records, math.Float32bits(v))
+		case string:
+			b.records = append(b.records, v...)
+		case []byte:
+			b.records = append(b.records, v...)
+		default:
+			panic("unsupported value")
+		}
+	}
+}
+
+// bytes returns the file: a header with its checksum, the records and the
+// checksum of the file.
+func (b *fitBuilder) bytes() []byte {
+	file := []byte{headerSizeCRC, 0x20}
+	file = binary.LittleEndian.AppendUint16(file, 2132)
+	file = binary.LittleEndian.AppendUint32(file, uint32(len(b.records)))
+	file = append(file, fitSignature...)
+	file = binary.LittleEndian.AppendUint16(file, checksum(0, file))
+	file = append(file, b.records...)
+	return binary.LittleEndian.AppendUint16(file, checksum(0, file))
+}
+
+func keepAll(uint16) bool { return true }
+
+func TestReadMessages(t *testing.T) {
+	const ts = 1000000000
+	b := &fitBuilder{}
+	b.def(0, mesgRecord, false, [][3]byte{{fieldTimestamp, 4, baseUint32}, {recordDepth, 4, baseUint32}, {recordTemperature, 1, baseSint8}})
+	b.data(0, uint32(ts), uint32(1500), int8(-2))
+	// the same message in big-endian, with a developer field that is skipped
+	b.def(1, mesgRecord, true, [][3]byte{{fieldTimestamp, 4, baseUint32}, {recordDepth, 4, baseUint32}}, 4)
+	b.data(1, uint32(ts+20), uint32(30500), []byte{0xde, 0xad, 0xbe, 0xef})
+	// compressed timestamps count from the last timestamp, and roll over
+	b.def(2, mesgRecord, false, [][3]byte{{recordDepth, 4, baseUint32}})
+	b.compressed(2, ts+25, uint32(29000))
+	b.compressed(2, ts+40, uint32(20000))
+	// messages that are not asked for are skipped by their definition
+	b.def(3, mesgDeviceInfo, false, [][3]byte{{deviceInfoProductName, 8, baseString}})
+	b.data(3, "Descent\x00")
+	b.data(0, uint32(ts+60), uint32(0xffffffff), int8(0x7f))
+
+	messages, err := readMessages(b.bytes(), func(num uint16) bool { return num == mesgRecord })
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		timestamp uint64
+		depth     float64
+		valid     bool
+	}{
+		{ts, 1.5, true},
+		{ts + 20, 30.5, true},
+		{ts + 25, 29, true},
+		{ts + 40, 20, true},
+		{ts + 60, 0, false},
+	}
+	if len(messages) != len(want) {
+		t.Fatalf("%d messages, want %d", len(messages), len(want))
+	}
+	for i, w := range want {
+		msg := messages[i]
+		timestamp, _ := msg.uint(fieldTimestamp)
+		depth, ok := msg.scaled(recordDepth, 1000)
+		if msg.num != mesgRecord || timestamp != w.timestamp || depth != w.depth || ok != w.valid {
+			t.Errorf("message %d: num %d, timestamp %d, depth %v (%v)", i, msg.num, timestamp, depth, ok)
+		}
+	}
+	if temp, ok := messages[0].int(recordTemperature); !ok || temp != -2 {
+		t.Errorf("temperature = %d (%v), want -2", temp, ok)
+	}
+	if _, ok := messages[4].int(recordTemperature); ok {
+		t.Error("an invalid temperature was read")
+	}
+}
+
+func TestReadMessagesErrors(t *testing.T) {
+	b := &fitBuilder{}
+	b.def(0, mesgRecord, false, [][3]byte{{fieldTimestamp, 4, baseUint32}})
+	b.data(0, uint32(1000))
+	valid := b.bytes()
+
+	corrupt := func(damage func(file []byte) []byte) []byte {
+		return damage(append([]byte(nil), valid...))
+	}
+	noDefinition := &fitBuilder{}
+	noDefinition.data(0, uint32(1000))
+	shortRecord := &fitBuilder{}
+	shortRecord.def(0, mesgRecord, false, [][3]byte{{fieldTimestamp, 4, baseUint32}})
+	shortRecord.records = append(shortRecord.records, 0, 1, 2)
+
+	for _, tc := range []struct {
+		name  string
+		input []byte
+		cause error
+	}{
+		{"not FIT", []byte("<divelog program='subsurface'/>"), ErrNotFIT},
+		{"data checksum", corrupt(func(f []byte) []byte { f[len(f)-4] ^= 1; return f }), ErrChecksum},
+		{"header checksum", corrupt(func(f []byte) []byte { f[12] ^= 1; return f }), ErrChecksum},
+		{"truncated", valid[:len(valid)-3], nil},
+		{"truncated header", valid[:10], ErrNotFIT},
+		{"no definition", noDefinition.bytes(), ErrNoDefinition},
+		{"record past the end", shortRecord.bytes(), nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := readMessages(tc.input, keepAll)
+			var decodeErr *subsurface.DecodeError
+			if !errors.As(err, &decodeErr) {
+				t.Fatalf("err = %v, want a DecodeError", err)
+			}
+			if tc.cause != nil && !errors.Is(err, tc.cause) {
+				t.Errorf("err = %v, want %v", err, tc.cause)
+			}
+		})
+	}
+
+	if messages, err := readMessages(nil, keepAll); err != nil || len(messages) != 0 {
+		t.Errorf("no input: %d messages, %v", len(messages), err)
+	}
+	// chained files are read one after another
+	messages, err := readMessages(append(append([]byte(nil), valid...), valid...), keepAll)
+	if err != nil || len(messages) != 2 {
+		t.Errorf("chained files: %d messages, %v", len(messages), err)
+	}
+}
@@ -0,0 +1,382 @@
+package fit
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"src.acicovic.me/divelog/subsurface"
+)
+
+// MaxFileSize is the largest FIT file that is read. A dive activity with
+// per-second records is a few hundred kilobytes.
+const MaxFileSize = 16 << 20
+
+// Program is reported in the header of logs decoded by Decode.
+const Program = "Garmin FIT"
+
+var (
+	ErrNotADive     = errors.New("FIT file is not a dive activity")
+	ErrFileTooLarge = errors.New("FIT file is too large")
+)
+
+// Global message numbers and field numbers from the FIT profile.
+const (
+	mesgFileID       = 0
+	mesgSession      = 18
+	mesgRecord       = 20
+	mesgDeviceInfo   = 23
+	mesgActivity     = 34
+	mesgDiveSettings = 258
+	mesgDiveGas      = 259
+	mesgDiveSummary  = 268
+
+	fileIDType         = 0
+	fileIDManufacturer = 1
+	fileIDSerialNumber = 3
+
+	sessionStartTime        = 2
+	sessionStartPositionLat = 3
+	sessionStartPositionLon = 4
+	sessionSport            = 5
+	sessionTotalElapsedTime = 7
+
+	recordPositionLat   = 0
+	recordPositionLon   = 1
+	recordTemperature   = 13
+	recordDepth         = 92
+	recordNextStopDepth = 93
+	recordTimeToSurface = 95
+	recordNDLTime       = 96
+
+	deviceInfoDeviceIndex = 0
+	deviceInfoProductName = 27
+
+	activityLocalTimestamp = 5
+
+	diveSettingsWaterType    = 3
+	diveSettingsWaterDensity = 4
+
+	diveGasHelium = 0
+	diveGasOxygen = 1
+	diveGasStatus = 2
+	diveGasMode   = 3
+
+	diveSummaryReferenceMesg  = 0
+	diveSummaryReferenceIndex = 1
+	diveSummaryAvgDepth       = 2
+	diveSummaryMaxDepth       = 3
+	diveSummaryDiveNumber     = 10
+)
+
+const (
+	fileTypeActivity    = 4
+	manufacturerGarmin  = 1
+	sportDiving         = 53
+	deviceIndexCreator  = 0
+	diveGasEnabled      = 1
+	diveGasModeDiluent  = 1
+	waterTypeFresh      = 0
+	waterTypeSalt       = 1
+	waterTypeEN13319    = 2
+	waterTypeCustom     = 3
+	densityEN13319      = 1020
+	semicirclesToDegree = 180.0 / (1 << 31)
+)
+
+// FIT timestamps are seconds since the FIT epoch.
+var epoch = time.Date(1989, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+// Dive is a dive decoded from a FIT activity. DiveSiteUUID is set to an ID
+// derived from the dive, as FIT files do not name dive sites.
+type Dive struct {
+	subsurface.DiveDataHolder
+	Coords string // entry position as "lat long", empty if it was not recorded
+}
+
+// Detect reports whether the buffered input is a FIT file. The input is not consumed.
+func Detect(br *bufio.Reader) bool {
+	header, _ := br.Peek(headerSizeNoCRC)
+	return len(header) == headerSizeNoCRC && bytes.Equal(header[8:12], fitSignature)
+}
+
+// Decode decodes a FIT activity and reports its dives to the handler, each
+// at its own dive site, in the same way subsurface.DecodeSubsurfaceDatabase
+// does for Subsurface databases.
+func Decode(r io.Reader, h subsurface.Handler) error {
+	if r == nil {
+		return subsurface.ErrNilReader
+	}
+	if h == nil {
+		return subsurface.ErrNilHandler
+	}
+
+	dives, err := ReadDives(r)
+	if err != nil {
+		return err
+	}
+	records := []subsurface.Record{&subsurface.HeaderRecord{Program: Program}}
+	for i, dive := range dives {
+		records = append(records, &subsurface.SiteRecord{
+			Index:  i + 1,
+			UUID:   dive.DiveSiteUUID,
+			Coords: dive.Coords,
+		})
+	}
+	for _, dive := range dives {
+		records = append(records, &subsurface.DiveRecord{DiveDataHolder: dive.DiveDataHolder})
+	}
+	return subsurface.ReportRecordSlice(records, h)
+}
+
+// ReadDives decodes the dives of a FIT activity: one for every diving session,
+// with its samples, gases and the summary written by the dive computer.
+// Activities of other sports are reported as ErrNotADive.
+func ReadDives(r io.Reader) ([]*Dive, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxFileSize {
+		return nil, ErrFileTooLarge
+	}
+
+	messages, err := readMessages(data, func(num uint16) bool {
+		switch num {
+		case mesgFileID, mesgSession, mesgRecord, mesgDeviceInfo, mesgActivity,
+			mesgDiveSettings, mesgDiveGas, mesgDiveSummary:
+			return true
+		}
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a := newActivity(messages)
+	if a.fileType != fileTypeActivity {
+		return nil, ErrNotADive
+	}
+	var dives []*Dive
+	for i, session := range a.sessions {
+		if sport, _ := session.uint(sessionSport); sport == sportDiving {
+			dives = append(dives, a.dive(i, session))
+		}
+	}
+	if len(dives) == 0 {
+		return nil, ErrNotADive
+	}
+	return dives, nil
+}
+
+// activity holds the messages of a FIT file that describe its dives.
+type activity struct {
+	fileType     uint64
+	manufacturer uint64
+	serial       uint64
+	model        string
+	localOffset  time.Duration // local time minus UTC
+	salinity     subsurface.Density
+	sessions     []*message
+	records      []*message
+	summaries    []*message
+	gases        []*message
+}
+
+func newActivity(messages []*message) *activity {
+	a := &activity{fileType: math.MaxUint64}
+	for _, msg := range messages {
+		switch msg.num {
+		case mesgFileID:
+			a.fileType, _ = msg.uint(fileIDType)
+			a.manufacturer, _ = msg.uint(fileIDManufacturer)
+			a.serial, _ = msg.uint(fileIDSerialNumber)
+		case mesgSession:
+			a.sessions = append(a.sessions, msg)
+		case mesgRecord:
+			a.records = append(a.records, msg)
+		case mesgDeviceInfo:
+			if index, ok := msg.uint(deviceInfoDeviceIndex); ok && index == deviceIndexCreator {
+				if name := msg.string(deviceInfoProductName); name != "" {
+					a.model = name
+				}
+			}
+		case mesgActivity:
+			ts, okUTC := msg.uint(fieldTimestamp)
+			local, okLocal := msg.uint(activityLocalTimestamp)
+			if okUTC && okLocal {
+				a.localOffset = time.Duration(int64(local)-int64(ts)) * time.Second
+			}
+		case mesgDiveSettings:
+			a.salinity = waterDensity(msg)
+		case mesgDiveGas:
+			a.gases = append(a.gases, msg)
+		case mesgDiveSummary:
+			a.summaries = append(a.summaries, msg)
+		}
+	}
+	if a.model == "" && a.manufacturer == manufacturerGarmin {
+		a.model = "Garmin"
+	}
+	return a
+}
+
+func (a *activity) dive(index int, session *message) *Dive {
+	start, ok := session.uint(sessionStartTime)
+	if !ok && len(a.records) > 0 {
+		start, _ = a.records[0].uint(fieldTimestamp)
+	}
+	elapsed, ok := session.scaled(sessionTotalElapsedTime, 1000)
+	if !ok {
+		elapsed = math.Inf(1)
+	}
+
+	dive := &Dive{DiveDataHolder: subsurface.DiveDataHolder{
+		DiveSiteUUID:      fmt.Sprintf("fit-%08x", start),
+		WaterSalinity:     a.salinity,
+		DateTime:          epoch.Add(time.Duration(start)*time.Second + a.localOffset),
+		DiveComputerModel: a.model,
+	}}
+	if a.serial != 0 {
+		dive.DiveComputerDeviceID = strconv.FormatUint(a.serial, 10)
+	}
+	dive.DiveComputerDiveID = fmt.Sprintf("%08x", start)
+
+	lat, okLat := session.int(sessionStartPositionLat)
+	lon, okLon := session.int(sessionStartPositionLon)
+	for _, record := range a.records {
+		ts, _ := record.uint(fieldTimestamp)
+		offset := float64(ts) - float64(start)
+		if offset < 0 || offset > elapsed {
+			continue
+		}
+		if !okLat || !okLon {
+			// dive computers record the position only at the surface
+			lat, okLat = record.int(recordPositionLat)
+			lon, okLon = record.int(recordPositionLon)
+		}
+		dive.Samples = append(dive.Samples, sample(record, subsurface.Seconds(offset)))
+	}
+	if okLat && okLon {
+		dive.Coords = fmt.Sprintf("%.6f %.6f", float64(lat)*semicirclesToDegree, float64(lon)*semicirclesToDegree)
+	}
+	if !math.IsInf(elapsed, 1) {
+		dive.Duration = subsurface.Seconds(elapsed)
+	} else if len(dive.Samples) > 0 {
+		dive.Duration = dive.Samples[len(dive.Samples)-1].Time
+	}
+
+	for _, gas := range a.gases {
+		if status, _ := gas.uint(diveGasStatus); status != diveGasEnabled {
+			continue
+		}
+		o2, _ := gas.uint(diveGasOxygen)
+		he, _ := gas.uint(diveGasHelium)
+		cyl := subsurface.CylinderDataHolder{
+			O2:  subsurface.Fraction(o2),
+			He:  subsurface.Fraction(he),
+			Use: "OC-gas",
+		}
+		if mode, _ := gas.uint(diveGasMode); mode == diveGasModeDiluent {
+			cyl.Use = "diluent"
+		}
+		dive.Cylinders = append(dive.Cylinders, cyl)
+	}
+
+	if summary := a.summary(index, session); summary != nil {
+		if number, ok := summary.uint(diveSummaryDiveNumber); ok {
+			dive.DiveNumber = int(number)
+		}
+		if depth, ok := summary.scaled(diveSummaryMaxDepth, 1000); ok {
+			dive.DepthMax = subsurface.Depth(depth)
+		}
+		if depth, ok := summary.scaled(diveSummaryAvgDepth, 1000); ok {
+			dive.DepthMean = subsurface.Depth(depth)
+		}
+	}
+	for _, s := range dive.Samples {
+		if s.Depth > dive.DepthMax {
+			dive.DepthMax = s.Depth
+		}
+		if s.Temperature != 0 && (dive.TemperatureWaterMin == 0 || s.Temperature < dive.TemperatureWaterMin) {
+			dive.TemperatureWaterMin = s.Temperature
+		}
+	}
+	if dive.DepthMean == 0 {
+		dive.DepthMean = subsurface.MeanDepth(dive.Samples)
+	}
+
+	if len(dive.Samples) > 0 || dive.DepthMax != 0 {
+		dive.DiveComputers = []subsurface.DiveComputerDataHolder{{
+			Primary:             true,
+			Model:               dive.DiveComputerModel,
+			DeviceID:            dive.DiveComputerDeviceID,
+			DiveID:              dive.DiveComputerDiveID,
+			DepthMax:            dive.DepthMax,
+			DepthMean:           dive.DepthMean,
+			TemperatureWaterMin: dive.TemperatureWaterMin,
+			Samples:             dive.Samples,
+		}}
+	}
+	return dive
+}
+
+// summary returns the dive summary of a session. Summaries refer to their
+// session by its message index, which defaults to the position of the session.
+func (a *activity) summary(index int, session *message) *message {
+	sessionIndex := uint64(index)
+	if v, ok := session.uint(fieldMessageIndex); ok {
+		sessionIndex = v
+	}
+	for _, summary := range a.summaries {
+		mesg, _ := summary.uint(diveSummaryReferenceMesg)
+		ref, ok := summary.uint(diveSummaryReferenceIndex)
+		if mesg == mesgSession && (!ok || ref == sessionIndex) {
+			return summary
+		}
+	}
+	return nil
+}
+
+func sample(record *message, offset time.Duration) subsurface.Sample {
+	s := subsurface.Sample{Time: offset}
+	if depth, ok := record.scaled(recordDepth, 1000); ok {
+		s.Depth = subsurface.Depth(depth)
+	}
+	if temp, ok := record.int(recordTemperature); ok {
+		s.Temperature = subsurface.Temperature(float64(temp) + 273.15)
+	}
+	if ndl, ok := record.uint(recordNDLTime); ok {
+		s.NDL = time.Duration(ndl) * time.Second
+	}
+	if tts, ok := record.uint(recordTimeToSurface); ok {
+		s.TTS = time.Duration(tts) * time.Second
+	}
+	if stop, ok := record.scaled(recordNextStopDepth, 1000); ok {
+		s.Ceiling = subsurface.Depth(stop)
+		s.InDeco = stop > 0
+	}
+	return s
+}
+
+func waterDensity(settings *message) subsurface.Density {
+	waterType, _ := settings.uint(diveSettingsWaterType)
+	switch waterType {
+	case waterTypeFresh:
+		return subsurface.DensityFreshWater
+	case waterTypeSalt:
+		return subsurface.DensitySaltWater
+	case waterTypeEN13319:
+		return densityEN13319
+	case waterTypeCustom:
+		// kg/m³ is the same as g/l
+		density, _ := settings.scaled(diveSettingsWaterDensity, 1)
+		return subsurface.Density(math.Round(density))
+	}
+	return 0
+}
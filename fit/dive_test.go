@@ -0,0 +1,139 @@
+package fit
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"src.acicovic.me/divelog/subsurface"
+)
+
+const diveStart = 1000000000 // 2021-09-08 01:46:40 UTC in FIT time
+
+func semicircles(degrees float64) int32 {
+	return int32(math.Round(degrees / semicirclesToDegree))
+}
+
+// diveActivity builds a FIT activity with one dive of 30 minutes, recorded
+// by a dive computer in a time zone two hours ahead of UTC.
+func diveActivity(fileType uint8, sport uint8) []byte {
+	const ts = diveStart
+	b := &fitBuilder{}
+	b.def(4, mesgFileID, false, [][3]byte{{fileIDType, 1, baseEnum}, {fileIDManufacturer, 2, baseUint16}, {fileIDSerialNumber, 4, baseUint32z}})
+	b.data(4, fileType, uint16(manufacturerGarmin), uint32(12345))
+	b.def(5, mesgDeviceInfo, false, [][3]byte{{deviceInfoDeviceIndex, 1, baseUint8}, {deviceInfoProductName, 12, baseString}})
+	b.data(5, uint8(1), "HRM-Pro\x00\x00\x00\x00\x00")
+	b.data(5, uint8(deviceIndexCreator), "Descent Mk2\x00")
+	b.def(6, mesgDiveSettings, false, [][3]byte{{diveSettingsWaterType, 1, baseEnum}, {diveSettingsWaterDensity, 4, baseFloat32}})
+	b.data(6, uint8(waterTypeCustom), float32(1025))
+	b.def(7, mesgDiveGas, false, [][3]byte{{diveGasHelium, 1, baseUint8}, {diveGasOxygen, 1, baseUint8}, {diveGasStatus, 1, baseEnum}, {diveGasMode, 1, baseEnum}})
+	b.data(7, uint8(0), uint8(32), uint8(diveGasEnabled), uint8(0))
+	b.data(7, uint8(0), uint8(50), uint8(0), uint8(0))
+	b.data(7, uint8(20), uint8(18), uint8(diveGasEnabled), uint8(diveGasModeDiluent))
+
+	// records at the surface with a position, with a compressed timestamp,
+	// with a developer field, and after the end of the dive
+	b.def(1, mesgRecord, false, [][3]byte{{fieldTimestamp, 4, baseUint32}, {recordPositionLat, 4, baseSint32}, {recordPositionLon, 4, baseSint32}, {recordDepth, 4, baseUint32}})
+	b.data(1, uint32(ts), semicircles(28.572), semicircles(34.537), uint32(0))
+	b.def(2, mesgRecord, false, [][3]byte{{recordDepth, 4, baseUint32}, {recordTemperature, 1, baseSint8}})
+	b.compressed(2, ts+10, uint32(5000), int8(24))
+	b.def(3, mesgRecord, true, [][3]byte{{fieldTimestamp, 4, baseUint32}, {recordDepth, 4, baseUint32}, {recordTemperature, 1, baseSint8}, {recordNextStopDepth, 4, baseUint32}, {recordNDLTime, 4, baseUint32}}, 4)
+	b.data(3, uint32(ts+600), uint32(30500), int8(22), uint32(3000), uint32(0), []byte{1, 2, 3, 4})
+	b.def(0, mesgRecord, false, [][3]byte{{fieldTimestamp, 4, baseUint32}, {recordDepth, 4, baseUint32}, {recordTemperature, 1, baseSint8}, {recordNDLTime, 4, baseUint32}})
+	b.data(0, uint32(ts+1800), uint32(0), int8(23), uint32(0xffffffff))
+	b.data(0, uint32(ts+1900), uint32(0), int8(23), uint32(0xffffffff))
+
+	// the session is written in big-endian, without a start position
+	b.def(8, mesgSession, true, [][3]byte{{fieldTimestamp, 4, baseUint32}, {sessionStartTime, 4, baseUint32}, {sessionStartPositionLat, 4, baseSint32}, {sessionStartPositionLon, 4, baseSint32}, {sessionSport, 1, baseEnum}, {sessionTotalElapsedTime, 4, baseUint32}, {fieldMessageIndex, 2, baseUint16}})
+	b.data(8, uint32(ts+1900), uint32(ts), int32(math.MaxInt32), int32(math.MaxInt32), sport, uint32(1800000), uint16(0))
+	// a lap summary comes before the session summary, and is not used
+	b.def(9, mesgDiveSummary, false, [][3]byte{{diveSummaryReferenceMesg, 2, baseUint16}, {diveSummaryReferenceIndex, 2, baseUint16}, {diveSummaryAvgDepth, 4, baseUint32}, {diveSummaryMaxDepth, 4, baseUint32}, {diveSummaryDiveNumber, 4, baseUint32}})
+	b.data(9, uint16(19), uint16(0), uint32(1000), uint32(2000), uint32(7))
+	b.data(9, uint16(mesgSession), uint16(0), uint32(15000), uint32(31000), uint32(42))
+	b.def(10, mesgActivity, false, [][3]byte{{fieldTimestamp, 4, baseUint32}, {activityLocalTimestamp, 4, baseUint32}})
+	b.data(10, uint32(ts+1900), uint32(ts+1900+7200))
+	return b.bytes()
+}
+
+func TestReadDives(t *testing.T) {
+	dives, err := ReadDives(bytes.NewReader(diveActivity(fileTypeActivity, sportDiving)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dives) != 1 {
+		t.Fatalf("%d dives, want 1", len(dives))
+	}
+	dive := dives[0]
+
+	if want := epoch.Add(diveStart*time.Second + 2*time.Hour); !dive.DateTime.Equal(want) {
+		t.Errorf("date and time %v, want %v", dive.DateTime, want)
+	}
+	if dive.DiveSiteUUID != "fit-3b9aca00" || dive.Coords != "28.572000 34.537000" {
+		t.Errorf("site %q at %q", dive.DiveSiteUUID, dive.Coords)
+	}
+	if dive.DiveNumber != 42 || dive.Duration != 30*time.Minute {
+		t.Errorf("dive %d, duration %v", dive.DiveNumber, dive.Duration)
+	}
+	// the summary has the maximum depth between two samples
+	if dive.DepthMax != 31 || dive.DepthMean != 15 {
+		t.Errorf("depth max %v, mean %v", dive.DepthMax, dive.DepthMean)
+	}
+	if dive.WaterSalinity != 1025 || dive.TemperatureWaterMin.Celsius() != 22 {
+		t.Errorf("salinity %v, water %v", dive.WaterSalinity, dive.TemperatureWaterMin)
+	}
+	if dive.DiveComputerModel != "Descent Mk2" || dive.DiveComputerDeviceID != "12345" {
+		t.Errorf("dive computer %q, device %q", dive.DiveComputerModel, dive.DiveComputerDeviceID)
+	}
+
+	wantCylinders := []subsurface.CylinderDataHolder{
+		{O2: 32, Use: "OC-gas"},
+		{O2: 18, He: 20, Use: "diluent"},
+	}
+	if len(dive.Cylinders) != len(wantCylinders) {
+		t.Fatalf("cylinders %+v", dive.Cylinders)
+	}
+	for i, want := range wantCylinders {
+		if got := dive.Cylinders[i]; got.O2 != want.O2 || got.He != want.He || got.Use != want.Use {
+			t.Errorf("cylinder %d: %+v, want %+v", i, got, want)
+		}
+	}
+
+	wantSamples := []subsurface.Sample{
+		{Time: 0},
+		{Time: 10 * time.Second, Depth: 5, Temperature: 24 + 273.15},
+		{Time: 10 * time.Minute, Depth: 30.5, Temperature: 22 + 273.15, Ceiling: 3, InDeco: true},
+		{Time: 30 * time.Minute, Temperature: 23 + 273.15},
+	}
+	if len(dive.Samples) != len(wantSamples) {
+		t.Fatalf("%d samples, want %d", len(dive.Samples), len(wantSamples))
+	}
+	for i, want := range wantSamples {
+		if got := dive.Samples[i]; got != want {
+			t.Errorf("sample %d: %+v, want %+v", i, got, want)
+		}
+	}
+	if len(dive.DiveComputers) != 1 || len(dive.DiveComputers[0].Samples) != len(wantSamples) {
+		t.Errorf("dive computers %+v", dive.DiveComputers)
+	}
+}
+
+func TestReadDivesNotADive(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		fileType uint8
+		sport    uint8
+	}{
+		{"course", 6, sportDiving},
+		{"running", fileTypeActivity, 1},
+	} {
+		if _, err := ReadDives(bytes.NewReader(diveActivity(tc.fileType, tc.sport))); !errors.Is(err, ErrNotADive) {
+			t.Errorf("%s: err = %v, want %v", tc.name, err, ErrNotADive)
+		}
+	}
+
+	if _, err := ReadDives(bytes.NewReader(make([]byte, MaxFileSize+1))); !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("err = %v, want %v", err, ErrFileTooLarge)
+	}
+}
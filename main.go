@@ -1,9 +1,25 @@
 package main
 
 import (
+	"fmt"
+	"os"
+
 	"src.acicovic.me/divelog/server"
 )
 
 func main() {
+	// bluefin export-uddf <database> <output file>
+	if len(os.Args) > 1 && os.Args[1] == "export-uddf" {
+		if len(os.Args) != 4 {
+			fmt.Fprintln(os.Stderr, "usage: bluefin export-uddf <database> <output file>")
+			os.Exit(2)
+		}
+		if err := server.ExportUDDF(os.Args[2], os.Args[3]); err != nil {
+			fmt.Fprintf(os.Stderr, "export failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	server.Run()
 }
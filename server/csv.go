@@ -0,0 +1,144 @@
+package server
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"src.acicovic.me/divelog/divecsv"
+	"src.acicovic.me/divelog/subsurface"
+)
+
+// CSV export of the dive list, with the columns of the dive list Subsurface
+// exports, so that it can be read back by Subsurface and by divecsv with the
+// default mapping. Values are in metric units, without unit names.
+
+const (
+	ContentTypeCSV = "text/csv; charset=utf-8"
+	FileNameCSV    = "dives.csv"
+)
+
+// WriteCSV writes the dives as a CSV dive list. There are as many cylinder
+// columns as the dive with the most cylinders has.
+func (log *DiveLog) WriteCSV(w io.Writer, dives []*Dive) error {
+	cylinders := 0
+	for _, dive := range dives {
+		cylinders = max(cylinders, len(dive.Cylinders))
+	}
+
+	header := []string{
+		divecsv.HeaderNumber,
+		divecsv.HeaderDate,
+		divecsv.HeaderTime,
+		divecsv.HeaderDuration,
+		divecsv.HeaderDepthMax,
+		divecsv.HeaderDepthMean,
+		divecsv.HeaderAirTemp,
+		divecsv.HeaderWaterTemp,
+	}
+	for i := 1; i <= cylinders; i++ {
+		header = append(header,
+			fmt.Sprintf(divecsv.HeaderCylinderSize, i),
+			fmt.Sprintf(divecsv.HeaderStartPressure, i),
+			fmt.Sprintf(divecsv.HeaderEndPressure, i),
+			fmt.Sprintf(divecsv.HeaderO2, i),
+			fmt.Sprintf(divecsv.HeaderHe, i),
+		)
+	}
+	header = append(header,
+		divecsv.HeaderLocation,
+		divecsv.HeaderGPS,
+		divecsv.HeaderDiveMaster,
+		divecsv.HeaderBuddy,
+		divecsv.HeaderSuit,
+		divecsv.HeaderRating,
+		divecsv.HeaderVisibility,
+		divecsv.HeaderNotes,
+		divecsv.HeaderWeight,
+		divecsv.HeaderTags,
+	)
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, dive := range dives {
+		site := log.DiveSites[dive.DiveSiteID]
+		row := []string{
+			formatCSVInt(dive.Number),
+			dive.datetime.Format("2006-01-02"),
+			dive.datetime.Format("15:04:05"),
+			formatCSVDuration(dive.Duration),
+			formatCSV(float64(dive.DepthMax)),
+			formatCSV(float64(dive.DepthMean)),
+			formatCSVTemperature(dive.TempAir),
+			formatCSVTemperature(dive.TempWaterMin),
+		}
+		for i := 0; i < cylinders; i++ {
+			if i >= len(dive.Cylinders) {
+				row = append(row, "", "", "", "", "")
+				continue
+			}
+			cyl := dive.Cylinders[i]
+			row = append(row,
+				formatCSV(float64(cyl.Size)),
+				formatCSV(float64(cyl.StartPressure)),
+				formatCSV(float64(cyl.EndPressure)),
+				formatCSV(float64(cyl.O2)),
+				formatCSV(float64(cyl.He)),
+			)
+		}
+		row = append(row,
+			site.Name,
+			strings.TrimSpace(site.Coordinates),
+			dive.OperatorDM,
+			dive.Buddy,
+			dive.Suit,
+			formatCSVInt(dive.Rating5),
+			formatCSVInt(dive.Visibility5),
+			dive.Notes,
+			formatCSV(float64(dive.Weights)),
+			strings.Join(dive.Tags, ", "),
+		)
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// formatCSV formats a value without the noise of unit conversions; zero means
+// not recorded.
+func formatCSV(v float64) string {
+	if v == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(math.Round(v*1000)/1000, 'f', -1, 64)
+}
+
+func formatCSVInt(v int) string {
+	if v == 0 {
+		return ""
+	}
+	return strconv.Itoa(v)
+}
+
+func formatCSVTemperature(t subsurface.Temperature) string {
+	if t == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(t.Celsius(), 'f', 1, 64)
+}
+
+func formatCSVDuration(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	seconds := int(d.Round(time.Second).Seconds())
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
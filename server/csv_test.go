@@ -0,0 +1,136 @@
+package server
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// exportCSV writes the dives of the fixture as a CSV dive list named name, and
+// returns the log and the path of the file.
+func exportCSV(t *testing.T, name string) (*DiveLog, string) {
+	t.Helper()
+	log, err := buildDatabase(DiveLogMetadata{Source: "../subsurface/testdata/dives.xml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), name)
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err = log.WriteCSV(file, log.Dives[1:]); err != nil {
+		t.Fatal(err)
+	}
+	return log, path
+}
+
+// The export reads back with the default mapping as the same dives.
+func TestCSVExportRoundTrip(t *testing.T) {
+	want, path := exportCSV(t, "dives.csv")
+	got, err := buildDatabase(DiveLogMetadata{Source: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Dives) != len(want.Dives) {
+		t.Fatalf("%d dives, want %d", len(got.Dives)-1, len(want.Dives)-1)
+	}
+
+	for i, w := range want.Dives[1:] {
+		g := got.Dives[i+1]
+		if g.Number != w.Number || g.DateTimeIn != w.DateTimeIn || g.Duration != w.Duration {
+			t.Errorf("dive %d: number %d at %s for %v, want %d at %s for %v",
+				w.ID, g.Number, g.DateTimeIn, g.Duration, w.Number, w.DateTimeIn, w.Duration)
+		}
+		if g.DepthMax != w.DepthMax || g.DepthMean != w.DepthMean || g.Weights != w.Weights {
+			t.Errorf("dive %d: depth %v / %v, weights %v, want %v / %v, %v",
+				w.ID, g.DepthMax, g.DepthMean, g.Weights, w.DepthMax, w.DepthMean, w.Weights)
+		}
+		if math.Abs(float64(g.TempAir-w.TempAir)) > 0.05 || math.Abs(float64(g.TempWaterMin-w.TempWaterMin)) > 0.05 {
+			t.Errorf("dive %d: air %v, water %v, want %v, %v", w.ID, g.TempAir, g.TempWaterMin, w.TempAir, w.TempWaterMin)
+		}
+		if g.Buddy != w.Buddy || g.Notes != w.Notes || g.Rating5 != w.Rating5 || g.Visibility5 != w.Visibility5 {
+			t.Errorf("dive %d: buddy %q, notes %q, rating %d, visibility %d", w.ID, g.Buddy, g.Notes, g.Rating5, g.Visibility5)
+		}
+		if strings.Join(g.Tags, ", ") != strings.Join(w.Tags, ", ") {
+			t.Errorf("dive %d: tags %q, want %q", w.ID, g.Tags, w.Tags)
+		}
+
+		if len(g.Cylinders) != len(w.Cylinders) {
+			t.Errorf("dive %d: %d cylinders, want %d", w.ID, len(g.Cylinders), len(w.Cylinders))
+			continue
+		}
+		for j, wc := range w.Cylinders {
+			gc := g.Cylinders[j]
+			if gc.Size != wc.Size || gc.StartPressure != wc.StartPressure || gc.EndPressure != wc.EndPressure || gc.O2 != wc.O2 || gc.He != wc.He {
+				t.Errorf("dive %d, cylinder %d: %+v, want %+v", w.ID, j+1, gc, wc)
+			}
+		}
+
+		gs, ws := got.DiveSites[g.DiveSiteID], want.DiveSites[w.DiveSiteID]
+		if gs.Name != ws.Name || gs.Coordinates != ws.Coordinates {
+			t.Errorf("dive %d: at %q (%s), want %q (%s)", w.ID, gs.Name, gs.Coordinates, ws.Name, ws.Coordinates)
+		}
+	}
+}
+
+// A mapping can pick the columns of the export by header, in any case, or by
+// position. A CSV file is told by its name only, so the same file named .xml
+// is not read as CSV.
+func TestCSVExportMapping(t *testing.T) {
+	want, path := exportCSV(t, "dives.csv")
+	mapping := filepath.Join(t.TempDir(), "mapping.json")
+	err := os.WriteFile(mapping, []byte(`{
+  "duration_format": "min:sec",
+  "columns": {
+    "number": "#1",
+    "date": "DATE",
+    "time": "#3",
+    "duration": "Duration [min]",
+    "location": "location",
+    "buddy": "buddy"
+  }
+}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := buildDatabase(DiveLogMetadata{Source: path, CSVMapping: mapping})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Dives) != len(want.Dives) {
+		t.Fatalf("%d dives, want %d", len(got.Dives)-1, len(want.Dives)-1)
+	}
+	for i, w := range want.Dives[1:] {
+		g := got.Dives[i+1]
+		if g.Number != w.Number || g.DateTimeIn != w.DateTimeIn || g.Duration != w.Duration || g.Buddy != w.Buddy {
+			t.Errorf("dive %d: number %d at %s for %v with %q", w.ID, g.Number, g.DateTimeIn, g.Duration, g.Buddy)
+		}
+		// columns that are not mapped are not read
+		if g.DepthMax != 0 || len(g.Cylinders) != 0 {
+			t.Errorf("dive %d: depth %v, %d cylinders", w.ID, g.DepthMax, len(g.Cylinders))
+		}
+		if name := got.DiveSites[g.DiveSiteID].Name; name != want.DiveSites[w.DiveSiteID].Name {
+			t.Errorf("dive %d: at %q", w.ID, name)
+		}
+	}
+
+	if err = os.WriteFile(mapping, []byte(`{"columns": {"number": "#1"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = buildDatabase(DiveLogMetadata{Source: path, CSVMapping: mapping}); err == nil {
+		t.Error("a mapping without a date column was loaded")
+	}
+
+	renamed := filepath.Join(filepath.Dir(path), "dives.xml")
+	if err = os.Rename(path, renamed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = buildDatabase(DiveLogMetadata{Source: renamed}); err == nil {
+		t.Error("a CSV file named .xml was read")
+	}
+}
@@ -1,41 +1,200 @@
 package server
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 	"unicode"
 
+	"src.acicovic.me/divelog/divecsv"
 	"src.acicovic.me/divelog/server/utils"
+	"src.acicovic.me/divelog/shearwater"
 	"src.acicovic.me/divelog/subsurface"
+	"src.acicovic.me/divelog/suunto"
+	"src.acicovic.me/divelog/uddf"
 )
 
-var bluefin DiveLog
+// _bluefin is the log being served. It is replaced as a whole when the log is
+// rebuilt, so handlers load it once and serve the request from that snapshot.
+var _bluefin atomic.Pointer[DiveLog]
 
-func buildDatabase() {
-	file, err := os.Open(bluefin.Metadata.Source)
+// _metadata is the configuration of the server that every build of the log
+// starts from.
+var _metadata DiveLogMetadata
+
+// buildDatabase builds a new log from the source in the metadata. The log that
+// is being served is not changed; a build that fails, or panics, only returns
+// an error.
+func buildDatabase(metadata DiveLogMetadata) (log *DiveLog, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log, err = nil, fmt.Errorf("failed to build database from %s: %v", metadata.Source, r)
+		}
+	}()
+
+	log = &DiveLog{Metadata: metadata}
+	var handler subsurface.Handler = &SubsurfaceCallbackHandler{log: log}
+	if metadata.FITDirectory != "" {
+		dives, err := readFITDirectory(metadata.FITDirectory)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read FIT files in %s: %v", metadata.FITDirectory, err)
+		}
+		handler = NewFITImportHandler(log, dives)
+	}
+
+	if subsurface.IsGitStorage(metadata.Source) {
+		storage, err := subsurface.OpenGitStorage(metadata.Source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open git storage %s: %v", metadata.Source, err)
+		}
+		defer subsurface.CloseGitStorage(storage)
+		if err = subsurface.DecodeGitStorage(storage, handler); err != nil {
+			return nil, fmt.Errorf("failed to decode git storage in %s: %v", metadata.Source, err)
+		}
+		return log, log.validate()
+	}
+
+	file, err := os.Open(metadata.Source)
 	if err != nil {
-		panic(fmt.Errorf("failed to open file %s: %v", bluefin.Metadata.Source, err))
+		return nil, fmt.Errorf("failed to open file %s: %v", metadata.Source, err)
 	}
 	defer file.Close()
 
-	if err = subsurface.DecodeSubsurfaceDatabase(file, &SubsurfaceCallbackHandler{}); err != nil {
-		panic(fmt.Errorf("failed to decode database in %s: %v", bluefin.Metadata.Source, err))
+	// backups are often gzip-compressed (.xml.gz, .ssrf)
+	database, err := subsurface.Decompress(file, subsurface.MaxDecompressedSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read database in %s: %v", metadata.Source, err)
+	}
+
+	// CSV files are told by their name (.csv or .csv.gz), as any header row can be
+	// mapped; the other formats are told by content, as exports of other programs
+	// are often named .xml as well
+	br := bufio.NewReader(database)
+	if divecsv.IsCSV(metadata.Source) {
+		mapping := divecsv.DefaultMapping()
+		if metadata.CSVMapping != "" {
+			if mapping, err = divecsv.LoadMapping(metadata.CSVMapping); err != nil {
+				return nil, fmt.Errorf("failed to load CSV mapping %s: %v", metadata.CSVMapping, err)
+			}
+		}
+		err = divecsv.Decode(br, mapping, handler)
+	} else if uddf.Detect(br) {
+		err = uddf.Decode(br, handler)
+	} else if suunto.Detect(br) {
+		err = suunto.Decode(br, handler)
+	} else if shearwater.Detect(br) {
+		err = shearwater.Decode(br, handler)
+	} else {
+		err = subsurface.DecodeSubsurfaceDatabase(br, handler)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode database in %s: %v", metadata.Source, err)
+	}
+	return log, log.validate()
+}
+
+// buildAssert is the assert of the build: it fails the build by a panic that
+// buildDatabase recovers from, instead of stopping the server, which keeps
+// serving the log it has.
+func buildAssert(condition bool, errMsg string) {
+	if !condition {
+		panic(errors.New(errMsg))
+	}
+}
+
+// validate checks that the log is whole: every dive is at one of its dive
+// sites, in one of its trips or in none, and recorded by its computers.
+func (dl *DiveLog) validate() error {
+	if dl.Dives == nil || dl.DiveSites == nil || dl.DiveTrips == nil || dl.Computers == nil {
+		return errors.New("invalid database: no dive log was read")
+	}
+	for i, dive := range dl.Dives[1:] {
+		switch {
+		case dive == nil || dive.ID != i+1:
+			return fmt.Errorf("invalid database: dive %d is missing", i+1)
+		case dive.DiveSiteID <= 0 || dive.DiveSiteID >= len(dl.DiveSites) || dl.DiveSites[dive.DiveSiteID] == nil:
+			return fmt.Errorf("invalid database: dive %d is at an unknown dive site", dive.ID)
+		case dive.DiveTripID < 0 || dive.DiveTripID >= len(dl.DiveTrips):
+			return fmt.Errorf("invalid database: dive %d is in an unknown dive trip", dive.ID)
+		}
+		for _, dc := range dive.DiveComputers {
+			if dc.ComputerID < 0 || dc.ComputerID >= len(dl.Computers) {
+				return fmt.Errorf("invalid database: dive %d is recorded by an unknown computer", dive.ID)
+			}
+		}
 	}
+	return nil
 }
 
+// unknownSiteUUID is the source ID of the placeholder site of dives that are
+// not at a known dive site. It cannot collide with a UUID from the source.
+const unknownSiteUUID = "\x00unknown"
+
 type SubsurfaceCallbackHandler struct {
+	log        *DiveLog
 	lastSiteID int
 	lastTripID int
 	lastDiveID int
+
+	// Dive sites may come after the dives in the source, so dives are linked
+	// to their sites, and pictures to the sites near them, at the end.
+	siteLinks []siteLink
+}
+
+type siteLink struct {
+	dive     *Dive
+	uuid     string
+	pictures []subsurface.Picture
 }
 
 func (p *SubsurfaceCallbackHandler) HandleBegin() {
-	bluefin.DiveSites = make([]*DiveSite, 1, 100)
-	bluefin.DiveTrips = make([]*DiveTrip, 1, 100)
-	bluefin.Dives = make([]*Dive, 1, 100)
-	bluefin.sourceToSystemID = make(map[string]int)
+	p.log.DiveSites = make([]*DiveSite, 1, 100)
+	p.log.DiveTrips = make([]*DiveTrip, 1, 100)
+	p.log.Dives = make([]*Dive, 1, 100)
+	p.log.Computers = make([]*Computer, 1, 10)
+	p.log.sourceToSystemID = make(map[string]int)
+	p.log.computerIDs = make(map[string]int)
+}
+
+func (p *SubsurfaceCallbackHandler) HandleSettings(settings subsurface.Settings) {
+	p.log.Metadata.AutoGroup = settings.AutoGroup
+	for _, dcid := range settings.DiveComputers {
+		computer := p.linkComputer(dcid.Model, dcid.DeviceID)
+		if computer == nil {
+			continue
+		}
+		computer.Serial = dcid.Serial
+		computer.Firmware = dcid.Firmware
+		computer.Nickname = dcid.Nickname
+	}
+}
+
+// linkComputer returns the computer of the model with the device ID, which is
+// added to the log the first time it is seen. Manually added dives are not
+// recorded by a computer.
+func (p *SubsurfaceCallbackHandler) linkComputer(model string, deviceID string) *Computer {
+	if model == "" || model == ManuallyAddedDiveModel {
+		return nil
+	}
+	key := strings.ToLower(model) + "\x00" + strings.ToLower(strings.TrimSpace(deviceID))
+	if id, ok := p.log.computerIDs[key]; ok {
+		return p.log.Computers[id]
+	}
+
+	computer := &Computer{
+		ID:       len(p.log.Computers),
+		Model:    model,
+		DeviceID: deviceID,
+	}
+	trace(_build, "%v", computer)
+	p.log.Computers = append(p.log.Computers, computer)
+	p.log.computerIDs[key] = computer.ID
+	trace(_map, "computerIDs %q -> %d", model+" "+deviceID, computer.ID)
+	return computer
 }
 
 func (p *SubsurfaceCallbackHandler) HandleDive(ddh subsurface.DiveDataHolder) int {
@@ -53,56 +212,176 @@ func (p *SubsurfaceCallbackHandler) HandleDive(ddh subsurface.DiveDataHolder) in
 		ID:     p.lastDiveID + 1,
 		Number: ddh.DiveNumber,
 
+		Rating5:     ddh.Rating,
+		Visibility5: ddh.Visibility,
+		Tags:        regularTags,
+		DateTimeIn:  ddh.DateTime.Format(time.RFC3339),
+		OperatorDM:  ddh.DiveMasterOrOperator,
+		Buddy:       ddh.Buddy,
+		Notes:       ddh.Notes,
+		Suit:        ddh.Suit,
+		WeightsType: ddh.WeightType,
+		DCModel:     ddh.DiveComputerModel,
+		DCName:      ddh.DiveComputerModel,
+		Current:     ddh.Current,
+		WaveSize:    ddh.WaveSize,
+		Surge:       ddh.Surge,
+		Chill:       ddh.Chill,
+		Invalid:     ddh.Invalid,
+		DiveMode:    string(ddh.DiveMode),
+		OTU:         ddh.OTU,
+		CNS:         ddh.CNS,
+
 		Duration:        ddh.Duration,
-		Rating5:         ddh.Rating,
-		Visibility5:     ddh.Visibility,
-		Tags:            regularTags,
 		Salinity:        ddh.WaterSalinity,
-		DateTimeIn:      ddh.DateTime.Format(time.RFC3339),
-		OperatorDM:      ddh.DiveMasterOrOperator,
-		Buddy:           ddh.Buddy,
-		Notes:           ddh.Notes,
-		Suit:            ddh.Suit,
-		CylSize:         ddh.CylinderSize,
-		CylType:         ddh.CylinderDescription,
-		StartPressure:   ddh.CylinderStartPressure,
-		EndPressure:     ddh.CylinderEndPressure,
-		Gas:             ddh.CylinderGas,
 		Weights:         ddh.Weight,
-		WeightsType:     ddh.WeightType,
-		DCModel:         ddh.DiveComputerModel,
 		DepthMax:        ddh.DepthMax,
 		DepthMean:       ddh.DepthMean,
 		TempWaterMin:    ddh.TemperatureWaterMin,
 		TempAir:         ddh.TemperatureAir,
 		SurfacePressure: ddh.SurfacePressure,
 
+		Samples: ddh.Samples,
+
 		datetime: ddh.DateTime,
 	}
+	for i, cyl := range ddh.Cylinders {
+		dive.Cylinders = append(dive.Cylinders, &Cylinder{
+			Index: i + 1,
+			Type:  cyl.Description,
+			Use:   cyl.Use,
+
+			Size:          cyl.Size,
+			WorkPressure:  cyl.WorkPressure,
+			StartPressure: cyl.StartPressure,
+			EndPressure:   cyl.EndPressure,
+			O2:            cyl.O2,
+			He:            cyl.He,
+		})
+	}
+	for _, ed := range ddh.ExtraData {
+		dive.ExtraData = append(dive.ExtraData, &ExtraData{Key: ed.Key, Value: ed.Value})
+	}
+	for _, event := range ddh.Events {
+		dive.Events = append(dive.Events, &Event{
+			Time:        formatEventTime(event.Time),
+			TimeSeconds: int(event.Time.Seconds()),
+			Type:        event.Type,
+			Flags:       event.Flags,
+			Value:       event.Value,
+			Cylinder:    event.Cylinder,
+
+			event: event,
+		})
+	}
+	for i, dc := range ddh.DiveComputers {
+		name, computerID := dc.Model, 0
+		if computer := p.linkComputer(dc.Model, dc.DeviceID); computer != nil {
+			name, computerID = computer.Name(), computer.ID
+		}
+		if dc.Primary {
+			dive.DCName = name
+		}
+		dive.DiveComputers = append(dive.DiveComputers, &DiveComputer{
+			Index:        i + 1,
+			Primary:      dc.Primary,
+			Model:        dc.Model,
+			Name:         name,
+			ComputerID:   computerID,
+			DeviceID:     dc.DeviceID,
+			DiveID:       dc.DiveID,
+			DepthMax:     dc.DepthMax,
+			DepthMean:    dc.DepthMean,
+			TempWaterMin: dc.TemperatureWaterMin,
+
+			samples: dc.Samples,
+		})
+	}
 	trace(_build, "%v", dive)
-	assert(dive.ID == len(bluefin.Dives), "invalid Dive.ID")
+	buildAssert(dive.ID == len(p.log.Dives), "invalid Dive.ID")
 
-	siteID, ok := bluefin.sourceToSystemID[ddh.DiveSiteUUID]
-	assert(ok, "DiveDataHolder.DiveSiteUUID is not mapped to DiveSite.ID")
-	dive.DiveSiteID = siteID
-	assert(siteID > 0 && siteID < len(bluefin.DiveSites), "invalid dive site ID mapping")
-	assert(bluefin.DiveSites[siteID] != nil, "DiveSite ptr is nil")
-	trace(_link, "%v -> %v", dive, bluefin.DiveSites[siteID])
+	p.siteLinks = append(p.siteLinks, siteLink{dive: dive, uuid: ddh.DiveSiteUUID, pictures: ddh.Pictures})
 
 	dive.DiveTripID = ddh.DiveTripID
-	assert(ddh.DiveTripID > 0 && ddh.DiveTripID < len(bluefin.DiveTrips), "invalid dive trip ID")
-	assert(bluefin.DiveTrips[ddh.DiveTripID] != nil, "DiveTrip ptr is nil")
-	trace(_link, "%v -> %v", dive, bluefin.DiveTrips[ddh.DiveTripID])
+	if ddh.DiveTripID != subsurface.IntNull {
+		buildAssert(ddh.DiveTripID > 0 && ddh.DiveTripID < len(p.log.DiveTrips), "invalid dive trip ID")
+		buildAssert(p.log.DiveTrips[ddh.DiveTripID] != nil, "DiveTrip ptr is nil")
+		trace(_link, "%v -> %v", dive, p.log.DiveTrips[ddh.DiveTripID])
+	}
 
 	dive.ProcessSpecialTags(specialTags)
 	dive.Normalize()
 
-	bluefin.Dives = append(bluefin.Dives, dive)
+	p.log.Dives = append(p.log.Dives, dive)
 	p.lastDiveID++
 
 	return dive.ID
 }
 
+// linkSite links the dive to its dive site, or to the unknown site if it has
+// none, and then links its pictures.
+func (p *SubsurfaceCallbackHandler) linkSite(link siteLink) {
+	dive := link.dive
+	siteID, ok := p.log.sourceToSystemID[link.uuid]
+	if !ok {
+		if link.uuid != "" {
+			trace(_error, "%v: dive site %q is not in the log", dive, link.uuid)
+		}
+		siteID = p.linkUnknownSite()
+	}
+	dive.DiveSiteID = siteID
+	buildAssert(siteID > 0 && siteID < len(p.log.DiveSites), "invalid dive site ID mapping")
+	buildAssert(p.log.DiveSites[siteID] != nil, "DiveSite ptr is nil")
+	trace(_link, "%v -> %v", dive, p.log.DiveSites[siteID])
+
+	for i, pic := range link.pictures {
+		p.linkPicture(dive, i+1, pic)
+	}
+}
+
+// linkUnknownSite returns the ID of the placeholder site of dives without a
+// dive site, which is added to the log the first time it is needed.
+func (p *SubsurfaceCallbackHandler) linkUnknownSite() int {
+	if id, ok := p.log.sourceToSystemID[unknownSiteUUID]; ok {
+		return id
+	}
+	return p.HandleDiveSite(unknownSiteUUID, UnknownSiteName, "", "")
+}
+
+// linkPicture adds the picture to the dive. Pictures with GPS tags are also
+// added to the dive site nearest to where they were taken, or to the site of
+// the dive if there is no site nearby.
+func (p *SubsurfaceCallbackHandler) linkPicture(dive *Dive, index int, pic subsurface.Picture) {
+	picture := &Picture{
+		Index:         index,
+		DiveID:        dive.ID,
+		Filename:      pic.Filename,
+		Offset:        formatPictureOffset(pic.Offset),
+		OffsetSeconds: int(pic.Offset.Seconds()),
+		Coordinates:   pic.Coords,
+
+		path: resolvePicture(p.log.Metadata.MediaRoot, pic.Filename),
+	}
+	if picture.path != "" {
+		picture.Available = true
+		picture.URL = fmt.Sprintf("/data/dives/%d/pictures/%d", dive.ID, index)
+		picture.ThumbnailURL = picture.URL + "/thumbnail"
+	}
+	trace(_build, "%v", picture)
+	dive.Pictures = append(dive.Pictures, picture)
+
+	lat, lon, ok := parseCoordinates(pic.Coords)
+	if !ok {
+		return
+	}
+	siteID := p.log.pictureSite(lat, lon)
+	if siteID == 0 {
+		siteID = dive.DiveSiteID
+	}
+	p.log.DiveSites[siteID].Pictures = append(p.log.DiveSites[siteID].Pictures, picture)
+	trace(_link, "%v -> %v", picture, p.log.DiveSites[siteID])
+}
+
 func (p *SubsurfaceCallbackHandler) HandleDiveSite(uuid string, name string, coords string, description string) int {
 	region := UnlabeledRegion
 	if strings.HasPrefix(description, PrefixForTagsInDescription) {
@@ -138,12 +417,12 @@ func (p *SubsurfaceCallbackHandler) HandleDiveSite(uuid string, name string, coo
 		sourceID: uuid,
 	}
 	trace(_build, "%v", site)
-	assert(site.ID == len(bluefin.DiveSites), "invalid DiveSite.ID")
+	buildAssert(site.ID == len(p.log.DiveSites), "invalid DiveSite.ID")
 
-	bluefin.sourceToSystemID[site.sourceID] = site.ID
+	p.log.sourceToSystemID[site.sourceID] = site.ID
 	trace(_map, "sourceToSystemID %q -> %d", site.sourceID, site.ID)
 
-	bluefin.DiveSites = append(bluefin.DiveSites, site)
+	p.log.DiveSites = append(p.log.DiveSites, site)
 	p.lastSiteID++
 
 	return site.ID
@@ -155,23 +434,49 @@ func (p *SubsurfaceCallbackHandler) HandleDiveTrip(label string) int {
 		Label: label,
 	}
 	trace(_build, "%v", trip)
-	assert(trip.ID == len(bluefin.DiveTrips), "invalid DiveTrip.ID")
+	buildAssert(trip.ID == len(p.log.DiveTrips), "invalid DiveTrip.ID")
 
-	bluefin.DiveTrips = append(bluefin.DiveTrips, trip)
+	p.log.DiveTrips = append(p.log.DiveTrips, trip)
 	p.lastTripID++
 
 	return trip.ID
 }
 
 func (p *SubsurfaceCallbackHandler) HandleEnd() {
-	assert(len(bluefin.Dives)-1 == p.lastDiveID, "invalid Dives slice length")
-	assert(len(bluefin.DiveSites)-1 == p.lastSiteID, "invalid DiveSites slice length")
-	assert(len(bluefin.DiveTrips)-1 == p.lastTripID, "invalid DiveTrips slice length")
+	for _, link := range p.siteLinks {
+		p.linkSite(link)
+	}
+	p.siteLinks = nil
+
+	buildAssert(len(p.log.Dives)-1 == p.lastDiveID, "invalid Dives slice length")
+	buildAssert(len(p.log.DiveSites)-1 == p.lastSiteID, "invalid DiveSites slice length")
+	buildAssert(len(p.log.DiveTrips)-1 == p.lastTripID, "invalid DiveTrips slice length")
 }
 
 func (p *SubsurfaceCallbackHandler) HandleGeoData(siteID int, cat int, label string) {
-	assert(bluefin.DiveSites[siteID] != nil, "DiveSite ptr is nil")
-	site := bluefin.DiveSites[siteID]
+	buildAssert(p.log.DiveSites[siteID] != nil, "DiveSite ptr is nil")
+	site := p.log.DiveSites[siteID]
+
+	// Subsurface keeps one label per category
+	var field *string
+	switch cat {
+	case subsurface.TaxonomyOcean:
+		field = &site.Taxonomy.Ocean
+	case subsurface.TaxonomyCountry:
+		field = &site.Taxonomy.Country
+	case subsurface.TaxonomyAdminL1:
+		field = &site.Taxonomy.State
+	case subsurface.TaxonomyAdminL2:
+		field = &site.Taxonomy.County
+	case subsurface.TaxonomyAdminL3:
+		field = &site.Taxonomy.City
+	case subsurface.TaxonomyLocalName:
+		field = &site.Taxonomy.Town
+	}
+	if field != nil && *field == "" {
+		*field = strings.TrimSpace(label)
+	}
+
 	for _, lbl := range site.GeoLabels {
 		if lbl == label {
 			return
@@ -181,11 +486,26 @@ func (p *SubsurfaceCallbackHandler) HandleGeoData(siteID int, cat int, label str
 }
 
 func (p *SubsurfaceCallbackHandler) HandleHeader(program string, version string) {
-	bluefin.Metadata.Program = program
-	bluefin.Metadata.ProgramVersion = version
-	bluefin.Metadata.Units = "metric" // DEVNOTE: make configurable?
+	p.log.Metadata.Program = program
+	p.log.Metadata.ProgramVersion = version
 }
 
 func (p *SubsurfaceCallbackHandler) HandleSkip(element string) {
 	// do nothing
 }
+
+// formatEventTime formats the time of an event, e.g. "12:30 min", including
+// events at the start of the dive.
+func formatEventTime(d time.Duration) string {
+	seconds := int(d.Round(time.Second).Seconds())
+	return fmt.Sprintf("%d:%02d min", seconds/60, seconds%60)
+}
+
+// formatPictureOffset formats the offset of a picture, e.g. "-1:30 min" for a
+// picture taken before the dive.
+func formatPictureOffset(d time.Duration) string {
+	if d < 0 {
+		return "-" + formatEventTime(-d)
+	}
+	return formatEventTime(d)
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestBuildDatabase(t *testing.T) {
+	for _, tc := range []struct {
+		source    string
+		dives     int
+		sites     int
+		cylinders int
+		unknown   bool // a dive is not at a known site
+	}{
+		{source: "../subsurface/testdata/dives.xml", dives: 3, sites: 2, cylinders: 4},
+		{source: "../uddf/testdata/dives.uddf", dives: 3, sites: 3, cylinders: 4, unknown: true},
+	} {
+		t.Run(tc.source, func(t *testing.T) {
+			log, err := buildDatabase(DiveLogMetadata{Source: tc.source})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := log.LargestDiveID(); n != tc.dives {
+				t.Errorf("%d dives, want %d", n, tc.dives)
+			}
+			if n := log.LargestSiteID(); n != tc.sites {
+				t.Errorf("%d dive sites, want %d", n, tc.sites)
+			}
+			cylinders := 0
+			for _, dive := range log.Dives[1:] {
+				cylinders += len(dive.Cylinders)
+			}
+			if cylinders != tc.cylinders {
+				t.Errorf("%d cylinders, want %d", cylinders, tc.cylinders)
+			}
+			last := log.Dives[len(log.Dives)-1]
+			if site := log.DiveSites[last.DiveSiteID]; (site.Name == UnknownSiteName) != tc.unknown {
+				t.Errorf("the last dive is at %q", site.Name)
+			}
+		})
+	}
+}
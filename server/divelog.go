@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"src.acicovic.me/divelog/server/utils"
+	"src.acicovic.me/divelog/subsurface"
 )
 
 type DiveLog struct {
@@ -13,13 +14,19 @@ type DiveLog struct {
 	DiveSites        []*DiveSite
 	DiveTrips        []*DiveTrip
 	Dives            []*Dive
+	Computers        []*Computer
 	sourceToSystemID map[string]int
+	computerIDs      map[string]int
 }
 
 type DiveLogMetadata struct {
 	Program        string `json:"program"`
 	ProgramVersion string `json:"program_version"`
 	Source         string `json:"source"`
+	FITDirectory   string `json:"fit_directory,omitempty"`
+	CSVMapping     string `json:"csv_mapping,omitempty"`
+	MediaRoot      string `json:"media_root,omitempty"`
+	AutoGroup      bool   `json:"autogroup,omitempty"`
 	Units          string `json:"units"`
 }
 
@@ -31,49 +38,171 @@ type DiveSite struct {
 	Description string   `json:"description,omitempty"`
 	Region      string   `json:"region,omitempty"`
 	GeoLabels   []string `json:"geo_labels,omitempty"`
+	Taxonomy    Taxonomy `json:"taxonomy"`
+
+	// pictures with GPS tags taken near this site
+	Pictures []*Picture `json:"pictures,omitempty"`
 
 	sourceID string
 }
 
+// Taxonomy is where a dive site is, by the geo data Subsurface looks up for
+// its coordinates. The administrative areas are named after the levels
+// Subsurface uses for them.
+type Taxonomy struct {
+	Ocean   string `json:"ocean,omitempty"`
+	Country string `json:"country,omitempty"`
+	State   string `json:"state,omitempty"`
+	County  string `json:"county,omitempty"`
+	City    string `json:"city,omitempty"`
+	Town    string `json:"town,omitempty"`
+}
+
+// Computer is a physical dive computer, told apart from other computers of the
+// same model by its device ID. Computers named in the settings of the log have
+// the nickname given to them in Subsurface.
+type Computer struct {
+	ID       int    `json:"id"`
+	Model    string `json:"model"`
+	DeviceID string `json:"device_id,omitempty"`
+	Serial   string `json:"serial,omitempty"`
+	Firmware string `json:"firmware,omitempty"`
+	Nickname string `json:"nickname,omitempty"`
+}
+
 type DiveTrip struct {
 	ID    int    `json:"id"`
 	Label string `json:"label"`
 }
 
+// Dive is a dive of the log. Measured values are kept in the units of the
+// subsurface package, and are formatted only when a dive is rendered (see
+// DiveFull); zero means that a value was not recorded.
 type Dive struct {
 	ID         int `json:"id"`
 	Number     int `json:"number"`
 	DiveSiteID int `json:"dive_site_id"`
 	DiveTripID int `json:"dive_trip_id"`
 
-	Duration        string   `json:"duration,omitempty"`
-	Rating5         int      `json:"rating5,omitempty"`
-	Visibility5     int      `json:"visibility5,omitempty"`
-	Tags            []string `json:"tags,omitempty"`
-	Salinity        string   `json:"salinity,omitempty"`
-	DateTimeIn      string   `json:"date_time_in,omitempty"`
-	OperatorDM      string   `json:"operator_dm,omitempty"`
-	Buddy           string   `json:"buddy,omitempty"`
-	Notes           string   `json:"notes,omitempty"`
-	Suit            string   `json:"suit,omitempty"`
-	CylSize         string   `json:"cyl_size,omitempty"`
-	CylType         string   `json:"cyl_type,omitempty"`
-	StartPressure   string   `json:"start_pressure,omitempty"`
-	EndPressure     string   `json:"end_pressure,omitempty"`
-	Gas             string   `json:"gas,omitempty"`
-	Weights         string   `json:"weights,omitempty"`
-	WeightsType     string   `json:"weights_type,omitempty"`
-	DCModel         string   `json:"dc_model,omitempty"`
-	DepthMax        string   `json:"depth_max,omitempty"`
-	DepthMean       string   `json:"depth_mean,omitempty"`
-	TempWaterMin    string   `json:"temp_water_min,omitempty"`
-	TempAir         string   `json:"temp_air,omitempty"`
-	SurfacePressure string   `json:"surface_pressure,omitempty"`
-	Award           string   `json:"award,omitempty"`
+	Rating5     int      `json:"rating5,omitempty"`
+	Visibility5 int      `json:"visibility5,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	DateTimeIn  string   `json:"date_time_in,omitempty"`
+	OperatorDM  string   `json:"operator_dm,omitempty"`
+	Buddy       string   `json:"buddy,omitempty"`
+	Notes       string   `json:"notes,omitempty"`
+	Suit        string   `json:"suit,omitempty"`
+	WeightsType string   `json:"weights_type,omitempty"`
+	DCModel     string   `json:"dc_model,omitempty"`
+	DCName      string   `json:"dc_name,omitempty"`
+	Award       string   `json:"award,omitempty"`
+	Current     int      `json:"current,omitempty"`
+	WaveSize    int      `json:"wavesize,omitempty"`
+	Surge       int      `json:"surge,omitempty"`
+	Chill       int      `json:"chill,omitempty"`
+	Invalid     bool     `json:"invalid,omitempty"`
+	DiveMode    string   `json:"dive_mode"`
+	OTU         int      `json:"otu,omitempty"`
+	CNS         int      `json:"cns,omitempty"`
+
+	Duration        time.Duration          `json:"-"`
+	Salinity        subsurface.Density     `json:"-"`
+	Weights         subsurface.Weight      `json:"-"`
+	DepthMax        subsurface.Depth       `json:"-"`
+	DepthMean       subsurface.Depth       `json:"-"`
+	TempWaterMin    subsurface.Temperature `json:"-"`
+	TempAir         subsurface.Temperature `json:"-"`
+	SurfacePressure subsurface.Pressure    `json:"-"`
+
+	Cylinders     []*Cylinder     `json:"-"`
+	DiveComputers []*DiveComputer `json:"-"`
+	ExtraData     []*ExtraData    `json:"extra_data,omitempty"`
+	Events        []*Event        `json:"events,omitempty"`
+	SafetyAlarms  []*SafetyAlarm  `json:"safety_alarms,omitempty"`
+	Pictures      []*Picture      `json:"pictures,omitempty"`
+
+	Samples []subsurface.Sample `json:"-"`
 
 	datetime time.Time
 }
 
+type Cylinder struct {
+	Index int    `json:"index"`
+	Type  string `json:"type,omitempty"`
+	Gas   string `json:"gas,omitempty"`
+	Use   string `json:"use,omitempty"`
+
+	Size          subsurface.Volume   `json:"-"`
+	WorkPressure  subsurface.Pressure `json:"-"`
+	StartPressure subsurface.Pressure `json:"-"`
+	EndPressure   subsurface.Pressure `json:"-"`
+	O2            subsurface.Fraction `json:"-"`
+	He            subsurface.Fraction `json:"-"`
+}
+
+// Event is an event reported by the primary dive computer, such as a gas
+// change, a bookmark or an alarm.
+type Event struct {
+	Time        string `json:"time"`
+	TimeSeconds int    `json:"time_s"`
+	Name        string `json:"name"`
+	Type        int    `json:"type,omitempty"`
+	Flags       int    `json:"flags,omitempty"`
+	Value       int    `json:"value,omitempty"`
+	Cylinder    int    `json:"cylinder,omitempty"`
+	Alarm       bool   `json:"alarm,omitempty"`
+	Description string `json:"description"`
+
+	event subsurface.Event
+}
+
+// ExtraData is a value the primary dive computer reports in addition to the
+// ones Subsurface knows, e.g. its deco model settings.
+type ExtraData struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// SafetyAlarm summarizes the alarms of one kind during a dive.
+type SafetyAlarm struct {
+	Name    string `json:"name"`
+	Count   int    `json:"count"`
+	FirstAt string `json:"first_at"`
+}
+
+// Picture is a photo taken during a dive, or shortly before or after it. The
+// offset is relative to the start of the dive. Pictures that are not found in
+// the media root are listed, but not served.
+type Picture struct {
+	Index         int    `json:"index"`
+	DiveID        int    `json:"dive_id"`
+	Filename      string `json:"filename"`
+	Offset        string `json:"offset"`
+	OffsetSeconds int    `json:"offset_s"`
+	Coordinates   string `json:"coordinates,omitempty"`
+	Available     bool   `json:"available"`
+	URL           string `json:"url,omitempty"`
+	ThumbnailURL  string `json:"thumbnail_url,omitempty"`
+
+	path string
+}
+
+type DiveComputer struct {
+	Index      int    `json:"index"`
+	Primary    bool   `json:"primary"`
+	Model      string `json:"model,omitempty"`
+	Name       string `json:"name,omitempty"`
+	ComputerID int    `json:"computer_id,omitempty"`
+	DeviceID   string `json:"device_id,omitempty"`
+	DiveID     string `json:"dive_id,omitempty"`
+
+	DepthMax     subsurface.Depth       `json:"-"`
+	DepthMean    subsurface.Depth       `json:"-"`
+	TempWaterMin subsurface.Temperature `json:"-"`
+
+	samples []subsurface.Sample
+}
+
 func (s *DiveSite) String() string {
 	return fmt.Sprintf("S%d:[%s]", s.ID, s.Name)
 }
@@ -87,6 +216,65 @@ func (s *DiveSite) FormattedCoordinates() string {
 	return fmt.Sprintf("lat = %s, long = %s", parts[0], parts[1])
 }
 
+// Country returns the country of the site, or UnlabeledCountry.
+func (s *DiveSite) Country() string {
+	if s.Taxonomy.Country != "" {
+		return s.Taxonomy.Country
+	}
+	return UnlabeledCountry
+}
+
+// AdminRegion returns the largest administrative area of the country the site
+// is in, or UnlabeledRegion.
+func (s *DiveSite) AdminRegion() string {
+	switch {
+	case s.Taxonomy.State != "":
+		return s.Taxonomy.State
+	case s.Taxonomy.County != "":
+		return s.Taxonomy.County
+	}
+	return UnlabeledRegion
+}
+
+// Locality returns the town or city the site is nearest to, or
+// UnlabeledLocality.
+func (s *DiveSite) Locality() string {
+	switch {
+	case s.Taxonomy.Town != "":
+		return s.Taxonomy.Town
+	case s.Taxonomy.City != "":
+		return s.Taxonomy.City
+	}
+	return UnlabeledLocality
+}
+
+// IsInCountry reports whether the site is in the country, ignoring case.
+func (s *DiveSite) IsInCountry(country string) bool {
+	return country == "" || strings.EqualFold(s.Country(), country)
+}
+
+func (c *Computer) String() string {
+	return fmt.Sprintf("C%d:[%s]", c.ID, c.Name())
+}
+
+// Name returns the nickname of the computer, or its model if it has none.
+func (c *Computer) Name() string {
+	if c.Nickname != "" {
+		return c.Nickname
+	}
+	return c.Model
+}
+
+func (p *Picture) String() string {
+	return fmt.Sprintf("P%d/%d:[%s]", p.DiveID, p.Index, p.Filename)
+}
+
+// Name returns the base name of the picture file.
+func (p *Picture) Name() string {
+	name := strings.ReplaceAll(p.Filename, `\`, "/")
+	return name[strings.LastIndex(name, "/")+1:]
+}
+
 func (t *DiveTrip) String() string {
 	return fmt.Sprintf("T%d:[%s]", t.ID, t.Label)
 }
@@ -100,28 +288,74 @@ func (d *Dive) String() string {
 	return fmt.Sprintf("D%d:[%s]", d.ID, d.datetime.Format(time.DateOnly))
 }
 
+// DiveModeName returns the name of the dive mode shown on dive pages.
+func (d *Dive) DiveModeName() string {
+	if name, ok := DiveModeMappings[d.DiveMode]; ok {
+		return name
+	}
+	return d.DiveMode
+}
+
+// HasConditions reports whether any of the conditions of the dive were rated.
+func (d *Dive) HasConditions() bool {
+	return d.Current != 0 || d.WaveSize != 0 || d.Surge != 0 || d.Chill != 0
+}
+
 func (d *Dive) Normalize() {
-	if strings.HasPrefix(d.Salinity, "1000") {
-		d.Salinity = "fresh water"
-	} else if strings.HasPrefix(d.Salinity, "1030") {
-		d.Salinity = "salt water"
-	} else {
-		d.Salinity = ""
+	// importers of other formats leave the dive mode empty
+	if d.DiveMode == "" {
+		d.DiveMode = string(subsurface.DiveModeOC)
+	}
+
+	for _, cyl := range d.Cylinders {
+		cyl.Normalize()
 	}
 
-	if d.Gas == "" {
-		d.Gas = "air"
-	} else { // e.g. "32%"
-		d.Gas = "nitrox " + d.Gas
+	// events refer to the cylinders by their gas
+	d.SafetyAlarms = nil
+	for _, event := range d.Events {
+		event.Normalize(d.Cylinders)
+		if !event.Alarm {
+			continue
+		}
+		found := false
+		for _, alarm := range d.SafetyAlarms {
+			if alarm.Name == event.Name {
+				alarm.Count++
+				found = true
+				break
+			}
+		}
+		if !found {
+			d.SafetyAlarms = append(d.SafetyAlarms, &SafetyAlarm{Name: event.Name, Count: 1, FirstAt: event.Time})
+		}
 	}
+}
 
-	if cylType, ok := CylinderTypeMappings[d.CylType]; ok {
-		d.CylType = cylType
+func (c *Cylinder) Normalize() {
+	c.Gas = gasName(c.O2, c.He)
+
+	if cylType, ok := CylinderTypeMappings[c.Type]; ok {
+		c.Type = cylType
 	} else {
-		d.CylType = "unrecognized"
+		c.Type = "unrecognized"
 	}
 }
 
+// IsRecordedBy reports whether one of the dive computers of the dive is the
+// computer. Every dive is recorded by computer 0.
+func (d *Dive) IsRecordedBy(computerID int) bool {
+	if computerID == 0 {
+		return true
+	}
+	for _, dc := range d.DiveComputers {
+		if dc.ComputerID == computerID {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *Dive) IsTaggedWith(tag string) bool {
 	if tag == "" {
 		return true
@@ -146,10 +380,74 @@ func (d *Dive) ProcessSpecialTags(specialTags []string) {
 	}
 }
 
+func (e *Event) Normalize(cylinders []*Cylinder) {
+	e.Name = e.event.TypeName()
+	e.Alarm = e.event.IsAlarm()
+
+	switch {
+	case e.event.IsGasChange():
+		if e.Cylinder > 0 && e.Cylinder <= len(cylinders) {
+			e.Description = fmt.Sprintf("gas change to %s (cylinder %d)", cylinders[e.Cylinder-1].Gas, e.Cylinder)
+		} else {
+			e.Description = fmt.Sprintf("gas change to %s", gasName(e.event.GasMix()))
+		}
+	case e.event.IsHeading():
+		e.Description = fmt.Sprintf("heading %d°", e.Value)
+	case e.event.IsBookmark():
+		e.Description = "bookmark"
+	case e.Value != 0:
+		e.Description = fmt.Sprintf("%s (%d)", e.Name, e.Value)
+	default:
+		e.Description = e.Name
+	}
+}
+
+// gasName names a gas mix the way it is shown on dive pages, e.g. "nitrox 32%".
+func gasName(o2 subsurface.Fraction, he subsurface.Fraction) string {
+	o2f, hef := float64(o2), float64(he)
+	switch {
+	case hef > 0 && o2f+hef >= 100:
+		return fmt.Sprintf("heliox %g/%g", o2f, hef)
+	case hef > 0:
+		return fmt.Sprintf("trimix %g/%g", o2f, hef)
+	case o2f == 0 || o2f == 21:
+		return "air"
+	case o2f >= 100:
+		return "oxygen"
+	default:
+		return fmt.Sprintf("nitrox %g%%", o2f)
+	}
+}
+
+// ValidDives returns the dives that are listed, leaving out the dives marked
+// invalid in Subsurface. Invalid dives can still be opened by their ID.
+func (dl *DiveLog) ValidDives() []*Dive {
+	dives := make([]*Dive, 0, len(dl.Dives))
+	for _, dive := range dl.Dives[1:] {
+		if !dive.Invalid {
+			dives = append(dives, dive)
+		}
+	}
+	return dives
+}
+
+func (dl *DiveLog) HasUngroupedDives() bool {
+	for _, dive := range dl.Dives[1:] {
+		if dive.DiveTripID == 0 && !dive.Invalid {
+			return true
+		}
+	}
+	return false
+}
+
 func (dl *DiveLog) LargestDiveID() int {
 	return len(dl.Dives) - 1
 }
 
+func (dl *DiveLog) LargestComputerID() int {
+	return len(dl.Computers) - 1
+}
+
 func (dl *DiveLog) LargestSiteID() int {
 	return len(dl.DiveSites) - 1
 }
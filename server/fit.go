@@ -0,0 +1,163 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"src.acicovic.me/divelog/fit"
+	"src.acicovic.me/divelog/subsurface"
+)
+
+const (
+	// FIT dives that start this close to a dive in the log are the same dive,
+	// already imported into Subsurface.
+	fitDuplicateWindow = 5 * 60 // seconds
+
+	// FIT dives are linked to a dive site in the log within this distance
+	// from their entry position.
+	fitSiteRadius = 200 // meters
+
+	fitUnnamedSite    = "Unnamed site"
+	fitSiteDescPrefix = "Entry position recorded by"
+)
+
+// readFITDirectory decodes the dives of all FIT files in dir, sorted by time.
+// Files of other activities are skipped.
+func readFITDirectory(dir string) ([]*fit.Dive, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var dives []*fit.Dive
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.EqualFold(filepath.Ext(entry.Name()), ".fit") {
+			continue
+		}
+		fileDives, err := readFITFile(filepath.Join(dir, entry.Name()))
+		if errors.Is(err, fit.ErrNotADive) {
+			trace(_build, "skipping %s: %v", entry.Name(), err)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		dives = append(dives, fileDives...)
+	}
+
+	slices.SortStableFunc(dives, func(a, b *fit.Dive) int {
+		return a.DateTime.Compare(b.DateTime)
+	})
+	return dives, nil
+}
+
+func readFITFile(path string) ([]*fit.Dive, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return fit.ReadDives(file)
+}
+
+type fitSite struct {
+	uuid     string
+	lat, lon float64
+}
+
+// FITImportHandler reports dives decoded from FIT files between the dives of
+// the log, in chronological order, and passes everything else through.
+// Dives that are already in the log are dropped. A FIT dive is linked to the
+// nearest dive site of the log around its entry position, or gets a new site.
+type FITImportHandler struct {
+	*SubsurfaceCallbackHandler
+	pending []*fit.Dive
+	sites   []fitSite
+}
+
+func NewFITImportHandler(log *DiveLog, dives []*fit.Dive) *FITImportHandler {
+	return &FITImportHandler{
+		SubsurfaceCallbackHandler: &SubsurfaceCallbackHandler{log: log},
+		pending:                   dives,
+	}
+}
+
+func (p *FITImportHandler) HandleDiveSite(uuid string, name string, coords string, description string) int {
+	if lat, lon, ok := parseCoordinates(coords); ok {
+		p.sites = append(p.sites, fitSite{uuid: uuid, lat: lat, lon: lon})
+	}
+	return p.SubsurfaceCallbackHandler.HandleDiveSite(uuid, name, coords, description)
+}
+
+func (p *FITImportHandler) HandleDive(ddh subsurface.DiveDataHolder) int {
+	for len(p.pending) > 0 {
+		next := p.pending[0]
+		diff := next.DateTime.Sub(ddh.DateTime).Seconds()
+		if diff > fitDuplicateWindow {
+			break
+		}
+		p.pending = p.pending[1:]
+		if math.Abs(diff) <= fitDuplicateWindow {
+			trace(_build, "FIT dive at %v is already in the log", next.DateTime)
+			continue
+		}
+		p.reportFITDive(next)
+	}
+	return p.SubsurfaceCallbackHandler.HandleDive(ddh)
+}
+
+func (p *FITImportHandler) HandleEnd() {
+	for _, dive := range p.pending {
+		p.reportFITDive(dive)
+	}
+	p.pending = nil
+	p.SubsurfaceCallbackHandler.HandleEnd()
+}
+
+func (p *FITImportHandler) reportFITDive(dive *fit.Dive) {
+	ddh := dive.DiveDataHolder
+	ddh.DiveTripID = subsurface.IntNull
+
+	if lat, lon, ok := parseCoordinates(dive.Coords); ok {
+		if site, found := p.nearestSite(lat, lon); found {
+			ddh.DiveSiteUUID = site.uuid
+		} else {
+			desc := fmt.Sprintf("%s %s.", fitSiteDescPrefix, ddh.DiveComputerModel)
+			p.HandleDiveSite(ddh.DiveSiteUUID, fitUnnamedSite, dive.Coords, desc)
+		}
+	} else {
+		// linked to the unknown site
+		ddh.DiveSiteUUID = ""
+	}
+
+	p.SubsurfaceCallbackHandler.HandleDive(ddh)
+}
+
+func (p *FITImportHandler) nearestSite(lat, lon float64) (fitSite, bool) {
+	var (
+		nearest fitSite
+		min     = math.Inf(1)
+	)
+	for _, site := range p.sites {
+		if d := distance(lat, lon, site.lat, site.lon); d < min {
+			nearest, min = site, d
+		}
+	}
+	return nearest, min <= fitSiteRadius
+}
+
+// distance returns the great-circle distance in meters between two positions.
+func distance(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadius = 6371000
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
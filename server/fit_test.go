@@ -0,0 +1,95 @@
+package server
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"src.acicovic.me/divelog/fit"
+	"src.acicovic.me/divelog/subsurface"
+)
+
+func fitDive(at string, coords string, buddy string) *fit.Dive {
+	dateTime, err := time.Parse(time.DateTime, at)
+	if err != nil {
+		panic(err)
+	}
+	return &fit.Dive{
+		DiveDataHolder: subsurface.DiveDataHolder{
+			DiveSiteUUID:      "fit-" + buddy,
+			DateTime:          dateTime,
+			Duration:          30 * time.Minute,
+			Buddy:             buddy,
+			DiveComputerModel: "Descent Mk2",
+		},
+		Coords: coords,
+	}
+}
+
+// FIT dives are merged into the log of the fixture, which has two dives at
+// Blue Hole (28.572 34.537) on 2024-05-01 at 10:00 and 14:00, and one at Lake
+// Ohrid on 2024-08-10 at 09:00.
+func TestFITImportHandler(t *testing.T) {
+	dives := []*fit.Dive{
+		fitDive("2024-05-01 09:55:00", "28.572000 34.537000", "same as dive 1"),
+		fitDive("2024-05-01 12:00:00", "28.573000 34.537000", "near Blue Hole"),
+		fitDive("2024-05-01 14:03:00", "", "same as dive 2"),
+		fitDive("2024-06-15 08:00:00", "28.575000 34.537000", "off Blue Hole"),
+		fitDive("2024-06-15 11:00:00", "28.575100 34.537000", "off Blue Hole again"),
+		fitDive("2024-09-01 10:00:00", "", "no position"),
+	}
+
+	source, err := os.Open("../subsurface/testdata/dives.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	log := &DiveLog{}
+	if err = subsurface.DecodeSubsurfaceDatabase(source, NewFITImportHandler(log, dives)); err != nil {
+		t.Fatal(err)
+	}
+	if err = log.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		buddy string
+		site  string
+	}{
+		{"Ana", "Blue Hole"},
+		{"near Blue Hole", "Blue Hole"},
+		{"", "Blue Hole"},
+		{"off Blue Hole", fitUnnamedSite},
+		{"off Blue Hole again", fitUnnamedSite},
+		{"", "Lake Ohrid"},
+		{"no position", UnknownSiteName},
+	}
+	if len(log.Dives)-1 != len(want) {
+		t.Fatalf("%d dives, want %d", len(log.Dives)-1, len(want))
+	}
+	for i, w := range want {
+		dive := log.Dives[i+1]
+		if site := log.DiveSites[dive.DiveSiteID]; dive.Buddy != w.buddy || site.Name != w.site {
+			t.Errorf("dive %d: buddy %q at %q, want %q at %q", dive.ID, dive.Buddy, site.Name, w.buddy, w.site)
+		}
+	}
+
+	// the dive 333 m off Blue Hole gets a site, and the next one 11 m away is
+	// linked to it
+	if log.Dives[4].DiveSiteID != log.Dives[5].DiveSiteID {
+		t.Errorf("dives %d and %d are at different sites", log.Dives[4].ID, log.Dives[5].ID)
+	}
+	if n := log.LargestSiteID(); n != 4 {
+		t.Errorf("%d dive sites, want 4", n)
+	}
+}
+
+func TestDistance(t *testing.T) {
+	// a thousandth of a degree of latitude is 111 m
+	if d := distance(28.572, 34.537, 28.573, 34.537); d < 111 || d > 112 {
+		t.Errorf("distance = %v m", d)
+	}
+	if d := distance(41.04, 20.72, 41.04, 20.72); d != 0 {
+		t.Errorf("distance to the same position = %v m", d)
+	}
+}
@@ -1,13 +1,17 @@
 package server
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"math"
 	"net/http"
 	"os"
 	"slices"
 	"sort"
+	"strconv"
+	"strings"
 
 	"src.acicovic.me/divelog/server/utils"
 )
@@ -19,11 +23,13 @@ const (
 	FileFavicon      = "data" + PathFavicon
 	FileProzaLibre   = "data" + PathProzaLibre
 	FileStyle        = "data" + PathStyle
+	FilePageTemplate = "data/pagetemplate.html"
 	ContentTypeWoff2 = "font/woff2"
 	ContentTypeCSS   = "text/css"
 )
 
-var _pageTemplate = template.Must(template.ParseFiles("data/pagetemplate.html"))
+// _pageTemplate is parsed when the server starts, from the working directory.
+var _pageTemplate *template.Template
 
 func defaultHandler(w http.ResponseWriter, r *http.Request) {
 	var filePath, contentType string
@@ -61,14 +67,19 @@ func defaultHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func fetchSites(w http.ResponseWriter, r *http.Request) {
+	bluefin := _bluefin.Load()
 	var (
-		resp []byte
-		err  error
+		resp    []byte
+		err     error
+		country = r.URL.Query().Get("country")
 	)
 
 	if r.URL.Query().Get("headonly") == "true" {
 		heads := make([]*SiteHead, 0, len(bluefin.DiveSites))
 		for _, site := range bluefin.DiveSites[1:] {
+			if !site.IsInCountry(country) {
+				continue
+			}
 			heads = append(heads, &SiteHead{
 				ID:   site.ID,
 				Name: site.Name,
@@ -80,8 +91,11 @@ func fetchSites(w http.ResponseWriter, r *http.Request) {
 		resp, err = json.Marshal(heads)
 	} else {
 		sites := []*SiteFull{}
+		dives := bluefin.ValidDives()
 		for _, site := range bluefin.DiveSites[1:] {
-			sites = append(sites, NewSiteFull(site, bluefin.Dives[1:]))
+			if site.IsInCountry(country) {
+				sites = append(sites, NewSiteFull(site, dives))
+			}
 		}
 		resp, err = json.Marshal(sites)
 	}
@@ -96,6 +110,7 @@ func fetchSites(w http.ResponseWriter, r *http.Request) {
 }
 
 func fetchSite(w http.ResponseWriter, r *http.Request) {
+	bluefin := _bluefin.Load()
 	siteID := utils.ConvertAndCheckID(r.PathValue("id"), bluefin.LargestSiteID())
 	if siteID == 0 {
 		w.WriteHeader(http.StatusBadRequest)
@@ -103,7 +118,7 @@ func fetchSite(w http.ResponseWriter, r *http.Request) {
 	}
 	site := bluefin.DiveSites[siteID]
 
-	resp, err := json.Marshal(NewSiteFull(site, bluefin.Dives[1:]))
+	resp, err := json.Marshal(NewSiteFull(site, bluefin.ValidDives()))
 	if err != nil {
 		trace(_error, "http: failed to marshal single dive site data: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -114,6 +129,7 @@ func fetchSite(w http.ResponseWriter, r *http.Request) {
 }
 
 func fetchTrips(w http.ResponseWriter, r *http.Request) {
+	bluefin := _bluefin.Load()
 	trips := make([]*Trip, 0, len(bluefin.DiveTrips))
 	reverse := r.URL.Query().Get("reverse") == "true"
 	if reverse {
@@ -132,8 +148,19 @@ func fetchTrips(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// dives that are not part of any trip are listed under a trip with ID 0
+	if bluefin.HasUngroupedDives() {
+		ungrouped := &Trip{Label: UngroupedTripLabel}
+		if reverse {
+			trips = slices.Insert(trips, 0, ungrouped)
+		} else {
+			trips = append(trips, ungrouped)
+		}
+	}
+
+	dives := bluefin.ValidDives()
 	for _, trip := range trips {
-		for _, dive := range bluefin.Dives[1:] {
+		for _, dive := range dives {
 			if dive.DiveTripID == trip.ID {
 				trip.LinkedDives = append(trip.LinkedDives, NewDiveHead(dive, bluefin.DiveSites[dive.DiveSiteID]))
 			}
@@ -153,24 +180,175 @@ func fetchTrips(w http.ResponseWriter, r *http.Request) {
 	send(w, resp)
 }
 
+func fetchComputers(w http.ResponseWriter, r *http.Request) {
+	bluefin := _bluefin.Load()
+	computers := make([]*ComputerFull, 0, len(bluefin.Computers))
+	for _, computer := range bluefin.Computers[1:] {
+		computers = append(computers, NewComputerFull(computer, bluefin.ValidDives(), bluefin.DiveSites))
+	}
+
+	resp, err := json.Marshal(computers)
+	if err != nil {
+		trace(_error, "http: failed to marshal dive computer data: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	send(w, resp)
+}
+
+// computerFilter returns the ID of the computer in the "computer" query
+// parameter, or 0 if it is not set. The parameter is invalid if the computer
+// does not exist.
+func computerFilter(bluefin *DiveLog, r *http.Request) (id int, ok bool) {
+	computer := r.URL.Query().Get("computer")
+	if computer == "" {
+		return 0, true
+	}
+	id = utils.ConvertAndCheckID(computer, bluefin.LargestComputerID())
+	return id, id != 0
+}
+
+// diveFilter selects dives by the query parameters of the data API. Invalid
+// dives are left out unless "invalid" is "true", or "only" to list nothing
+// else. Conditions ratings and oxygen exposure are matched by ranges.
+type diveFilter struct {
+	sites      []*DiveSite
+	tag        string
+	computerID int
+	country    string
+	mode       string
+	invalid    string
+
+	current  valueRange
+	waveSize valueRange
+	surge    valueRange
+	chill    valueRange
+	otu      valueRange
+	cns      valueRange
+}
+
+// valueRange is a range of values given as "3", "2-4", "3-" or "-2". A
+// zero valueRange matches every value.
+type valueRange struct {
+	set      bool
+	min, max int
+}
+
+// newDiveFilter returns the filter of the request, or false if one of its
+// parameters is invalid.
+func newDiveFilter(bluefin *DiveLog, r *http.Request) (*diveFilter, bool) {
+	query := r.URL.Query()
+	f := &diveFilter{
+		sites:   bluefin.DiveSites,
+		tag:     query.Get("tag"),
+		country: query.Get("country"),
+		mode:    query.Get("mode"),
+		invalid: query.Get("invalid"),
+	}
+	switch f.invalid {
+	case "", "false", "true", "only":
+	default:
+		return nil, false
+	}
+
+	var ok bool
+	if f.computerID, ok = computerFilter(bluefin, r); !ok {
+		return nil, false
+	}
+	for param, vr := range map[string]*valueRange{
+		"current":  &f.current,
+		"wavesize": &f.waveSize,
+		"surge":    &f.surge,
+		"chill":    &f.chill,
+		"otu":      &f.otu,
+		"cns":      &f.cns,
+	} {
+		if *vr, ok = parseValueRange(query.Get(param)); !ok {
+			return nil, false
+		}
+	}
+	return f, true
+}
+
+func (f *diveFilter) match(dive *Dive) bool {
+	switch {
+	case dive.Invalid && (f.invalid == "" || f.invalid == "false"):
+		return false
+	case !dive.Invalid && f.invalid == "only":
+		return false
+	case f.mode != "" && !strings.EqualFold(f.mode, dive.DiveMode):
+		return false
+	case !f.sites[dive.DiveSiteID].IsInCountry(f.country):
+		return false
+	}
+	return dive.IsTaggedWith(f.tag) &&
+		dive.IsRecordedBy(f.computerID) &&
+		f.current.contains(dive.Current) &&
+		f.waveSize.contains(dive.WaveSize) &&
+		f.surge.contains(dive.Surge) &&
+		f.chill.contains(dive.Chill) &&
+		f.otu.contains(dive.OTU) &&
+		f.cns.contains(dive.CNS)
+}
+
+func parseValueRange(s string) (valueRange, bool) {
+	if s == "" {
+		return valueRange{}, true
+	}
+	vr := valueRange{set: true, max: math.MaxInt}
+	minStr, maxStr, isRange := strings.Cut(s, "-")
+	if !isRange {
+		maxStr = minStr
+	}
+	var err error
+	if minStr != "" {
+		if vr.min, err = strconv.Atoi(minStr); err != nil {
+			return vr, false
+		}
+	}
+	if maxStr != "" {
+		if vr.max, err = strconv.Atoi(maxStr); err != nil {
+			return vr, false
+		}
+	}
+	return vr, (minStr != "" || maxStr != "") && vr.min <= vr.max
+}
+
+func (vr valueRange) contains(v int) bool {
+	return !vr.set || (v >= vr.min && v <= vr.max)
+}
+
 func fetchDives(w http.ResponseWriter, r *http.Request) {
+	bluefin := _bluefin.Load()
 	var (
 		resp []byte
 		err  error
-		tag  = r.URL.Query().Get("tag")
 	)
+	filter, ok := newDiveFilter(bluefin, r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	units, ok := requestUnits(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
 	if r.URL.Query().Get("headonly") == "true" {
 		heads := make([]*DiveHead, 0, len(bluefin.Dives))
 		for _, dive := range bluefin.Dives[1:] {
-			heads = append(heads, NewDiveHead(dive, bluefin.DiveSites[dive.DiveSiteID]))
+			if filter.match(dive) {
+				heads = append(heads, NewDiveHead(dive, bluefin.DiveSites[dive.DiveSiteID]))
+			}
 		}
 		resp, err = json.Marshal(heads)
 	} else {
 		dives := []*DiveFull{}
 		for _, dive := range bluefin.Dives[1:] {
-			if dive.IsTaggedWith(tag) {
-				dives = append(dives, NewDiveFull(dive, bluefin.DiveSites[dive.DiveSiteID]))
+			if filter.match(dive) {
+				dives = append(dives, NewDiveFull(dive, bluefin.DiveSites[dive.DiveSiteID], units))
 			}
 		}
 		resp, err = json.Marshal(dives)
@@ -186,14 +364,20 @@ func fetchDives(w http.ResponseWriter, r *http.Request) {
 }
 
 func fetchDive(w http.ResponseWriter, r *http.Request) {
+	bluefin := _bluefin.Load()
 	diveID := utils.ConvertAndCheckID(r.PathValue("id"), bluefin.LargestDiveID())
 	if diveID == 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 	dive := bluefin.Dives[diveID]
+	units, ok := requestUnits(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
-	resp, err := json.Marshal(NewDiveFull(dive, bluefin.DiveSites[dive.DiveSiteID]))
+	resp, err := json.Marshal(NewDiveFull(dive, bluefin.DiveSites[dive.DiveSiteID], units))
 	if err != nil {
 		trace(_error, "http: failed to marshal single dive data: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -203,9 +387,90 @@ func fetchDive(w http.ResponseWriter, r *http.Request) {
 	send(w, resp)
 }
 
+func fetchDiveProfile(w http.ResponseWriter, r *http.Request) {
+	bluefin := _bluefin.Load()
+	diveID := utils.ConvertAndCheckID(r.PathValue("id"), bluefin.LargestDiveID())
+	if diveID == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	dive := bluefin.Dives[diveID]
+	units, ok := requestUnits(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// ?dc={index} selects a dive computer other than the primary one
+	samples := dive.Samples
+	if dc := r.URL.Query().Get("dc"); dc != "" {
+		index := utils.ConvertAndCheckID(dc, len(dive.DiveComputers))
+		if index == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		samples = dive.DiveComputers[index-1].samples
+	}
+
+	resp, err := json.Marshal(NewDiveProfile(samples, units))
+	if err != nil {
+		trace(_error, "http: failed to marshal dive profile data: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	send(w, resp)
+}
+
+// divePicture returns the picture of the dive in the request, or nil if it
+// does not exist or is not found in the media root.
+func divePicture(r *http.Request) *Picture {
+	bluefin := _bluefin.Load()
+	diveID := utils.ConvertAndCheckID(r.PathValue("id"), bluefin.LargestDiveID())
+	if diveID == 0 {
+		return nil
+	}
+	dive := bluefin.Dives[diveID]
+	index := utils.ConvertAndCheckID(r.PathValue("index"), len(dive.Pictures))
+	if index == 0 || !dive.Pictures[index-1].Available {
+		return nil
+	}
+	return dive.Pictures[index-1]
+}
+
+func fetchDivePicture(w http.ResponseWriter, r *http.Request) {
+	picture := divePicture(r)
+	if picture == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	http.ServeFile(w, r, picture.path)
+}
+
+func fetchDivePictureThumbnail(w http.ResponseWriter, r *http.Request) {
+	picture := divePicture(r)
+	if picture == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	data, modTime, err := _thumbnails.get(picture.path)
+	if err != nil {
+		trace(_error, "http: failed to make thumbnail of %v: %v", picture, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", ContentTypeJPEG)
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(data))
+}
+
 func fetchTags(w http.ResponseWriter, r *http.Request) {
+	bluefin := _bluefin.Load()
 	tags := make(map[string]int)
-	for _, dive := range bluefin.Dives[1:] {
+	for _, dive := range bluefin.ValidDives() {
 		for _, tag := range dive.Tags {
 			tags[tag]++
 		}
@@ -222,6 +487,7 @@ func fetchTags(w http.ResponseWriter, r *http.Request) {
 }
 
 func renderDives(w http.ResponseWriter, r *http.Request) {
+	bluefin := _bluefin.Load()
 	// TODO: This function can be refactored to be similar to renderSites.
 	trips := make([]*Trip, 0, len(bluefin.DiveTrips))
 	for i := len(bluefin.DiveTrips) - 1; i > 0; i-- {
@@ -231,7 +497,21 @@ func renderDives(w http.ResponseWriter, r *http.Request) {
 		}
 		for i := len(bluefin.Dives) - 1; i > 0; i-- {
 			dive := bluefin.Dives[i]
-			if dive.DiveTripID == trip.ID {
+			if dive.DiveTripID == trip.ID && !dive.Invalid {
+				trip.LinkedDives = append(
+					trip.LinkedDives,
+					NewDiveHead(dive, bluefin.DiveSites[dive.DiveSiteID]),
+				)
+			}
+		}
+		trips = append(trips, trip)
+	}
+
+	if bluefin.HasUngroupedDives() {
+		trip := &Trip{Label: UngroupedTripLabel}
+		for i := len(bluefin.Dives) - 1; i > 0; i-- {
+			dive := bluefin.Dives[i]
+			if dive.DiveTripID == 0 && !dive.Invalid {
 				trip.LinkedDives = append(
 					trip.LinkedDives,
 					NewDiveHead(dive, bluefin.DiveSites[dive.DiveSiteID]),
@@ -241,7 +521,7 @@ func renderDives(w http.ResponseWriter, r *http.Request) {
 		trips = append(trips, trip)
 	}
 
-	renderTemplate(w, Page{
+	renderTemplate(w, r, Page{
 		Title:      "Dives",
 		Supertitle: "All",
 		Trips:      trips,
@@ -249,6 +529,7 @@ func renderDives(w http.ResponseWriter, r *http.Request) {
 }
 
 func renderSites(w http.ResponseWriter, r *http.Request) {
+	bluefin := _bluefin.Load()
 	regionMap := make(map[string][]*SiteHead)
 	for _, site := range bluefin.DiveSites[1:] {
 		regionMap[site.Region] = append(regionMap[site.Region], &SiteHead{
@@ -272,17 +553,49 @@ func renderSites(w http.ResponseWriter, r *http.Request) {
 		return siteHeads[i].Region < siteHeads[j].Region
 	})
 
-	renderTemplate(w, Page{
+	renderTemplate(w, r, Page{
 		Title:        "Dive sites",
 		Supertitle:   "All",
 		GroupedSites: siteHeads,
 	})
 }
 
+func renderCountries(w http.ResponseWriter, r *http.Request) {
+	bluefin := _bluefin.Load()
+	renderTemplate(w, r, Page{
+		Title:      "Countries",
+		Supertitle: "All",
+		Countries:  GroupSitesByCountry(bluefin.DiveSites[1:]),
+	})
+}
+
+func renderCountry(w http.ResponseWriter, r *http.Request) {
+	bluefin := _bluefin.Load()
+	country := r.PathValue("country")
+	sites := []*DiveSite{}
+	for _, site := range bluefin.DiveSites[1:] {
+		if site.IsInCountry(country) {
+			sites = append(sites, site)
+		}
+	}
+	if len(sites) == 0 {
+		renderNotFound(w, r, "country not found")
+		return
+	}
+
+	countries := GroupSitesByCountry(sites)
+	renderTemplate(w, r, Page{
+		Title:      countries[0].Country,
+		Supertitle: "Dive sites in",
+		Countries:  countries,
+	})
+}
+
 func renderDive(w http.ResponseWriter, r *http.Request) {
+	bluefin := _bluefin.Load()
 	diveID := utils.ConvertAndCheckID(r.PathValue("id"), bluefin.LargestDiveID())
 	if diveID == 0 {
-		renderNotFound(w, "dive not found")
+		renderNotFound(w, r, "dive not found")
 		return
 	}
 	dive := bluefin.Dives[diveID]
@@ -291,7 +604,7 @@ func renderDive(w http.ResponseWriter, r *http.Request) {
 	page := Page{
 		Title:      site.Name,
 		Supertitle: fmt.Sprintf("Dive %d", dive.Number),
-		Dive:       NewDiveFull(dive, site),
+		Dive:       NewDiveFull(dive, site, pageUnits(r)),
 	}
 	// fix it here because this is the only scenario where it's needed
 	// (although it's not a good design)
@@ -299,33 +612,35 @@ func renderDive(w http.ResponseWriter, r *http.Request) {
 		page.Dive.NextID = 0
 	}
 
-	renderTemplate(w, page)
+	renderTemplate(w, r, page)
 }
 
 func renderSite(w http.ResponseWriter, r *http.Request) {
+	bluefin := _bluefin.Load()
 	siteID := utils.ConvertAndCheckID(r.PathValue("id"), bluefin.LargestSiteID())
 	if siteID == 0 {
-		renderNotFound(w, "site not found")
+		renderNotFound(w, r, "site not found")
 		return
 	}
 	site := bluefin.DiveSites[siteID]
 
-	renderTemplate(w, Page{
+	renderTemplate(w, r, Page{
 		Title:      site.Name,
 		Supertitle: site.Region,
-		Site:       NewSiteFull(site, bluefin.Dives[1:]),
+		Site:       NewSiteFull(site, bluefin.ValidDives()),
 	})
 }
 
 func renderTags(w http.ResponseWriter, r *http.Request) {
+	bluefin := _bluefin.Load()
 	tags := make(map[string]int)
-	for _, dive := range bluefin.Dives[1:] {
+	for _, dive := range bluefin.ValidDives() {
 		for _, tag := range dive.Tags {
 			tags[tag]++
 		}
 	}
 
-	renderTemplate(w, Page{
+	renderTemplate(w, r, Page{
 		Title:      "Tags",
 		Supertitle: "All",
 		Tags:       tags,
@@ -333,10 +648,14 @@ func renderTags(w http.ResponseWriter, r *http.Request) {
 }
 
 func renderTaggedDives(w http.ResponseWriter, r *http.Request) {
+	bluefin := _bluefin.Load()
 	tag := r.PathValue("tag")
 	dives := []*DiveHead{}
 	for i := len(bluefin.Dives) - 1; i > 0; i-- {
 		dive := bluefin.Dives[i]
+		if dive.Invalid {
+			continue
+		}
 		for _, t := range dive.Tags {
 			if t == tag {
 				dives = append(
@@ -348,29 +667,91 @@ func renderTaggedDives(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if len(dives) == 0 {
-		renderNotFound(w, "")
+		renderNotFound(w, r, "")
 		return
 	}
 
-	renderTemplate(w, Page{
+	renderTemplate(w, r, Page{
 		Title:      tag,
 		Supertitle: "Dives tagged with",
 		Dives:      dives,
 	})
 }
 
-func renderNotFound(w http.ResponseWriter, title string) {
+func renderComputers(w http.ResponseWriter, r *http.Request) {
+	bluefin := _bluefin.Load()
+	computers := make([]*ComputerFull, 0, len(bluefin.Computers))
+	for _, computer := range bluefin.Computers[1:] {
+		computers = append(computers, NewComputerFull(computer, bluefin.ValidDives(), bluefin.DiveSites))
+	}
+	sort.SliceStable(computers, func(i, j int) bool {
+		return computers[i].Name < computers[j].Name
+	})
+
+	renderTemplate(w, r, Page{
+		Title:      "Dive computers",
+		Supertitle: "All",
+		Computers:  computers,
+	})
+}
+
+func renderNotFound(w http.ResponseWriter, r *http.Request, title string) {
 	if title == "" {
 		title = "not found"
 	}
 
-	renderTemplate(w, Page{
+	renderTemplate(w, r, Page{
 		Title:      title,
 		Supertitle: "404",
 		NotFound:   true,
 	})
 }
 
+func exportUDDF(w http.ResponseWriter, r *http.Request) {
+	bluefin := _bluefin.Load()
+	var buf bytes.Buffer
+	if err := bluefin.WriteUDDF(&buf); err != nil {
+		trace(_error, "http: failed to write UDDF export: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", ContentTypeUDDF)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", FileNameUDDF))
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		trace(_error, "http: send: %v", err)
+	}
+}
+
+func exportDivesCSV(w http.ResponseWriter, r *http.Request) {
+	bluefin := _bluefin.Load()
+	var (
+		buf   bytes.Buffer
+		dives = []*Dive{}
+	)
+	filter, ok := newDiveFilter(bluefin, r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for _, dive := range bluefin.Dives[1:] {
+		if filter.match(dive) {
+			dives = append(dives, dive)
+		}
+	}
+	if err := bluefin.WriteCSV(&buf, dives); err != nil {
+		trace(_error, "http: failed to write CSV export: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", ContentTypeCSV)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", FileNameCSV))
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		trace(_error, "http: send: %v", err)
+	}
+}
+
 func multiplexer() http.Handler {
 	mux := http.NewServeMux()
 
@@ -398,6 +779,12 @@ func multiplexer() http.Handler {
 	})
 	trace(_https, "handler registered for /hms/tags/")
 
+	mux.HandleFunc("GET /hms/computers", renderComputers)
+	trace(_https, "handler registered for /hms/computers")
+
+	mux.HandleFunc("GET /hms/countries", renderCountries)
+	trace(_https, "handler registered for /hms/countries")
+
 	mux.HandleFunc("GET /hms/dives/{id}", renderDive)
 	trace(_https, "handler registered for /hms/dives/{id}")
 
@@ -407,8 +794,11 @@ func multiplexer() http.Handler {
 	mux.HandleFunc("GET /hms/tags/{tag}", renderTaggedDives)
 	trace(_https, "handler registered for /hms/tags/{tag}")
 
+	mux.HandleFunc("GET /hms/countries/{country}", renderCountry)
+	trace(_https, "handler registered for /hms/countries/{country}")
+
 	mux.HandleFunc("GET /hms/about", func(w http.ResponseWriter, r *http.Request) {
-		renderTemplate(w, Page{
+		renderTemplate(w, r, Page{
 			Title:      "this site",
 			Supertitle: "about",
 			About:      true,
@@ -437,13 +827,31 @@ func multiplexer() http.Handler {
 	trace(_https, "handler registered for /data/dives")
 	// DEVNOTE: /data/dives/{$} returns 404
 
+	mux.HandleFunc("GET /data/dives.csv", exportDivesCSV)
+	trace(_https, "handler registered for /data/dives.csv")
+
 	mux.HandleFunc("GET /data/dives/{id}", fetchDive)
 	trace(_https, "handler registered for /data/dives/{id}")
 
+	mux.HandleFunc("GET /data/dives/{id}/profile", fetchDiveProfile)
+	trace(_https, "handler registered for /data/dives/{id}/profile")
+
+	mux.HandleFunc("GET /data/dives/{id}/pictures/{index}", fetchDivePicture)
+	trace(_https, "handler registered for /data/dives/{id}/pictures/{index}")
+
+	mux.HandleFunc("GET /data/dives/{id}/pictures/{index}/thumbnail", fetchDivePictureThumbnail)
+	trace(_https, "handler registered for /data/dives/{id}/pictures/{index}/thumbnail")
+
+	mux.HandleFunc("GET /data/computers", fetchComputers)
+	trace(_https, "handler registered for /data/computers")
+
 	mux.HandleFunc("GET /data/tags", fetchTags)
 	trace(_https, "handler registered for /data/tags")
 	// DEVNOTE: /data/tags/{$} returns 404
 
+	mux.HandleFunc("GET /data/export.uddf", exportUDDF)
+	trace(_https, "handler registered for /data/export.uddf")
+
 	mux.HandleFunc("GET /", defaultHandler)
 	trace(_https, "handler registered for /")
 
@@ -475,7 +883,9 @@ func send(w http.ResponseWriter, data []byte) {
 	}
 }
 
-func renderTemplate(w http.ResponseWriter, p Page) {
+func renderTemplate(w http.ResponseWriter, r *http.Request, p Page) {
+	p.Units = pageUnits(r)
+	rememberUnits(w, r)
 	if !p.check() {
 		trace(_error, "http: incorrect internal page state")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -3,16 +3,30 @@ package server
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
 )
 
 // Local API; registered only in "dev" mode; error reporting through HTTPS responses is acceptable.
 
 func fetchAll(w http.ResponseWriter, r *http.Request) {
+	bluefin := _bluefin.Load()
+	units, ok := requestUnits(r)
+	if !ok {
+		http.Error(w, "invalid units", http.StatusBadRequest)
+		return
+	}
+
 	all := &All{
+		Metadata:  bluefin.Metadata,
 		DiveSites: bluefin.DiveSites,
 		DiveTrips: bluefin.DiveTrips,
-		Dives:     bluefin.Dives,
+		Dives:     make([]*DiveFull, len(bluefin.Dives)),
+		Computers: bluefin.Computers,
 	}
+	for i, dive := range bluefin.Dives[1:] {
+		all.Dives[i+1] = NewDiveFull(dive, bluefin.DiveSites[dive.DiveSiteID], units)
+	}
+	all.Metadata.Units = string(units)
 	encoded, err := json.Marshal(all)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -25,6 +39,19 @@ func forceFailure(w http.ResponseWriter, r *http.Request) {
 	assert(false, "forced failure")
 }
 
+// rebuildDatabase rebuilds the log; a rebuild that loses dives must be
+// confirmed with "?confirm=true".
 func rebuildDatabase(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusNotImplemented)
+	confirmed, _ := strconv.ParseBool(r.URL.Query().Get("confirm"))
+	report := rebuild(nil, confirmed)
+	encoded, err := json.Marshal(report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !report.Rebuilt {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	send(w, encoded)
 }
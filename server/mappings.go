@@ -2,9 +2,14 @@ package server
 
 const (
 	UnlabeledRegion            = "Unlabeled Region"
+	UnlabeledCountry           = "Unlabeled Country"
+	UnlabeledLocality          = "Unlabeled Locality"
 	UndefinedDescription       = "This dive site is missing a description."
 	PrefixForTagsInDescription = "tags:"
 	RegionTagPrefix            = "_region_"
+	UngroupedTripLabel         = "Ungrouped"
+	UnknownSiteName            = "Unknown site"
+	ManuallyAddedDiveModel     = "Manually added dive"
 )
 
 var CylinderTypeMappings = map[string]string{
@@ -13,6 +18,13 @@ var CylinderTypeMappings = map[string]string{
 	"HP130": "steel",
 }
 
+var DiveModeMappings = map[string]string{
+	"OC":       "open circuit",
+	"CCR":      "closed circuit rebreather",
+	"PSCR":     "passive semi-closed rebreather",
+	"Freedive": "freediving",
+}
+
 var SpecialTagValueMappings = map[string]string{
 	"europe":        "Europe",
 	"asia":          "Asia",
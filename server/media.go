@@ -0,0 +1,217 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	_ "image/gif"
+	_ "image/png"
+)
+
+// Pictures are linked to dives by the file names Subsurface stores, which are
+// paths on the computer of the diver. They are looked up in the media root,
+// which holds a copy of the pictures: the whole path first, then shorter and
+// shorter trailing parts of it, so that both a mirrored directory tree and a
+// flat directory of pictures work. Files outside of the media root are never
+// served, even through symbolic links in it.
+
+const (
+	ContentTypeJPEG = "image/jpeg"
+
+	// thumbnails fit in a square of this size, in pixels
+	thumbnailSize    = 320
+	thumbnailQuality = 80
+	// the cache is cleared when it grows beyond this number of thumbnails
+	thumbnailCacheSize = 1024
+	// larger pictures are not decoded, as they would take too much memory
+	maxPicturePixels = 64 << 20
+
+	// pictures with GPS tags are linked to a dive site within this distance,
+	// and to the site of their dive otherwise
+	pictureSiteRadius = 200 // meters
+)
+
+var errPictureTooLarge = errors.New("picture is too large")
+
+var _thumbnails = thumbnailCache{entries: make(map[thumbnailKey][]byte)}
+
+// resolvePicture returns the path of the picture in the media root, or an
+// empty string if it is not found.
+func resolvePicture(root string, filename string) string {
+	if root == "" {
+		return ""
+	}
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return ""
+	}
+
+	// Windows paths are common, and their volume names are meaningless here
+	name := strings.ReplaceAll(filename, `\`, "/")
+	if i := strings.Index(name, ":"); i != -1 && !strings.Contains(name[:i], "/") {
+		name = name[i+1:]
+	}
+
+	parts := strings.FieldsFunc(name, func(r rune) bool { return r == '/' })
+	for i := range parts {
+		candidate := filepath.Join(parts[i:]...)
+		if !filepath.IsLocal(candidate) {
+			continue
+		}
+		path, err := filepath.EvalSymlinks(filepath.Join(root, candidate))
+		if err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(root, path); err != nil || !filepath.IsLocal(rel) {
+			trace(_error, "picture %s links outside of the media root", filename)
+			continue
+		}
+		if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() {
+			return path
+		}
+	}
+	return ""
+}
+
+// pictureSite returns the ID of the dive site nearest to the position of the
+// picture, or 0 if there is none within pictureSiteRadius.
+func (dl *DiveLog) pictureSite(lat, lon float64) int {
+	var (
+		nearest int
+		min     = float64(pictureSiteRadius)
+	)
+	for _, site := range dl.DiveSites[1:] {
+		siteLat, siteLon, ok := parseCoordinates(site.Coordinates)
+		if !ok {
+			continue
+		}
+		if d := distance(lat, lon, siteLat, siteLon); d <= min {
+			nearest, min = site.ID, d
+		}
+	}
+	return nearest
+}
+
+type thumbnailKey struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// thumbnailCache keeps the thumbnails of pictures in memory. A thumbnail is
+// made again when its picture changes.
+type thumbnailCache struct {
+	mu      sync.Mutex
+	entries map[thumbnailKey][]byte
+}
+
+// get returns the JPEG thumbnail of the picture and the time the picture was
+// last modified.
+func (c *thumbnailCache) get(path string) ([]byte, time.Time, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	key := thumbnailKey{path: path, modTime: fi.ModTime(), size: fi.Size()}
+
+	c.mu.Lock()
+	data, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok {
+		return data, key.modTime, nil
+	}
+
+	if data, err = makeThumbnail(path); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	c.mu.Lock()
+	if len(c.entries) >= thumbnailCacheSize {
+		clear(c.entries)
+	}
+	c.entries[key] = data
+	c.mu.Unlock()
+	trace(_build, "thumbnail of %s: %d bytes", path, len(data))
+
+	return data, key.modTime, nil
+}
+
+// makeThumbnail decodes a JPEG, PNG or GIF picture and encodes a downscaled
+// copy of it as JPEG.
+func makeThumbnail(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// the header tells the size, so that a small file that decodes into a huge
+	// image is rejected before it is decoded
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %w", path, err)
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width > maxPicturePixels/config.Height {
+		return nil, fmt.Errorf("decode %s: %w: %dx%d", path, errPictureTooLarge, config.Width, config.Height)
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	src, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %w", path, err)
+	}
+
+	var buf bytes.Buffer
+	if err = jpeg.Encode(&buf, downscale(src, thumbnailSize), &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		return nil, fmt.Errorf("encode thumbnail of %s: %w", path, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// downscale fits the image in a square of the size, keeping its aspect ratio.
+// Every pixel of the result is the average of the pixels it covers. Images
+// that already fit are not scaled up.
+func downscale(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= size && h <= size {
+		return src
+	}
+	dw, dh := size, max(1, h*size/w)
+	if h > w {
+		dw, dh = max(1, w*size/h), size
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := bounds.Min.Y+y*h/dh, bounds.Min.Y+(y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := bounds.Min.X+x*w/dw, bounds.Min.X+(x+1)*w/dw
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(b / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
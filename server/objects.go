@@ -4,12 +4,16 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+
+	"src.acicovic.me/divelog/subsurface"
 )
 
 type All struct {
-	DiveSites []*DiveSite `json:"dive_sites"`
-	DiveTrips []*DiveTrip `json:"dive_trips"`
-	Dives     []*Dive     `json:"dives"`
+	Metadata  DiveLogMetadata `json:"metadata"`
+	DiveSites []*DiveSite     `json:"dive_sites"`
+	DiveTrips []*DiveTrip     `json:"dive_trips"`
+	Dives     []*DiveFull     `json:"dives"`
+	Computers []*Computer     `json:"computers"`
 }
 
 type SiteHead struct {
@@ -22,6 +26,12 @@ type SiteFull struct {
 	LinkedDives []*DiveHead `json:"linked_dives"`
 }
 
+type ComputerFull struct {
+	*Computer
+	Name        string      `json:"name"`
+	LinkedDives []*DiveHead `json:"linked_dives"`
+}
+
 type DiveHead struct {
 	ID               int    `json:"id"`
 	ShortLabel       string `json:"short_label"`
@@ -29,12 +39,108 @@ type DiveHead struct {
 	Award            string `json:"award,omitempty"`
 }
 
+// DiveFull is a dive as it is rendered. The measured values of the dive are
+// shadowed by display strings in the unit system of the request, and are also
+// given as numbers in the units named by their JSON keys, metric ones always
+// and imperial ones as well in the imperial system; zero values are left out,
+// except for temperatures.
 type DiveFull struct {
 	*Dive
-	DiveSiteName     string `json:"dive_site_name"`
-	DateTimeInPretty string `json:"date_time_in_pretty"`
-	NextID           int    `json:"-"`
-	PrevID           int    `json:"-"`
+	DiveSiteName     string     `json:"dive_site_name"`
+	DateTimeInPretty string     `json:"date_time_in_pretty"`
+	Units            UnitSystem `json:"units"`
+	NextID           int        `json:"-"`
+	PrevID           int        `json:"-"`
+
+	Duration        string `json:"duration,omitempty"`
+	Salinity        string `json:"salinity,omitempty"`
+	Weights         string `json:"weights,omitempty"`
+	DepthMax        string `json:"depth_max,omitempty"`
+	DepthMean       string `json:"depth_mean,omitempty"`
+	TempWaterMin    string `json:"temp_water_min,omitempty"`
+	TempAir         string `json:"temp_air,omitempty"`
+	SurfacePressure string `json:"surface_pressure,omitempty"`
+
+	DurationSeconds    int     `json:"duration_s,omitempty"`
+	SalinityGramsLiter float64 `json:"salinity_g_l,omitempty"`
+
+	WeightsKilograms       float64  `json:"weights_kg,omitempty"`
+	DepthMaxMeters         float64  `json:"depth_max_m,omitempty"`
+	DepthMeanMeters        float64  `json:"depth_mean_m,omitempty"`
+	TempWaterMinCelsius    *float64 `json:"temp_water_min_c,omitempty"`
+	TempAirCelsius         *float64 `json:"temp_air_c,omitempty"`
+	SurfacePressureBar     float64  `json:"surface_pressure_bar,omitempty"`
+	WeightsPounds          float64  `json:"weights_lb,omitempty"`
+	DepthMaxFeet           float64  `json:"depth_max_ft,omitempty"`
+	DepthMeanFeet          float64  `json:"depth_mean_ft,omitempty"`
+	TempWaterMinFahrenheit *float64 `json:"temp_water_min_f,omitempty"`
+	TempAirFahrenheit      *float64 `json:"temp_air_f,omitempty"`
+	SurfacePressurePSI     float64  `json:"surface_pressure_psi,omitempty"`
+
+	Cylinders     []*CylinderFull     `json:"cylinders,omitempty"`
+	DiveComputers []*DiveComputerFull `json:"dive_computers,omitempty"`
+
+	// Deprecated: the first cylinder, under the keys dives had before they
+	// listed all of their cylinders; use Cylinders.
+	CylSize       string `json:"cyl_size,omitempty"`
+	CylType       string `json:"cyl_type,omitempty"`
+	StartPressure string `json:"start_pressure,omitempty"`
+	EndPressure   string `json:"end_pressure,omitempty"`
+	Gas           string `json:"gas,omitempty"`
+}
+
+type CylinderFull struct {
+	*Cylinder
+	Size          string `json:"size,omitempty"`
+	WorkPressure  string `json:"work_pressure,omitempty"`
+	StartPressure string `json:"start_pressure,omitempty"`
+	EndPressure   string `json:"end_pressure,omitempty"`
+
+	O2Percent float64 `json:"o2_percent,omitempty"`
+	HePercent float64 `json:"he_percent,omitempty"`
+
+	SizeLiters       float64 `json:"size_l,omitempty"`
+	WorkPressureBar  float64 `json:"work_pressure_bar,omitempty"`
+	StartPressureBar float64 `json:"start_pressure_bar,omitempty"`
+	EndPressureBar   float64 `json:"end_pressure_bar,omitempty"`
+	SizeCubicFeet    float64 `json:"size_cuft,omitempty"`
+	WorkPressurePSI  float64 `json:"work_pressure_psi,omitempty"`
+	StartPressurePSI float64 `json:"start_pressure_psi,omitempty"`
+	EndPressurePSI   float64 `json:"end_pressure_psi,omitempty"`
+}
+
+type DiveComputerFull struct {
+	*DiveComputer
+	DepthMax     string `json:"depth_max,omitempty"`
+	DepthMean    string `json:"depth_mean,omitempty"`
+	TempWaterMin string `json:"temp_water_min,omitempty"`
+
+	DepthMaxMeters         float64  `json:"depth_max_m,omitempty"`
+	DepthMeanMeters        float64  `json:"depth_mean_m,omitempty"`
+	TempWaterMinCelsius    *float64 `json:"temp_water_min_c,omitempty"`
+	DepthMaxFeet           float64  `json:"depth_max_ft,omitempty"`
+	DepthMeanFeet          float64  `json:"depth_mean_ft,omitempty"`
+	TempWaterMinFahrenheit *float64 `json:"temp_water_min_f,omitempty"`
+}
+
+// ProfileSample is a sample of a dive profile. Depths, temperatures and
+// pressures are given in metric units, and also in imperial units if the
+// request selects them, under the key that names their unit; the partial
+// pressure of oxygen is always in bar.
+type ProfileSample struct {
+	TimeSeconds int      `json:"time_s"`
+	DepthMeters *float64 `json:"depth_m,omitempty"`
+	DepthFeet   *float64 `json:"depth_ft,omitempty"`
+	Celsius     *float64 `json:"temp_c,omitempty"`
+	Fahrenheit  *float64 `json:"temp_f,omitempty"`
+	PressureBar float64  `json:"pressure_bar,omitempty"`
+	PressurePSI float64  `json:"pressure_psi,omitempty"`
+	NDLSeconds  int      `json:"ndl_s,omitempty"`
+	TTSSeconds  int      `json:"tts_s,omitempty"`
+	CeilingM    float64  `json:"ceiling_m,omitempty"`
+	CeilingFt   float64  `json:"ceiling_ft,omitempty"`
+	InDeco      bool     `json:"in_deco,omitempty"`
+	PO2         float64  `json:"po2_bar,omitempty"`
 }
 
 type Trip struct {
@@ -48,6 +154,23 @@ type GroupedSites struct {
 	LinkedSites []*SiteHead
 }
 
+// CountrySites are the sites of a country, grouped by region and then by
+// locality.
+type CountrySites struct {
+	Country string
+	Regions []*RegionSites
+}
+
+type RegionSites struct {
+	Region     string
+	Localities []*LocalitySites
+}
+
+type LocalitySites struct {
+	Locality    string
+	LinkedSites []*SiteHead
+}
+
 func NewDiveHead(dive *Dive, diveSite *DiveSite) *DiveHead {
 	return &DiveHead{
 		ID:               dive.ID,
@@ -57,14 +180,116 @@ func NewDiveHead(dive *Dive, diveSite *DiveSite) *DiveHead {
 	}
 }
 
-func NewDiveFull(dive *Dive, diveSite *DiveSite) *DiveFull {
-	return &DiveFull{
+func NewDiveFull(dive *Dive, diveSite *DiveSite, units UnitSystem) *DiveFull {
+	d := &DiveFull{
 		Dive:             dive,
 		DiveSiteName:     diveSite.Name,
 		DateTimeInPretty: dive.datetime.Format("January 2 2006, 15:04"),
+		Units:            units,
 		NextID:           dive.ID + 1,
 		PrevID:           dive.ID - 1,
+
+		Duration:        subsurface.FormatDuration(dive.Duration),
+		Salinity:        waterType(dive.Salinity),
+		Weights:         units.formatWeight(dive.Weights),
+		DepthMax:        units.formatDepth(dive.DepthMax),
+		DepthMean:       units.formatDepth(dive.DepthMean),
+		TempWaterMin:    units.formatTemperature(dive.TempWaterMin),
+		TempAir:         units.formatTemperature(dive.TempAir),
+		SurfacePressure: units.formatPressure(dive.SurfacePressure),
+
+		DurationSeconds:    int(dive.Duration.Seconds()),
+		SalinityGramsLiter: float64(dive.Salinity),
+	}
+	d.WeightsKilograms, d.WeightsPounds = units.weights(dive.Weights)
+	d.DepthMaxMeters, d.DepthMaxFeet = units.depths(dive.DepthMax)
+	d.DepthMeanMeters, d.DepthMeanFeet = units.depths(dive.DepthMean)
+	d.TempWaterMinCelsius, d.TempWaterMinFahrenheit = units.temperatures(dive.TempWaterMin)
+	d.TempAirCelsius, d.TempAirFahrenheit = units.temperatures(dive.TempAir)
+	d.SurfacePressureBar, d.SurfacePressurePSI = units.pressures(dive.SurfacePressure)
+
+	for _, cyl := range dive.Cylinders {
+		c := &CylinderFull{
+			Cylinder:      cyl,
+			Size:          units.formatVolume(cyl.Size, cyl.WorkPressure),
+			WorkPressure:  units.formatPressure(cyl.WorkPressure),
+			StartPressure: units.formatPressure(cyl.StartPressure),
+			EndPressure:   units.formatPressure(cyl.EndPressure),
+			O2Percent:     float64(cyl.O2),
+			HePercent:     float64(cyl.He),
+		}
+		c.SizeLiters, c.SizeCubicFeet = units.volumes(cyl.Size, cyl.WorkPressure)
+		c.WorkPressureBar, c.WorkPressurePSI = units.pressures(cyl.WorkPressure)
+		c.StartPressureBar, c.StartPressurePSI = units.pressures(cyl.StartPressure)
+		c.EndPressureBar, c.EndPressurePSI = units.pressures(cyl.EndPressure)
+		d.Cylinders = append(d.Cylinders, c)
+	}
+	if len(d.Cylinders) > 0 {
+		first := d.Cylinders[0]
+		d.CylSize, d.CylType, d.Gas = first.Size, first.Type, first.Gas
+		d.StartPressure, d.EndPressure = first.StartPressure, first.EndPressure
+	}
+	for _, dc := range dive.DiveComputers {
+		c := &DiveComputerFull{
+			DiveComputer: dc,
+			DepthMax:     units.formatDepth(dc.DepthMax),
+			DepthMean:    units.formatDepth(dc.DepthMean),
+			TempWaterMin: units.formatTemperature(dc.TempWaterMin),
+		}
+		c.DepthMaxMeters, c.DepthMaxFeet = units.depths(dc.DepthMax)
+		c.DepthMeanMeters, c.DepthMeanFeet = units.depths(dc.DepthMean)
+		c.TempWaterMinCelsius, c.TempWaterMinFahrenheit = units.temperatures(dc.TempWaterMin)
+		d.DiveComputers = append(d.DiveComputers, c)
+	}
+	return d
+}
+
+// SecondaryDiveComputers returns all dive computers except the primary one.
+func (d *DiveFull) SecondaryDiveComputers() []*DiveComputerFull {
+	secondary := make([]*DiveComputerFull, 0, len(d.DiveComputers))
+	for _, dc := range d.DiveComputers {
+		if !dc.Primary {
+			secondary = append(secondary, dc)
+		}
+	}
+	return secondary
+}
+
+// waterType names the water of a dive by its density, if it is one of the two
+// Subsurface knows.
+func waterType(salinity subsurface.Density) string {
+	switch salinity {
+	case subsurface.DensityFreshWater:
+		return "fresh water"
+	case subsurface.DensitySaltWater:
+		return "salt water"
+	default:
+		return ""
+	}
+}
+
+func NewDiveProfile(samples []subsurface.Sample, units UnitSystem) []*ProfileSample {
+	profile := make([]*ProfileSample, 0, len(samples))
+	for _, sample := range samples {
+		ps := &ProfileSample{
+			TimeSeconds: int(sample.Time.Seconds()),
+			NDLSeconds:  int(sample.NDL.Seconds()),
+			TTSSeconds:  int(sample.TTS.Seconds()),
+			InDeco:      sample.InDeco,
+			PO2:         float64(sample.PO2),
+		}
+		// the depth is given at the surface too
+		m, ft := units.depths(sample.Depth)
+		ps.DepthMeters = &m
+		if units == UnitsImperial {
+			ps.DepthFeet = &ft
+		}
+		ps.Celsius, ps.Fahrenheit = units.temperatures(sample.Temperature)
+		ps.PressureBar, ps.PressurePSI = units.pressures(sample.Pressure)
+		ps.CeilingM, ps.CeilingFt = units.depths(sample.Ceiling)
+		profile = append(profile, ps)
 	}
+	return profile
 }
 
 func NewSiteFull(site *DiveSite, allDives []*Dive) *SiteFull {
@@ -80,6 +305,97 @@ func NewSiteFull(site *DiveSite, allDives []*Dive) *SiteFull {
 	return s
 }
 
+func NewComputerFull(computer *Computer, allDives []*Dive, allSites []*DiveSite) *ComputerFull {
+	c := &ComputerFull{
+		Computer:    computer,
+		Name:        computer.Name(),
+		LinkedDives: []*DiveHead{},
+	}
+	for i := len(allDives) - 1; i >= 0; i-- {
+		dive := allDives[i]
+		if dive.IsRecordedBy(computer.ID) {
+			c.LinkedDives = append(c.LinkedDives, NewDiveHead(dive, allSites[dive.DiveSiteID]))
+		}
+	}
+	return c
+}
+
+// GroupSitesByCountry groups the sites by country, region and locality, all in
+// alphabetical order, with the unlabeled ones last.
+func GroupSitesByCountry(sites []*DiveSite) []*CountrySites {
+	var countries []*CountrySites
+	for _, site := range sites {
+		var country *CountrySites
+		for _, c := range countries {
+			if c.Country == site.Country() {
+				country = c
+				break
+			}
+		}
+		if country == nil {
+			country = &CountrySites{Country: site.Country()}
+			countries = append(countries, country)
+		}
+
+		var region *RegionSites
+		for _, r := range country.Regions {
+			if r.Region == site.AdminRegion() {
+				region = r
+				break
+			}
+		}
+		if region == nil {
+			region = &RegionSites{Region: site.AdminRegion()}
+			country.Regions = append(country.Regions, region)
+		}
+
+		var locality *LocalitySites
+		for _, l := range region.Localities {
+			if l.Locality == site.Locality() {
+				locality = l
+				break
+			}
+		}
+		if locality == nil {
+			locality = &LocalitySites{Locality: site.Locality()}
+			region.Localities = append(region.Localities, locality)
+		}
+
+		locality.LinkedSites = append(locality.LinkedSites, &SiteHead{
+			ID:   site.ID,
+			Name: site.Name,
+		})
+	}
+
+	sort.Slice(countries, func(i, j int) bool {
+		return lessLabel(countries[i].Country, countries[j].Country, UnlabeledCountry)
+	})
+	for _, country := range countries {
+		sort.Slice(country.Regions, func(i, j int) bool {
+			return lessLabel(country.Regions[i].Region, country.Regions[j].Region, UnlabeledRegion)
+		})
+		for _, region := range country.Regions {
+			sort.Slice(region.Localities, func(i, j int) bool {
+				return lessLabel(region.Localities[i].Locality, region.Localities[j].Locality, UnlabeledLocality)
+			})
+			for _, locality := range region.Localities {
+				sort.Slice(locality.LinkedSites, func(i, j int) bool {
+					return locality.LinkedSites[i].Name < locality.LinkedSites[j].Name
+				})
+			}
+		}
+	}
+	return countries
+}
+
+// lessLabel orders labels alphabetically, with the unlabeled one last.
+func lessLabel(a string, b string, unlabeled string) bool {
+	if a == unlabeled || b == unlabeled {
+		return b == unlabeled && a != unlabeled
+	}
+	return a < b
+}
+
 func (s *SiteFull) URLLongLat() string {
 	return strings.Replace(s.Coordinates, " ", ",", 1)
 }
@@ -93,8 +409,11 @@ type Page struct {
 	Tags         map[string]int
 	Dive         *DiveFull
 	Site         *SiteFull
+	Computers    []*ComputerFull
+	Countries    []*CountrySites
 	About        bool
 	NotFound     bool
+	Units        UnitSystem
 }
 
 func (p *Page) check() bool {
@@ -117,6 +436,12 @@ func (p *Page) check() bool {
 	if p.Site != nil {
 		c++
 	}
+	if p.Computers != nil {
+		c++
+	}
+	if p.Countries != nil {
+		c++
+	}
 	if p.About {
 		c++
 	}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The log is rebuilt from its source while the server keeps serving the log it
+// has. The new log is built off to the side and validated, and only then does
+// it replace the log being served. Requests in flight finish with the log they
+// started with. A rebuild that fails leaves the served log as it is, and so
+// does one that loses dives, unless the loss is confirmed.
+
+// RebuildReport is the outcome of a rebuild. The counts are those of the log
+// that is served after it, which is the old one if the rebuild failed.
+type RebuildReport struct {
+	Rebuilt    bool   `json:"rebuilt"`
+	Error      string `json:"error,omitempty"`
+	DivesLost  int    `json:"dives_lost,omitempty"`
+	DiveSites  int    `json:"dive_sites"`
+	DiveTrips  int    `json:"dive_trips"`
+	Dives      int    `json:"dives"`
+	Computers  int    `json:"computers"`
+	Duration   string `json:"duration"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// only one rebuild runs at a time
+var _rebuildLock sync.Mutex
+
+// rebuild builds the log from its source again and swaps it in. If verify is
+// not nil, it is called before the swap, and can fail the rebuild. A rebuilt
+// log with fewer dives than the served one replaces it only if confirmed is
+// set; otherwise the report tells how many dives would be lost.
+func rebuild(verify func() error, confirmed bool) *RebuildReport {
+	_rebuildLock.Lock()
+	defer _rebuildLock.Unlock()
+
+	start := time.Now()
+	current := _bluefin.Load()
+	lost := 0
+	log, err := buildDatabase(_metadata)
+	if err == nil {
+		lost = current.LargestDiveID() - log.LargestDiveID()
+		err = acceptRebuild(current, log, confirmed)
+	}
+	if err == nil && verify != nil {
+		err = verify()
+	}
+	if err == nil {
+		_bluefin.Store(log)
+	} else {
+		log = current
+	}
+	elapsed := time.Since(start)
+
+	report := &RebuildReport{
+		Rebuilt:    err == nil,
+		DiveSites:  log.LargestSiteID(),
+		DiveTrips:  len(log.DiveTrips) - 1,
+		Dives:      log.LargestDiveID(),
+		Computers:  log.LargestComputerID(),
+		Duration:   elapsed.Round(time.Microsecond).String(),
+		DurationMs: elapsed.Milliseconds(),
+	}
+	if errors.Is(err, errDivesLost) {
+		report.DivesLost = lost
+	}
+	if err != nil {
+		report.Error = err.Error()
+		trace(_error, "rebuild failed after %v, keeping %d dives: %v", report.Duration, report.Dives, err)
+	} else {
+		trace(_build, "rebuilt in %v: %d dives, %d dive sites, %d dive trips, %d computers",
+			report.Duration, report.Dives, report.DiveSites, report.DiveTrips, report.Computers)
+	}
+	return report
+}
+
+var errDivesLost = errors.New("the rebuilt log has fewer dives than the served one")
+
+// acceptRebuild reports whether the rebuilt log may replace the current one.
+// A log with fewer dives does not replace it unless the loss is confirmed, as
+// it is more likely to come from a truncated file, or one that is still being
+// written, than from dives that were deleted.
+func acceptRebuild(current *DiveLog, rebuilt *DiveLog, confirmed bool) error {
+	if n := rebuilt.LargestDiveID(); n < current.LargestDiveID() && !confirmed {
+		return fmt.Errorf("%w: %d of %d dives", errDivesLost, n, current.LargestDiveID())
+	}
+	return nil
+}
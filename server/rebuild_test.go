@@ -0,0 +1,146 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const rebuildFixture = "../subsurface/testdata/dives.xml"
+
+// fixtureSource returns the fixture, which has three dives, or the fixture
+// without its last dive.
+func fixtureSource(t *testing.T, withoutLast bool) string {
+	t.Helper()
+	data, err := os.ReadFile(rebuildFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := string(data)
+	if withoutLast {
+		start := strings.LastIndex(source, "<dive number=")
+		end := strings.Index(source[start:], "</dive>") + len("</dive>")
+		source = source[:start] + source[start+end:]
+	}
+	return source
+}
+
+// addDive adds a dive after the dives of the fixture.
+func addDive(source string) string {
+	return strings.Replace(source, "</dives>", "<dive date='2024-09-01' time='10:00:00'/>\n</dives>", 1)
+}
+
+// serveSource builds the log from a copy of a source and serves it, as Run
+// does. It returns the path of the copy, which the test can change.
+func serveSource(t *testing.T, source string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "dives.xml")
+	writeSource(t, path, source)
+
+	metadata, served := _metadata, _bluefin.Load()
+	t.Cleanup(func() {
+		_metadata = metadata
+		_bluefin.Store(served)
+	})
+	_metadata = DiveLogMetadata{Source: path}
+	log, err := buildDatabase(_metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_bluefin.Store(log)
+	return path
+}
+
+func writeSource(t *testing.T, path string, source string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(source), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	errChanged := errors.New("source changed")
+	for _, tc := range []struct {
+		name      string
+		source    string // empty to keep the served source
+		verify    func() error
+		confirmed bool
+		rebuilt   bool
+		dives     int
+		lost      int
+	}{
+		{name: "same source", rebuilt: true, dives: 3},
+		{name: "more dives", source: addDive(fixtureSource(t, false)), rebuilt: true, dives: 4},
+		{name: "missing source", source: "-", dives: 3},
+		{name: "half-written source", source: fixtureSource(t, false)[:1000], dives: 3},
+		{name: "empty source", source: " ", dives: 3},
+		{name: "lost dive", source: fixtureSource(t, true), dives: 3, lost: 1},
+		{name: "confirmed lost dive", source: fixtureSource(t, true), confirmed: true, rebuilt: true, dives: 2},
+		{name: "verify error", verify: func() error { return errChanged }, dives: 3},
+		{name: "verify error and lost dive", source: fixtureSource(t, true), verify: func() error { return errChanged }, dives: 3, lost: 1},
+		{name: "verify error and confirmed lost dive", source: fixtureSource(t, true), verify: func() error { return errChanged }, confirmed: true, dives: 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := serveSource(t, fixtureSource(t, false))
+			switch tc.source {
+			case "":
+			case "-":
+				if err := os.Remove(path); err != nil {
+					t.Fatal(err)
+				}
+			default:
+				writeSource(t, path, tc.source)
+			}
+
+			// a request in flight has loaded the log before the rebuild
+			snapshot := _bluefin.Load()
+			report := rebuild(tc.verify, tc.confirmed)
+
+			if report.Rebuilt != tc.rebuilt || report.Dives != tc.dives || report.DivesLost != tc.lost {
+				t.Errorf("report %+v, want rebuilt %v with %d dives, %d lost", report, tc.rebuilt, tc.dives, tc.lost)
+			}
+			if (report.Error == "") != tc.rebuilt {
+				t.Errorf("error %q", report.Error)
+			}
+			served := _bluefin.Load()
+			if (served != snapshot) != tc.rebuilt {
+				t.Errorf("the served log was replaced: %v", served != snapshot)
+			}
+			if n := served.LargestDiveID(); n != tc.dives {
+				t.Errorf("%d dives served, want %d", n, tc.dives)
+			}
+			if n := snapshot.LargestDiveID(); n != 3 || snapshot.validate() != nil {
+				t.Errorf("the log of the request in flight changed to %d dives", n)
+			}
+		})
+	}
+}
+
+func TestAcceptRebuild(t *testing.T) {
+	logWithDives := func(n int) *DiveLog {
+		log := &DiveLog{Dives: make([]*Dive, n+1)}
+		for i := 1; i <= n; i++ {
+			log.Dives[i] = &Dive{ID: i}
+		}
+		return log
+	}
+	for _, tc := range []struct {
+		current, rebuilt int
+		confirmed        bool
+		lost             bool
+	}{
+		{current: 3, rebuilt: 3},
+		{current: 3, rebuilt: 4},
+		{current: 0, rebuilt: 0},
+		{current: 3, rebuilt: 2, lost: true},
+		{current: 3, rebuilt: 0, lost: true},
+		{current: 3, rebuilt: 2, confirmed: true},
+	} {
+		err := acceptRebuild(logWithDives(tc.current), logWithDives(tc.rebuilt), tc.confirmed)
+		if errors.Is(err, errDivesLost) != tc.lost {
+			t.Errorf("%d to %d dives, confirmed %v: err = %v", tc.current, tc.rebuilt, tc.confirmed, err)
+		}
+	}
+}
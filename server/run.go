@@ -1,9 +1,11 @@
 package server
 
 import (
+	"html/template"
 	"os"
 	"path/filepath"
 	"strconv"
+	"time"
 )
 
 var _serverControl control
@@ -11,7 +13,16 @@ var _serverControl control
 func Run() {
 	trace(_control, "main: start: %s v1.2", filepath.Base(os.Args[0]))
 	readEnvironment()
-	buildDatabase()
+	_pageTemplate = template.Must(template.ParseFiles(FilePageTemplate))
+	watcher := newSourceWatcher(_metadata.Source, _watchInterval)
+	log, err := buildDatabase(_metadata)
+	if err != nil {
+		panic(err)
+	}
+	_bluefin.Store(log)
+	if watcher != nil {
+		go watcher.run()
+	}
 	_serverControl.boot()
 }
 
@@ -19,6 +30,11 @@ func readEnvironment() {
 	const (
 		modeEnvVar        = "DIVELOG_MODE"
 		dbPathEnvVar      = "DIVELOG_DBFILE_PATH"
+		fitDirEnvVar      = "DIVELOG_FIT_DIR"
+		csvMappingEnvVar  = "DIVELOG_CSV_MAPPING"
+		mediaRootEnvVar   = "DIVELOG_MEDIA_ROOT"
+		unitsEnvVar       = "DIVELOG_UNITS"
+		watchEnvVar       = "DIVELOG_WATCH_INTERVAL"
 		ipHostEnvVar      = "DIVELOG_IP_HOST"
 		portEnvVar        = "DIVELOG_PORT"
 		privateKeyPathVar = "DIVELOG_PRIVATE_KEY_PATH"
@@ -84,10 +100,41 @@ func readEnvironment() {
 		os.Exit(1)
 	}
 
-	bluefin.Metadata.Source = os.Getenv(dbPathEnvVar)
-	trace(_env, "%s = %q", dbPathEnvVar, bluefin.Metadata.Source)
-	if bluefin.Metadata.Source == "" {
+	_metadata.Source = os.Getenv(dbPathEnvVar)
+	trace(_env, "%s = %q", dbPathEnvVar, _metadata.Source)
+	if _metadata.Source == "" {
 		trace(_error, "%s is empty or undefined", dbPathEnvVar)
 		os.Exit(1)
 	}
+
+	_metadata.FITDirectory = os.Getenv(fitDirEnvVar)
+	trace(_env, "%s = %q", fitDirEnvVar, _metadata.FITDirectory)
+
+	_metadata.CSVMapping = os.Getenv(csvMappingEnvVar)
+	trace(_env, "%s = %q", csvMappingEnvVar, _metadata.CSVMapping)
+
+	_metadata.MediaRoot = os.Getenv(mediaRootEnvVar)
+	trace(_env, "%s = %q", mediaRootEnvVar, _metadata.MediaRoot)
+
+	units := os.Getenv(unitsEnvVar)
+	trace(_env, "%s = %q", unitsEnvVar, units)
+	if units == "" {
+		units = string(UnitsMetric)
+	}
+	if _, ok := ParseUnitSystem(units); !ok {
+		trace(_error, "value of %s is invalid", unitsEnvVar)
+		os.Exit(1)
+	}
+	_metadata.Units = units
+
+	watch := os.Getenv(watchEnvVar)
+	trace(_env, "%s = %q", watchEnvVar, watch)
+	if watch != "" {
+		interval, err := time.ParseDuration(watch)
+		if err != nil || interval < 0 {
+			trace(_error, "value of %s is invalid", watchEnvVar)
+			os.Exit(1)
+		}
+		_watchInterval = interval
+	}
 }
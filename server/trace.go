@@ -16,6 +16,7 @@ const (
 	_link    TracePrefix = "link"
 	_map     TracePrefix = "map"
 	_https   TracePrefix = "https"
+	_watch   TracePrefix = "watch"
 )
 
 func trace(prefix TracePrefix, format string, args ...interface{}) {
@@ -0,0 +1,462 @@
+package server
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"src.acicovic.me/divelog/subsurface"
+)
+
+// UDDF 3.2 export of the dive log. UDDF uses SI units: meters, kelvin, pascal,
+// cubic meters and seconds. Dives are put in repetition groups, which start
+// anew after a surface interval of more than a day.
+
+const (
+	UDDFVersion       = "3.2.0"
+	UDDFNamespace     = "http://www.streit.cc/uddf/3.2/"
+	UDDFGeneratorName = "bluefin"
+	UDDFGeneratorType = "logbook"
+	ContentTypeUDDF   = "application/xml"
+	FileNameUDDF      = "divelog.uddf"
+
+	uddfRepetitionInterval = 24 * time.Hour
+)
+
+type UDDFDocument struct {
+	XMLName        xml.Name            `xml:"uddf"`
+	Namespace      string              `xml:"xmlns,attr"`
+	Version        string              `xml:"version,attr"`
+	Generator      UDDFGenerator       `xml:"generator"`
+	Diver          *UDDFDiver          `xml:"diver,omitempty"`
+	DiveSite       UDDFDiveSite        `xml:"divesite"`
+	DiveTrip       *UDDFDiveTrip       `xml:"divetrip,omitempty"`
+	GasDefinitions *UDDFGasDefinitions `xml:"gasdefinitions,omitempty"`
+	ProfileData    UDDFProfileData     `xml:"profiledata"`
+}
+
+type UDDFGenerator struct {
+	Name     string `xml:"name"`
+	Type     string `xml:"type"`
+	DateTime string `xml:"datetime"`
+}
+
+type UDDFDiver struct {
+	Owner   UDDFPerson   `xml:"owner"`
+	Buddies []UDDFPerson `xml:"buddy"`
+}
+
+type UDDFPerson struct {
+	ID        string `xml:"id,attr"`
+	FirstName string `xml:"personal>firstname,omitempty"`
+}
+
+type UDDFDiveSite struct {
+	Sites []UDDFSite `xml:"site"`
+}
+
+type UDDFSite struct {
+	ID        string         `xml:"id,attr"`
+	Name      string         `xml:"name"`
+	Geography *UDDFGeography `xml:"geography,omitempty"`
+	Notes     *UDDFNotes     `xml:"notes,omitempty"`
+}
+
+type UDDFGeography struct {
+	Location  string `xml:"location,omitempty"`
+	Latitude  string `xml:"latitude,omitempty"`
+	Longitude string `xml:"longitude,omitempty"`
+}
+
+type UDDFNotes struct {
+	Paragraphs []string `xml:"para"`
+}
+
+type UDDFDiveTrip struct {
+	Trips []UDDFTrip `xml:"trip"`
+}
+
+type UDDFTrip struct {
+	ID   string       `xml:"id,attr"`
+	Name string       `xml:"name"`
+	Part UDDFTripPart `xml:"trippart"`
+}
+
+type UDDFTripPart struct {
+	Name         string     `xml:"name"`
+	RelatedDives []UDDFLink `xml:"relateddives>link"`
+}
+
+type UDDFLink struct {
+	Ref string `xml:"ref,attr"`
+}
+
+type UDDFGasDefinitions struct {
+	Mixes []UDDFMix `xml:"mix"`
+}
+
+type UDDFMix struct {
+	ID   string `xml:"id,attr"`
+	Name string `xml:"name"`
+	O2   string `xml:"o2"`
+	N2   string `xml:"n2"`
+	He   string `xml:"he"`
+}
+
+type UDDFProfileData struct {
+	RepetitionGroups []UDDFRepetitionGroup `xml:"repetitiongroup"`
+}
+
+type UDDFRepetitionGroup struct {
+	ID    string     `xml:"id,attr"`
+	Dives []UDDFDive `xml:"dive"`
+}
+
+type UDDFDive struct {
+	ID      string                    `xml:"id,attr"`
+	Before  UDDFInformationBeforeDive `xml:"informationbeforedive"`
+	Tanks   []UDDFTankData            `xml:"tankdata"`
+	Samples *UDDFSamples              `xml:"samples,omitempty"`
+	After   UDDFInformationAfterDive  `xml:"informationafterdive"`
+}
+
+// UDDFInformationBeforeDive elements follow the links in alphabetical order,
+// as the schema lists them.
+type UDDFInformationBeforeDive struct {
+	Links           []UDDFLink          `xml:"link"`
+	AirTemperature  string              `xml:"airtemperature,omitempty"`
+	DateTime        string              `xml:"datetime"`
+	DiveNumber      string              `xml:"divenumber,omitempty"`
+	SurfaceInterval UDDFSurfaceInterval `xml:"surfaceintervalbeforedive"`
+}
+
+// UDDFSurfaceInterval holds either the seconds since the previous dive,
+// or an empty <infinity/> element for the first dive.
+type UDDFSurfaceInterval struct {
+	PassedTime string    `xml:"passedtime,omitempty"`
+	Infinity   *struct{} `xml:"infinity,omitempty"`
+}
+
+type UDDFSamples struct {
+	Points []UDDFWaypoint `xml:"waypoint"`
+}
+
+// UDDFTankData elements follow the link in alphabetical order, as the schema
+// lists them.
+type UDDFTankData struct {
+	Link          *UDDFLink `xml:"link,omitempty"`
+	PressureBegin string    `xml:"tankpressurebegin,omitempty"`
+	PressureEnd   string    `xml:"tankpressureend,omitempty"`
+	Volume        string    `xml:"tankvolume,omitempty"`
+}
+
+// UDDFWaypoint starts with the depth and the dive time, which every waypoint
+// has, followed by the optional elements in alphabetical order, as the schema
+// lists them.
+type UDDFWaypoint struct {
+	Depth         string        `xml:"depth"`
+	DiveTime      string        `xml:"divetime"`
+	CalculatedPO2 string        `xml:"calculatedpo2,omitempty"`
+	DecoStop      *UDDFDecoStop `xml:"decostop,omitempty"`
+	NoDecoTime    string        `xml:"nodecotime,omitempty"`
+	TankPressure  string        `xml:"tankpressure,omitempty"`
+	Temperature   string        `xml:"temperature,omitempty"`
+}
+
+type UDDFDecoStop struct {
+	Kind     string `xml:"kind,attr"`
+	Depth    string `xml:"decodepth,attr"`
+	Duration string `xml:"duration,attr"`
+}
+
+// UDDFInformationAfterDive leaves out visibility, which UDDF measures in
+// meters and Subsurface rates with stars.
+type UDDFInformationAfterDive struct {
+	AverageDepth      string             `xml:"averagedepth,omitempty"`
+	DiveDuration      string             `xml:"diveduration,omitempty"`
+	EquipmentUsed     *UDDFEquipmentUsed `xml:"equipmentused,omitempty"`
+	GreatestDepth     string             `xml:"greatestdepth"`
+	LowestTemperature string             `xml:"lowesttemperature,omitempty"`
+	Notes             *UDDFNotes         `xml:"notes,omitempty"`
+	Rating            *UDDFRating        `xml:"rating,omitempty"`
+}
+
+type UDDFEquipmentUsed struct {
+	LeadQuantity string `xml:"leadquantity"`
+}
+
+type UDDFRating struct {
+	Value string `xml:"ratingvalue"`
+}
+
+// WriteUDDF writes the whole dive log as a UDDF document.
+func (log *DiveLog) WriteUDDF(w io.Writer) error {
+	return NewUDDFDocument(log, time.Now()).Write(w)
+}
+
+// Write writes the document with an XML declaration, indented.
+func (doc *UDDFDocument) Write(w io.Writer) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// ExportUDDF loads the database at source and writes it as a UDDF file.
+// It does not start the server.
+func ExportUDDF(source string, target string) error {
+	log, err := buildDatabase(DiveLogMetadata{Source: source, Units: string(UnitsMetric)})
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	if err = log.WriteUDDF(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func NewUDDFDocument(log *DiveLog, generated time.Time) *UDDFDocument {
+	doc := &UDDFDocument{
+		Namespace: UDDFNamespace,
+		Version:   UDDFVersion,
+		Generator: UDDFGenerator{
+			Name:     UDDFGeneratorName,
+			Type:     UDDFGeneratorType,
+			DateTime: generated.UTC().Format(time.RFC3339),
+		},
+	}
+
+	for _, site := range log.DiveSites[1:] {
+		uddfSite := UDDFSite{
+			ID:   uddfID("site", site.ID),
+			Name: site.Name,
+		}
+		geography := &UDDFGeography{}
+		if len(site.GeoLabels) > 0 {
+			geography.Location = strings.Join(site.GeoLabels, ", ")
+		}
+		if lat, lon, ok := parseCoordinates(site.Coordinates); ok {
+			geography.Latitude = formatUDDF(lat)
+			geography.Longitude = formatUDDF(lon)
+		}
+		if *geography != (UDDFGeography{}) {
+			uddfSite.Geography = geography
+		}
+		if site.Description != UndefinedDescription {
+			uddfSite.Notes = uddfNotes(site.Description)
+		}
+		doc.DiveSite.Sites = append(doc.DiveSite.Sites, uddfSite)
+	}
+
+	var (
+		buddyIDs = make(map[string]string)
+		mixIDs   = make(map[[2]subsurface.Fraction]string)
+		diver    = &UDDFDiver{Owner: UDDFPerson{ID: "owner"}}
+		gases    = &UDDFGasDefinitions{}
+	)
+
+	dives := slices.Clone(log.Dives[1:])
+	slices.SortStableFunc(dives, func(a, b *Dive) int {
+		return a.datetime.Compare(b.datetime)
+	})
+
+	var (
+		group   *UDDFRepetitionGroup
+		lastEnd time.Time
+	)
+	for _, dive := range dives {
+		uddfDive := UDDFDive{
+			ID: uddfID("dive", dive.ID),
+			Before: UDDFInformationBeforeDive{
+				Links:          []UDDFLink{{Ref: uddfID("site", dive.DiveSiteID)}},
+				DateTime:       dive.datetime.Format("2006-01-02T15:04:05"),
+				AirTemperature: formatUDDFQuantity(float64(dive.TempAir)),
+			},
+			After: UDDFInformationAfterDive{
+				AverageDepth:      formatUDDFQuantity(float64(dive.DepthMean)),
+				DiveDuration:      formatUDDFQuantity(dive.Duration.Seconds()),
+				GreatestDepth:     formatUDDF(float64(dive.DepthMax)),
+				LowestTemperature: formatUDDFQuantity(float64(dive.TempWaterMin)),
+				Notes:             uddfNotes(dive.Notes),
+			},
+		}
+		if dive.Number != subsurface.IntNull {
+			uddfDive.Before.DiveNumber = strconv.Itoa(dive.Number)
+		}
+		if dive.Weights != 0 {
+			uddfDive.After.EquipmentUsed = &UDDFEquipmentUsed{LeadQuantity: formatUDDF(float64(dive.Weights))}
+		}
+		if dive.Rating5 != subsurface.IntNull {
+			// UDDF rates dives from 1 to 10
+			uddfDive.After.Rating = &UDDFRating{Value: strconv.Itoa(2 * dive.Rating5)}
+		}
+
+		for _, name := range strings.Split(dive.Buddy, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			id, ok := buddyIDs[name]
+			if !ok {
+				id = uddfID("buddy", len(buddyIDs)+1)
+				buddyIDs[name] = id
+				diver.Buddies = append(diver.Buddies, UDDFPerson{ID: id, FirstName: name})
+			}
+			uddfDive.Before.Links = append(uddfDive.Before.Links, UDDFLink{Ref: id})
+		}
+
+		if group == nil || dive.datetime.Sub(lastEnd) > uddfRepetitionInterval {
+			doc.ProfileData.RepetitionGroups = append(doc.ProfileData.RepetitionGroups, UDDFRepetitionGroup{
+				ID: uddfID("group", len(doc.ProfileData.RepetitionGroups)+1),
+			})
+			group = &doc.ProfileData.RepetitionGroups[len(doc.ProfileData.RepetitionGroups)-1]
+			uddfDive.Before.SurfaceInterval.Infinity = &struct{}{}
+		} else {
+			interval := max(dive.datetime.Sub(lastEnd), 0)
+			uddfDive.Before.SurfaceInterval.PassedTime = formatUDDF(interval.Seconds())
+		}
+		lastEnd = dive.datetime.Add(dive.Duration)
+
+		for _, cyl := range dive.Cylinders {
+			tank := UDDFTankData{
+				Volume:        formatUDDFQuantity(float64(cyl.Size) / 1000),
+				PressureBegin: formatUDDFQuantity(float64(cyl.StartPressure) * 1e5),
+				PressureEnd:   formatUDDFQuantity(float64(cyl.EndPressure) * 1e5),
+			}
+			o2 := cyl.O2
+			if o2 == 0 {
+				o2 = 21 // air
+			}
+			mix := [2]subsurface.Fraction{o2, cyl.He}
+			id, ok := mixIDs[mix]
+			if !ok {
+				id = uddfID("mix", len(mixIDs)+1)
+				mixIDs[mix] = id
+				gases.Mixes = append(gases.Mixes, UDDFMix{
+					ID:   id,
+					Name: cyl.Gas,
+					O2:   formatUDDF(float64(o2) / 100),
+					N2:   formatUDDF(float64(100-o2-cyl.He) / 100),
+					He:   formatUDDF(float64(cyl.He) / 100),
+				})
+			}
+			tank.Link = &UDDFLink{Ref: id}
+			uddfDive.Tanks = append(uddfDive.Tanks, tank)
+		}
+
+		if len(dive.Samples) > 0 {
+			uddfDive.Samples = &UDDFSamples{}
+		}
+		for _, sample := range dive.Samples {
+			point := UDDFWaypoint{
+				CalculatedPO2: formatUDDFQuantity(float64(sample.PO2) * 1e5),
+				Depth:         formatUDDF(float64(sample.Depth)),
+				DiveTime:      formatUDDF(sample.Time.Seconds()),
+				NoDecoTime:    formatUDDFQuantity(sample.NDL.Seconds()),
+				TankPressure:  formatUDDFQuantity(float64(sample.Pressure) * 1e5),
+				Temperature:   formatUDDFQuantity(float64(sample.Temperature)),
+			}
+			if sample.InDeco && sample.Ceiling != 0 {
+				point.DecoStop = &UDDFDecoStop{
+					Kind:     "mandatory",
+					Depth:    formatUDDF(float64(sample.Ceiling)),
+					Duration: "0",
+				}
+			}
+			uddfDive.Samples.Points = append(uddfDive.Samples.Points, point)
+		}
+
+		group.Dives = append(group.Dives, uddfDive)
+	}
+
+	if len(diver.Buddies) > 0 {
+		doc.Diver = diver
+	}
+	if len(gases.Mixes) > 0 {
+		doc.GasDefinitions = gases
+	}
+
+	// trips are groups of dives, linked by their IDs
+	trips := &UDDFDiveTrip{}
+	for _, trip := range log.DiveTrips[1:] {
+		uddfTrip := UDDFTrip{
+			ID:   uddfID("trip", trip.ID),
+			Name: trip.Label,
+			Part: UDDFTripPart{Name: trip.Label},
+		}
+		for _, dive := range dives {
+			if dive.DiveTripID == trip.ID {
+				uddfTrip.Part.RelatedDives = append(uddfTrip.Part.RelatedDives, UDDFLink{Ref: uddfID("dive", dive.ID)})
+			}
+		}
+		trips.Trips = append(trips.Trips, uddfTrip)
+	}
+	if len(trips.Trips) > 0 {
+		doc.DiveTrip = trips
+	}
+
+	return doc
+}
+
+func uddfID(kind string, id int) string {
+	return fmt.Sprintf("%s_%d", kind, id)
+}
+
+func uddfNotes(text string) *UDDFNotes {
+	var notes UDDFNotes
+	for _, para := range strings.Split(text, "\n") {
+		if trimmed := strings.TrimSpace(para); trimmed != "" {
+			notes.Paragraphs = append(notes.Paragraphs, trimmed)
+		}
+	}
+	if len(notes.Paragraphs) == 0 {
+		return nil
+	}
+	return &notes
+}
+
+// parseCoordinates parses Subsurface coordinates, e.g. "28.572000 34.537000".
+func parseCoordinates(coords string) (lat float64, lon float64, ok bool) {
+	fields := strings.Fields(coords)
+	if len(fields) != 2 {
+		return 0, 0, false
+	}
+	lat, errLat := strconv.ParseFloat(fields[0], 64)
+	lon, errLon := strconv.ParseFloat(fields[1], 64)
+	return lat, lon, errLat == nil && errLon == nil
+}
+
+// formatUDDF formats a value without the noise of unit conversions,
+// e.g. 0.0111 instead of 0.011099999999999999 for an 11.1 l tank.
+func formatUDDF(v float64) string {
+	return strconv.FormatFloat(math.Round(v*1e9)/1e9, 'f', -1, 64)
+}
+
+// formatUDDFQuantity formats an optional value; zero means not recorded.
+func formatUDDFQuantity(v float64) string {
+	if v == 0 {
+		return ""
+	}
+	return formatUDDF(v)
+}
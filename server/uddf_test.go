@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"src.acicovic.me/divelog/subsurface"
+	"src.acicovic.me/divelog/uddf"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+const uddfGolden = "testdata/divelog.uddf"
+
+func exportFixture(t *testing.T) []byte {
+	t.Helper()
+	log, err := buildDatabase(DiveLogMetadata{Source: "../subsurface/testdata/dives.xml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	generated := time.Date(2024, 9, 1, 12, 0, 0, 0, time.UTC)
+	if err = NewUDDFDocument(log, generated).Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestUDDFExport(t *testing.T) {
+	got := exportFixture(t)
+	if *update {
+		if err := os.WriteFile(uddfGolden, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(uddfGolden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("export differs from %s; run go test -update to review the change with git diff", uddfGolden)
+	}
+
+	// the export reads back with the same dives, sites and cylinders
+	records, err := uddf.ReadRecords(bytes.NewReader(got))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sites, dives, cylinders int
+	for _, record := range records {
+		switch rec := record.(type) {
+		case *subsurface.SiteRecord:
+			sites++
+		case *subsurface.DiveRecord:
+			dives++
+			cylinders += len(rec.Cylinders)
+		}
+	}
+	if sites != 2 || dives != 3 || cylinders != 4 {
+		t.Errorf("read back %d sites, %d dives and %d cylinders", sites, dives, cylinders)
+	}
+}
+
+// TestUDDFSchema validates the export against the UDDF schema, which is not
+// part of the repository: set UDDF_SCHEMA to the path of uddf_3.2.x.xsd. It is
+// skipped otherwise, so schema validation is a manual step (see README).
+func TestUDDFSchema(t *testing.T) {
+	schema := os.Getenv("UDDF_SCHEMA")
+	if schema == "" {
+		t.Skip("UDDF_SCHEMA is not set")
+	}
+	xmllint, err := exec.LookPath("xmllint")
+	if err != nil {
+		t.Skip("xmllint is not installed")
+	}
+
+	file := filepath.Join(t.TempDir(), "divelog.uddf")
+	if err = os.WriteFile(file, exportFixture(t), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(xmllint, "--noout", "--schema", schema, file).CombinedOutput()
+	if err != nil {
+		t.Errorf("%v:\n%s", err, out)
+	}
+}
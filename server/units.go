@@ -0,0 +1,205 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"src.acicovic.me/divelog/subsurface"
+)
+
+// Measured values are kept in metric units and converted when they are
+// rendered, to the unit system of the server or the one chosen by the client:
+// the "units" query parameter selects it for a single request, and pages also
+// remember it in a cookie of the same name. Numeric JSON fields name their
+// unit in the key: the metric ones (e.g. "depth_max_m") are always present, so
+// that clients may rely on them, and the imperial ones (e.g. "depth_max_ft")
+// are added alongside when the imperial system is selected.
+
+// UnitSystem is a system of units in which dives are rendered.
+type UnitSystem string
+
+const (
+	UnitsMetric   UnitSystem = "metric"
+	UnitsImperial UnitSystem = "imperial"
+
+	unitsParam        = "units"
+	unitsCookieMaxAge = 365 * 24 * 60 * 60 // seconds
+
+	metersToFeet    = 1 / 0.3048
+	barToPSI        = 14.503773773
+	kgToPounds      = 1 / 0.45359237
+	litersToCubicFt = 0.0353146667
+	atmosphere      = 1.01325 // bar
+)
+
+// ParseUnitSystem parses the name of a unit system.
+func ParseUnitSystem(s string) (UnitSystem, bool) {
+	switch u := UnitSystem(s); u {
+	case UnitsMetric, UnitsImperial:
+		return u, true
+	}
+	return "", false
+}
+
+// requestUnits returns the unit system of the request: the one in the query,
+// or the one remembered by the client. It is not ok if the query names an
+// unknown system.
+func requestUnits(r *http.Request) (UnitSystem, bool) {
+	if s := r.URL.Query().Get(unitsParam); s != "" {
+		return ParseUnitSystem(s)
+	}
+	return rememberedUnits(r), true
+}
+
+// pageUnits returns the unit system of a page request, in which an unknown
+// system in the query is ignored.
+func pageUnits(r *http.Request) UnitSystem {
+	if units, ok := requestUnits(r); ok {
+		return units
+	}
+	return rememberedUnits(r)
+}
+
+// rememberedUnits returns the unit system in the cookie, or the default of the
+// server if there is no valid one.
+func rememberedUnits(r *http.Request) UnitSystem {
+	if cookie, err := r.Cookie(unitsParam); err == nil {
+		if units, ok := ParseUnitSystem(cookie.Value); ok {
+			return units
+		}
+	}
+	return UnitSystem(_metadata.Units)
+}
+
+// rememberUnits sets the cookie to the unit system in the query, if any.
+func rememberUnits(w http.ResponseWriter, r *http.Request) {
+	if units, ok := ParseUnitSystem(r.URL.Query().Get(unitsParam)); ok {
+		http.SetCookie(w, &http.Cookie{
+			Name:     unitsParam,
+			Value:    string(units),
+			Path:     "/",
+			MaxAge:   unitsCookieMaxAge,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+}
+
+// Other returns the other unit system, which pages link to.
+func (u UnitSystem) Other() UnitSystem {
+	if u == UnitsImperial {
+		return UnitsMetric
+	}
+	return UnitsImperial
+}
+
+// The following methods return a value in the unit of the metric system, and
+// in the unit of the imperial system if it is selected (zero or nil otherwise).
+
+func (u UnitSystem) depths(d subsurface.Depth) (m float64, ft float64) {
+	if u == UnitsImperial {
+		ft = thousandths(float64(d) * metersToFeet)
+	}
+	return float64(d), ft
+}
+
+func (u UnitSystem) pressures(p subsurface.Pressure) (bar float64, psi float64) {
+	if u == UnitsImperial {
+		psi = thousandths(float64(p) * barToPSI)
+	}
+	return float64(p), psi
+}
+
+func (u UnitSystem) weights(w subsurface.Weight) (kg float64, lb float64) {
+	if u == UnitsImperial {
+		lb = thousandths(float64(w) * kgToPounds)
+	}
+	return float64(w), lb
+}
+
+// volumes returns the size of a cylinder. In imperial units cylinders are
+// sized by the volume of the gas they hold at their working pressure, e.g. 80
+// cu ft for an 11.1 l cylinder, as in Subsurface; cylinders without a working
+// pressure are sized by their water volume.
+func (u UnitSystem) volumes(v subsurface.Volume, wp subsurface.Pressure) (l float64, cuft float64) {
+	if u == UnitsImperial {
+		cuft = float64(v) * litersToCubicFt
+		if wp != 0 {
+			cuft *= float64(wp) / atmosphere
+		}
+		cuft = thousandths(cuft)
+	}
+	return float64(v), cuft
+}
+
+// temperatures returns nil for a temperature that was not recorded, so that
+// 0 °C is told apart from a missing value.
+func (u UnitSystem) temperatures(t subsurface.Temperature) (c *float64, f *float64) {
+	if t == 0 {
+		return nil, nil
+	}
+	v := t.Celsius()
+	if u == UnitsImperial {
+		vf := thousandths(v*9/5 + 32)
+		f = &vf
+	}
+	return &v, f
+}
+
+// The following methods format a value in the unit system; zero means that a
+// value was not recorded, and yields an empty string.
+
+func (u UnitSystem) formatDepth(d subsurface.Depth) string {
+	if u == UnitsImperial {
+		return formatImperial(float64(d)*metersToFeet, 0, "ft")
+	}
+	return d.String()
+}
+
+func (u UnitSystem) formatPressure(p subsurface.Pressure) string {
+	if u == UnitsImperial {
+		// a decimal is kept for low pressures, e.g. the surface pressure
+		psi := float64(p) * barToPSI
+		if psi < 100 {
+			return formatImperial(psi, 1, "psi")
+		}
+		return formatImperial(psi, 0, "psi")
+	}
+	return p.String()
+}
+
+func (u UnitSystem) formatWeight(w subsurface.Weight) string {
+	if u == UnitsImperial {
+		return formatImperial(float64(w)*kgToPounds, 1, "lb")
+	}
+	return w.String()
+}
+
+func (u UnitSystem) formatVolume(v subsurface.Volume, wp subsurface.Pressure) string {
+	if u == UnitsImperial {
+		_, cuft := u.volumes(v, wp)
+		return formatImperial(cuft, 1, "cu ft")
+	}
+	return v.String()
+}
+
+func (u UnitSystem) formatTemperature(t subsurface.Temperature) string {
+	if u == UnitsImperial && t != 0 {
+		return fmt.Sprintf("%.1f °F", t.Celsius()*9/5+32)
+	}
+	return t.String()
+}
+
+// formatImperial formats a converted value with a fixed number of decimals, as
+// conversions leave more of them than were measured.
+func formatImperial(v float64, decimals int, unit string) string {
+	if v == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(v, 'f', decimals, 64) + " " + unit
+}
+
+func thousandths(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"src.acicovic.me/divelog/subsurface"
+)
+
+// The source of the log is watched by polling, and the log is rebuilt when the
+// source changes. A change is picked up once the file has stayed the same for
+// a whole poll interval, so that a file that is still being written is left
+// alone. Its content must also stay the same while the log is rebuilt, and the
+// rebuilt log must be valid, or the served log is kept (see rebuild). A source
+// that fails to build is not tried again until it changes, except for one that
+// loses dives: it is rebuilt again at the next poll, and the loss is accepted if
+// the source is still the same then.
+//
+// Git storage is a directory, and is polled by its version instead (see
+// subsurface.GitStorageVersion), which is cheap enough to be read at every poll.
+
+// _watchInterval is the poll interval of the source; zero disables the watch.
+var _watchInterval time.Duration
+
+// sourceState tells versions of the source apart. The modification time and
+// the size of a file are cheap to poll; its hash is computed only when they
+// change. The version of git storage is polled in their place.
+type sourceState struct {
+	modTime time.Time
+	size    int64
+	version string
+	hash    [sha256.Size]byte
+}
+
+type sourceWatcher struct {
+	path     string
+	interval time.Duration
+
+	// the version of the source the log was last built from, or tried to be
+	last sourceState
+	// a changed version waiting to stay the same for an interval
+	pending *sourceState
+	// the hash of a version whose log lost dives, waiting to be confirmed
+	lossy *[sha256.Size]byte
+}
+
+// newSourceWatcher returns a watcher of the source in its current state, or
+// nil if the source cannot be watched.
+func newSourceWatcher(path string, interval time.Duration) *sourceWatcher {
+	if interval <= 0 {
+		return nil
+	}
+	state, err := readSourceState(path, true)
+	if err != nil {
+		trace(_error, "watch: %v", err)
+		return nil
+	}
+	return &sourceWatcher{path: path, interval: interval, last: state}
+}
+
+// run polls the source until the process exits.
+func (sw *sourceWatcher) run() {
+	trace(_watch, "polling %s every %v", sw.path, sw.interval)
+	ticker := time.NewTicker(sw.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		sw.poll()
+	}
+}
+
+func (sw *sourceWatcher) poll() {
+	state, err := readSourceState(sw.path, false)
+	if err != nil {
+		// the file may be missing for a moment while it is replaced
+		sw.pending = nil
+		return
+	}
+
+	switch {
+	case state.sameFile(sw.last):
+		sw.pending = nil
+		return
+	case sw.pending == nil || !state.sameFile(*sw.pending):
+		if sw.pending == nil {
+			trace(_watch, "%s changed, waiting for it to settle", sw.path)
+		}
+		sw.pending = &state
+		return
+	}
+
+	sw.pending = nil
+	if state, err = readSourceState(sw.path, true); err != nil {
+		trace(_error, "watch: %v", err)
+		return
+	}
+	if state.hash == sw.last.hash {
+		trace(_watch, "%s was touched, but its content is the same", sw.path)
+		sw.last = state
+		return
+	}
+
+	confirmed := sw.lossy != nil && *sw.lossy == state.hash
+	sw.lossy = nil
+	if confirmed {
+		trace(_watch, "%s still loses dives, rebuilding", sw.path)
+	} else {
+		trace(_watch, "%s settled, rebuilding", sw.path)
+	}
+	previous := sw.last
+	sw.last = state
+	report := rebuild(func() error {
+		after, err := readSourceState(sw.path, true)
+		if err != nil {
+			return err
+		}
+		if after.hash != state.hash {
+			return errors.New("the source changed while the log was rebuilt")
+		}
+		return nil
+	}, confirmed)
+	switch {
+	case report.DivesLost > 0:
+		// read it again at the next poll, as if it had just settled
+		trace(_watch, "%s loses %d dives, reading it again to confirm", sw.path, report.DivesLost)
+		sw.lossy = &state.hash
+		sw.last, sw.pending = previous, &state
+	case !report.Rebuilt:
+		trace(_watch, "%s will be read again when it changes", sw.path)
+	}
+}
+
+// sameFile reports whether the states are of the same version of the source,
+// as far as its modification time and size, or its version, tell.
+func (s sourceState) sameFile(other sourceState) bool {
+	return s.modTime.Equal(other.modTime) && s.size == other.size && s.version == other.version
+}
+
+// readSourceState returns the state of the source, with its hash if wanted.
+// The hash of git storage is that of its version, which is always read.
+func readSourceState(path string, withHash bool) (sourceState, error) {
+	if subsurface.IsGitStorage(path) {
+		version, err := subsurface.GitStorageVersion(path)
+		if err != nil {
+			return sourceState{}, err
+		}
+		return sourceState{version: version, hash: sha256.Sum256([]byte(version))}, nil
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return sourceState{}, err
+	}
+	state := sourceState{modTime: fi.ModTime(), size: fi.Size()}
+	if !withHash {
+		return state, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return sourceState{}, err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, file); err != nil {
+		return sourceState{}, err
+	}
+	h.Sum(state.hash[:0])
+	return state, nil
+}
@@ -0,0 +1,65 @@
+//go:build linux || darwin
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// A source that changes while the log is rebuilt does not replace the log,
+// and is rebuilt once it settles again. The rebuild is held up by a FIT file
+// that is a named pipe: the build blocks on opening it until the test has
+// changed the source.
+func TestSourceWatcherChangeDuringRebuild(t *testing.T) {
+	full := fixtureSource(t, false)
+	path := serveSource(t, full)
+	clock := &sourceClock{t: t, path: path, now: time.Now().Add(-time.Hour)}
+	clock.touch()
+	sw := newSourceWatcher(path, time.Second)
+
+	fitDir := t.TempDir()
+	pipe := filepath.Join(fitDir, "dive.fit")
+	if err := syscall.Mkfifo(pipe, 0o600); err != nil {
+		t.Skipf("named pipes are not supported: %v", err)
+	}
+	_metadata.FITDirectory = fitDir
+
+	clock.write(addDive(full))
+	sw.poll()
+	served := _bluefin.Load()
+	done := make(chan struct{})
+	go func() {
+		sw.poll()
+		close(done)
+	}()
+
+	// opening the pipe for writing waits for the build to open it for reading
+	writer, err := os.OpenFile(pipe, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.write(addDive(addDive(full)))
+	// an empty FIT file is not a dive activity, and is skipped
+	writer.Close()
+	<-done
+
+	if _bluefin.Load() != served {
+		t.Fatalf("a source that changed during the rebuild replaced the log with %d dives", _bluefin.Load().LargestDiveID())
+	}
+
+	// the next change is waited for, and the pipe opened again, as before
+	go func() {
+		if writer, err := os.OpenFile(pipe, os.O_WRONLY, 0); err == nil {
+			writer.Close()
+		}
+	}()
+	sw.poll()
+	sw.poll()
+	if n := _bluefin.Load().LargestDiveID(); n != 5 {
+		t.Errorf("%d dives served after the source settled, want 5", n)
+	}
+}
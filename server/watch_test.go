@@ -0,0 +1,168 @@
+package server
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// watchStep changes the source, or not, and polls it once.
+type watchStep struct {
+	source   string // written before the poll; empty for no change
+	touch    bool   // only the modification time is changed
+	remove   bool
+	replaced bool // the poll swaps in a rebuilt log
+	dives    int  // served after the poll
+}
+
+// sourceClock sets the modification times of the source, one minute apart, so
+// that every change is seen whatever the resolution of the file system.
+type sourceClock struct {
+	t    *testing.T
+	path string
+	now  time.Time
+}
+
+func (c *sourceClock) write(source string) {
+	c.t.Helper()
+	writeSource(c.t, c.path, source)
+	c.touch()
+}
+
+func (c *sourceClock) touch() {
+	c.t.Helper()
+	c.now = c.now.Add(time.Minute)
+	if err := os.Chtimes(c.path, c.now, c.now); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func TestSourceWatcherPoll(t *testing.T) {
+	var (
+		full = fixtureSource(t, false)
+		more = addDive(full)
+		lost = fixtureSource(t, true)
+	)
+	for _, tc := range []struct {
+		name  string
+		steps []watchStep
+	}{
+		{
+			name: "settled",
+			steps: []watchStep{
+				{source: more, dives: 3},
+				{replaced: true, dives: 4},
+				{dives: 4},
+			},
+		},
+		{
+			name: "still being written",
+			steps: []watchStep{
+				{source: more[:1000], dives: 3},
+				{source: more[:2000], dives: 3},
+				{source: more, dives: 3},
+				{replaced: true, dives: 4},
+			},
+		},
+		{
+			name: "half-written file settles",
+			steps: []watchStep{
+				{source: more[:1000], dives: 3},
+				{dives: 3}, // the rebuild fails
+				{dives: 3}, // and is not tried again
+				{source: more, dives: 3},
+				{replaced: true, dives: 4},
+			},
+		},
+		{
+			name: "touched",
+			steps: []watchStep{
+				{touch: true, dives: 3},
+				{dives: 3},
+				{dives: 3},
+			},
+		},
+		{
+			name: "replaced",
+			steps: []watchStep{
+				{remove: true, dives: 3},
+				{dives: 3},
+				{source: more, dives: 3},
+				{replaced: true, dives: 4},
+			},
+		},
+		{
+			name: "lost dive confirmed",
+			steps: []watchStep{
+				{source: lost, dives: 3},
+				{dives: 3}, // the loss is not accepted yet
+				{replaced: true, dives: 2},
+				{dives: 2},
+			},
+		},
+		{
+			name: "truncated file completed",
+			steps: []watchStep{
+				{source: lost, dives: 3},
+				{dives: 3},
+				{source: more, dives: 3},
+				{replaced: true, dives: 4},
+			},
+		},
+		{
+			name: "truncated file restored",
+			steps: []watchStep{
+				{source: lost, dives: 3},
+				{dives: 3},
+				{source: full, dives: 3},
+				{dives: 3}, // the content is the same as the served one
+				{dives: 3},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := serveSource(t, full)
+			clock := &sourceClock{t: t, path: path, now: time.Now().Add(-time.Hour)}
+			clock.touch()
+			sw := newSourceWatcher(path, time.Second)
+			if sw == nil {
+				t.Fatal("the source is not watched")
+			}
+
+			for i, step := range tc.steps {
+				switch {
+				case step.source != "":
+					clock.write(step.source)
+				case step.touch:
+					clock.touch()
+				case step.remove:
+					if err := os.Remove(path); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				served := _bluefin.Load()
+				sw.poll()
+				if replaced := _bluefin.Load() != served; replaced != step.replaced {
+					t.Errorf("poll %d: the log was replaced: %v", i+1, replaced)
+				}
+				if n := _bluefin.Load().LargestDiveID(); n != step.dives {
+					t.Errorf("poll %d: %d dives served, want %d", i+1, n, step.dives)
+				}
+			}
+		})
+	}
+}
+
+func TestNewSourceWatcher(t *testing.T) {
+	path := serveSource(t, fixtureSource(t, false))
+	if sw := newSourceWatcher(path, 0); sw != nil {
+		t.Error("the source is watched without an interval")
+	}
+	if sw := newSourceWatcher(path+".missing", time.Second); sw != nil {
+		t.Error("a missing source is watched")
+	}
+	if sw := newSourceWatcher("../subsurface/testdata/storage.git", time.Second); sw == nil || sw.last.version == "" {
+		t.Error("git storage is not watched by its version")
+	}
+}
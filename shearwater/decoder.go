@@ -0,0 +1,268 @@
+package shearwater
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"src.acicovic.me/divelog/subsurface"
+)
+
+// Program is reported in the header, with the version of the export format.
+const Program = "Shearwater XML"
+
+const (
+	siteUUID    = "shearwater"
+	unknownSite = "Unknown site"
+
+	// geo taxonomy category of the location, as Subsurface numbers them
+	geoLocalName = 5
+
+	feetToMeters = 0.3048
+	psiToBar     = 0.0689475729
+)
+
+var dateTimeLayouts = []string{
+	"2006-01-02 15:04:05",
+	"1/2/2006 3:04:05 PM",
+	"2006-01-02T15:04:05",
+	time.RFC3339,
+}
+
+// Detect reports whether the buffered input is a Shearwater XML export. A
+// <dive> root is too common to tell it apart, so the <diveLog> of the dive
+// must also name the computer (its model or serial number) before its
+// records. The input is not consumed.
+func Detect(br *bufio.Reader) bool {
+	head, _ := br.Peek(br.Size())
+	d := xml.NewDecoder(bytes.NewReader(head))
+	var path []string
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return false
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			path = append(path, tok.Name.Local)
+			switch {
+			case len(path) == 1 && path[0] != "dive":
+				return false
+			case len(path) == 2 && path[1] != "diveLog":
+				// the dive log is the only element of the export
+				return false
+			case len(path) == 3 && (path[2] == "computerModel" || path[2] == "computerSerial"):
+				return true
+			case len(path) == 3 && path[2] == "diveLogRecords":
+				return false
+			}
+		case xml.EndElement:
+			path = path[:len(path)-1]
+			if len(path) < 2 {
+				return false
+			}
+		}
+	}
+}
+
+// Decode decodes a Shearwater XML export and reports its contents to the
+// handler, in the same way subsurface.DecodeSubsurfaceDatabase does for
+// Subsurface databases.
+func Decode(r io.Reader, h subsurface.Handler) error {
+	if r == nil {
+		return subsurface.ErrNilReader
+	}
+	if h == nil {
+		return subsurface.ErrNilHandler
+	}
+
+	records, err := ReadRecords(r)
+	if err != nil {
+		return err
+	}
+	return subsurface.ReportRecordSlice(records, h)
+}
+
+// ReadRecords decodes a Shearwater XML export of a dive into the records that
+// subsurface.Reader produces for Subsurface databases: a header, a dive site
+// and the dive. Cylinders are made of the gas mixes breathed during the dive.
+// Invalid values are reported as a subsurface.DecodeError.
+func ReadRecords(r io.Reader) ([]subsurface.Record, error) {
+	var doc DiveXML
+	if err := subsurface.DecodeDocument(r, "dive", &doc); err != nil {
+		return nil, err
+	}
+
+	log := &doc.DiveLog
+	c := &converter{imperial: strings.EqualFold(strings.TrimSpace(log.ImperialUnits), "true")}
+	dive := c.convertDive("dive/diveLog", log)
+	if c.Err != nil {
+		return nil, c.Err
+	}
+
+	name := strings.TrimSpace(log.Site)
+	location := strings.TrimSpace(log.Location)
+	if name == "" {
+		name, location = location, ""
+	}
+	if name == "" {
+		name = unknownSite
+	}
+	records := []subsurface.Record{
+		&subsurface.HeaderRecord{Program: Program, Version: doc.Version},
+		&subsurface.SiteRecord{Index: 1, UUID: siteUUID, Name: name},
+	}
+	if location != "" {
+		records = append(records, &subsurface.GeoRecord{SiteIndex: 1, SiteUUID: siteUUID, Cat: geoLocalName, Label: location})
+	}
+	return append(records, dive), nil
+}
+
+type converter struct {
+	imperial bool
+	subsurface.ValueParser
+}
+
+type mix struct {
+	o2, he subsurface.Fraction
+}
+
+func (c *converter) convertDive(path string, log *DiveLogXML) *subsurface.DiveRecord {
+	ddh := subsurface.DiveDataHolder{
+		DiveTripID:           subsurface.IntNull,
+		DiveSiteUUID:         siteUUID,
+		Buddy:                strings.TrimSpace(log.Buddy),
+		Notes:                strings.TrimSpace(log.Notes),
+		DiveComputerModel:    strings.TrimSpace(log.ComputerModel),
+		DiveComputerDeviceID: strings.TrimSpace(log.ComputerSerial),
+	}
+
+	if log.Number != "" {
+		ddh.DiveNumber = int(c.Number(path+"/number", log.Number))
+	}
+	if log.StartDate != "" {
+		ddh.DateTime = c.DateTime(path+"/startDate", log.StartDate, dateTimeLayouts)
+	}
+	if log.EndDate != "" && !ddh.DateTime.IsZero() {
+		ddh.Duration = c.DateTime(path+"/endDate", log.EndDate, dateTimeLayouts).Sub(ddh.DateTime)
+	}
+	ddh.DepthMax = c.depth(path+"/maxDepth", log.MaxDepth)
+	ddh.SurfacePressure = subsurface.Pressure(c.Number(path+"/surfacePressure", log.SurfacePressure) / 1000)
+
+	var (
+		mixes     = make(map[mix]int) // cylinder index
+		timeScale = c.timeScale(path, log, ddh.Duration)
+	)
+	for i, rec := range log.Records {
+		recPath := fmt.Sprintf("%s/diveLogRecords/diveLogRecord[%d]", path, i+1)
+		sample := subsurface.Sample{
+			Time:        time.Duration(c.Number(recPath+"/currentTime", rec.CurrentTime) * timeScale).Round(time.Second),
+			Depth:       c.depth(recPath+"/currentDepth", rec.CurrentDepth),
+			Temperature: c.temperature(recPath+"/waterTemp", rec.WaterTemp),
+			TTS:         minutes(c.Number(recPath+"/ttsMins", rec.TTSMins)),
+			PO2:         subsurface.Pressure(c.Number(recPath+"/averagePPO2", rec.AveragePPO2)),
+			Pressure:    subsurface.Pressure(thousandths(c.Number(recPath+"/tank0pressurePSI", rec.Tank0Pressure) * psiToBar)),
+		}
+		if stop := c.depth(recPath+"/firstStopDepth", rec.FirstStopDepth); stop > 0 {
+			sample.Ceiling = stop
+			sample.InDeco = true
+		} else {
+			sample.NDL = minutes(c.Number(recPath+"/firstStopTime", rec.FirstStopTime))
+		}
+		ddh.Samples = append(ddh.Samples, sample)
+
+		m := mix{
+			o2: subsurface.Fraction(100 * c.Number(recPath+"/fractionO2", rec.FractionO2)),
+			he: subsurface.Fraction(100 * c.Number(recPath+"/fractionHe", rec.FractionHe)),
+		}
+		if _, ok := mixes[m]; !ok && m.o2 > 0 {
+			mixes[m] = len(ddh.Cylinders)
+			ddh.Cylinders = append(ddh.Cylinders, subsurface.CylinderDataHolder{O2: m.o2, He: m.he})
+		}
+		if sample.Pressure > 0 && len(ddh.Cylinders) > 0 {
+			// the transmitter is on the first cylinder
+			cyl := &ddh.Cylinders[0]
+			if cyl.StartPressure == 0 {
+				cyl.StartPressure = sample.Pressure
+			}
+			cyl.EndPressure = sample.Pressure
+		}
+	}
+
+	for _, sample := range ddh.Samples {
+		if sample.Depth > ddh.DepthMax {
+			ddh.DepthMax = sample.Depth
+		}
+		if sample.Temperature != 0 && (ddh.TemperatureWaterMin == 0 || sample.Temperature < ddh.TemperatureWaterMin) {
+			ddh.TemperatureWaterMin = sample.Temperature
+		}
+	}
+	if ddh.Duration <= 0 && len(ddh.Samples) > 0 {
+		ddh.Duration = ddh.Samples[len(ddh.Samples)-1].Time
+	}
+	ddh.DepthMean = subsurface.MeanDepth(ddh.Samples)
+
+	if len(ddh.Samples) > 0 || ddh.DepthMax != 0 {
+		ddh.DiveComputers = []subsurface.DiveComputerDataHolder{{
+			Primary:             true,
+			Model:               ddh.DiveComputerModel,
+			DeviceID:            ddh.DiveComputerDeviceID,
+			DepthMax:            ddh.DepthMax,
+			DepthMean:           ddh.DepthMean,
+			TemperatureWaterMin: ddh.TemperatureWaterMin,
+			SurfacePressure:     ddh.SurfacePressure,
+			Samples:             ddh.Samples,
+		}}
+	}
+
+	return &subsurface.DiveRecord{DiveDataHolder: ddh}
+}
+
+// timeScale returns the unit of currentTime. Exports do not agree on it: it is
+// read as milliseconds when, in seconds, the records would last more than ten
+// times as long as the dive.
+func (c *converter) timeScale(path string, log *DiveLogXML, duration time.Duration) float64 {
+	if len(log.Records) == 0 || duration <= 0 {
+		return float64(time.Second)
+	}
+	last := len(log.Records)
+	span := c.Number(fmt.Sprintf("%s/diveLogRecords/diveLogRecord[%d]/currentTime", path, last), log.Records[last-1].CurrentTime)
+	if span > 10*duration.Seconds() {
+		return float64(time.Millisecond)
+	}
+	return float64(time.Second)
+}
+
+func (c *converter) depth(path string, s string) subsurface.Depth {
+	v := c.Number(path, s)
+	if c.imperial {
+		v *= feetToMeters
+	}
+	return subsurface.Depth(thousandths(v))
+}
+
+func (c *converter) temperature(path string, s string) subsurface.Temperature {
+	if strings.TrimSpace(s) == "" {
+		return 0
+	}
+	v := c.Number(path, s)
+	if c.imperial {
+		v = (v - 32) * 5 / 9
+	}
+	return subsurface.Temperature(thousandths(v + 273.15))
+}
+
+// thousandths rounds a converted value to the resolution Subsurface stores,
+// e.g. millimeters and millibar.
+func thousandths(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+func minutes(v float64) time.Duration {
+	return time.Duration(v * float64(time.Minute)).Round(time.Second)
+}
@@ -0,0 +1,45 @@
+package shearwater
+
+import (
+	"encoding/xml"
+)
+
+// Depths and temperatures are in meters and degrees Celsius, or in feet and
+// degrees Fahrenheit when imperialUnits is set; tank pressures are always in
+// PSI.
+
+type DiveXML struct {
+	XMLName xml.Name   `xml:"dive"`
+	Version string     `xml:"version,attr"`
+	DiveLog DiveLogXML `xml:"diveLog"`
+}
+
+type DiveLogXML struct {
+	Number          string      `xml:"number"`
+	StartDate       string      `xml:"startDate"`
+	EndDate         string      `xml:"endDate"`
+	MaxDepth        string      `xml:"maxDepth"`
+	ImperialUnits   string      `xml:"imperialUnits"`
+	SurfacePressure string      `xml:"surfacePressure"` // millibar
+	ComputerModel   string      `xml:"computerModel"`
+	ComputerSerial  string      `xml:"computerSerial"`
+	Firmware        string      `xml:"firmwareVersion"`
+	Site            string      `xml:"site"`
+	Location        string      `xml:"location"`
+	Buddy           string      `xml:"buddy"`
+	Notes           string      `xml:"notes"`
+	Records         []RecordXML `xml:"diveLogRecords>diveLogRecord"`
+}
+
+type RecordXML struct {
+	CurrentTime    string `xml:"currentTime"`
+	CurrentDepth   string `xml:"currentDepth"`
+	WaterTemp      string `xml:"waterTemp"`
+	FirstStopDepth string `xml:"firstStopDepth"`
+	FirstStopTime  string `xml:"firstStopTime"` // no decompression limit while not in deco
+	TTSMins        string `xml:"ttsMins"`
+	AveragePPO2    string `xml:"averagePPO2"`
+	FractionO2     string `xml:"fractionO2"`
+	FractionHe     string `xml:"fractionHe"`
+	Tank0Pressure  string `xml:"tank0pressurePSI"`
+}
@@ -0,0 +1,82 @@
+package subsurface
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MaxDecompressedSize is the largest decompressed database that Decompress
+// lets through. Even logs with many years of dive computer samples are well
+// below it.
+const MaxDecompressedSize = 256 << 20
+
+var (
+	ErrUnsupportedCompression = errors.New("compression format is not supported")
+	ErrDecompressedTooLarge   = errors.New("decompressed database is too large")
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// Decompress recognizes a compressed database by its magic bytes and returns
+// a reader over the decompressed contents, which fails with
+// ErrDecompressedTooLarge after more than limit bytes. Gzip (.xml.gz and .ssrf
+// files) is supported; zstd and xz are recognized, but reported as
+// ErrUnsupportedCompression. Uncompressed input is returned as is.
+func Decompress(r io.Reader, limit int64) (io.Reader, error) {
+	if r == nil {
+		return nil, ErrNilReader
+	}
+
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(xzMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+		return &limitedReader{r: zr, remaining: limit}, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		return nil, fmt.Errorf("%w: zstd", ErrUnsupportedCompression)
+	case bytes.HasPrefix(magic, xzMagic):
+		return nil, fmt.Errorf("%w: xz", ErrUnsupportedCompression)
+	default:
+		return br, nil
+	}
+}
+
+// limitedReader is like io.LimitedReader, but fails instead of ending the input
+// early, so a truncated database is never mistaken for a complete one.
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// the limit is only exceeded if there is more to read
+		var probe [1]byte
+		if n, err := l.r.Read(probe[:]); n == 0 {
+			return 0, err
+		}
+		return 0, ErrDecompressedTooLarge
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
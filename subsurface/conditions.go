@@ -0,0 +1,90 @@
+package subsurface
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DiveMode is the breathing apparatus of a dive, as Subsurface names it.
+type DiveMode string
+
+const (
+	DiveModeOC       DiveMode = "OC"
+	DiveModeCCR      DiveMode = "CCR"
+	DiveModePSCR     DiveMode = "PSCR"
+	DiveModeFreedive DiveMode = "Freedive"
+)
+
+// Conditions ratings, like dive ratings, are from 1 to 5 stars; 0 means the
+// conditions were not rated.
+const (
+	ConditionsUnrated = 0
+	ConditionsMax     = 5
+)
+
+// ExtraData is a key/value pair a dive computer reports in addition to the
+// values Subsurface knows, e.g. its serial number or the deco model settings.
+type ExtraData struct {
+	Key   string
+	Value string
+}
+
+// ParseDiveMode parses a dive mode, ignoring case. An empty string is open
+// circuit, the mode Subsurface does not write.
+func ParseDiveMode(s string) (DiveMode, error) {
+	trimmed := strings.TrimSpace(s)
+	if trimmed == "" {
+		return DiveModeOC, nil
+	}
+	for _, mode := range []DiveMode{DiveModeOC, DiveModeCCR, DiveModePSCR, DiveModeFreedive} {
+		if strings.EqualFold(trimmed, string(mode)) {
+			return mode, nil
+		}
+	}
+	return DiveModeOC, fmt.Errorf("%w: dive mode %q", ErrInvalidValue, s)
+}
+
+// ParseConditions parses a conditions rating from 0 to ConditionsMax.
+func ParseConditions(s string) (int, error) {
+	v, err := parseOptionalInt(s)
+	if err != nil {
+		return 0, err
+	}
+	if v < ConditionsUnrated || v > ConditionsMax {
+		return 0, fmt.Errorf("%w: rating %q", ErrInvalidValue, s)
+	}
+	return v, nil
+}
+
+// ParseCNS parses the maximum CNS oxygen toxicity of a dive in percent,
+// e.g. "12%".
+func ParseCNS(s string) (int, error) {
+	trimmed := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), "%"))
+	if trimmed == "" {
+		return 0, nil
+	}
+	v, err := strconv.Atoi(trimmed)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("%w: CNS %q", ErrInvalidValue, s)
+	}
+	return v, nil
+}
+
+// parseFlag parses a flag Subsurface writes as "1" when it is set.
+func parseFlag(s string) (bool, error) {
+	v, err := parseOptionalInt(s)
+	return v != 0, err
+}
+
+// DecodeExtraData converts the extradata elements of a dive computer. Pairs
+// without a key are dropped.
+func DecodeExtraData(extraDataXML []ExtraDataXML) []ExtraData {
+	var extraData []ExtraData
+	for _, edXML := range extraDataXML {
+		if key := strings.TrimSpace(edXML.Key); key != "" {
+			extraData = append(extraData, ExtraData{Key: key, Value: edXML.Value})
+		}
+	}
+	return extraData
+}
@@ -1,9 +1,13 @@
 package subsurface
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/xml"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -19,13 +23,14 @@ const (
 var (
 	ErrNilReader     = errors.New("io.Reader is nil")
 	ErrNilHandler    = errors.New("subsurface.Handler is nil")
-	ErrInvalidFormat = errors.New("XML database is not in the valid format")
+	ErrInvalidFormat = errors.New("database is not in the valid format")
 )
 
 type Handler interface {
 	HandleBegin()
 	HandleEnd()
 	HandleHeader(program string, version string)
+	HandleSettings(settings Settings)
 	HandleSkip(element string)
 	HandleDiveSite(uuid string, name string, coords string, description string) int
 	HandleGeoData(siteID int, cat int, label string)
@@ -35,41 +40,113 @@ type Handler interface {
 
 type Decoder struct {
 	XMLDecoder *xml.Decoder
+	path       []string
 }
 
 type DiveDataHolder struct {
-	DiveNumber            int
-	DiveTripID            int
-	DiveSiteUUID          string
-	Rating                int
-	Visibility            int
-	SAC                   string
-	Tags                  []string
-	WaterSalinity         string
-	DateTime              time.Time
-	Duration              string
-	DiveMasterOrOperator  string
-	Buddy                 string
-	Notes                 string
-	Suit                  string
-	CylinderSize          string
-	CylinderWorkPressure  string
-	CylinderDescription   string
-	CylinderStartPressure string
-	CylinderEndPressure   string
-	CylinderGas           string
-	Weight                string
-	WeightType            string
-	DiveComputerModel     string
-	DiveComputerDeviceID  string
-	DiveComputerDiveID    string
-	DepthMax              string
-	DepthMean             string
-	TemperatureWaterMin   string
-	TemperatureAir        string
-	SurfacePressure       string
+	DiveNumber           int
+	DiveTripID           int // IntNull for dives that are not part of a trip
+	DiveSiteUUID         string
+	Rating               int
+	Visibility           int
+	SAC                  VolumeRate
+	Tags                 []string
+	WaterSalinity        Density
+	DateTime             time.Time
+	Duration             time.Duration
+	DiveMasterOrOperator string
+	Buddy                string
+	Notes                string
+	Suit                 string
+	Cylinders            []CylinderDataHolder
+	Weight               Weight
+	WeightType           string
+	DiveComputerModel    string
+	DiveComputerDeviceID string
+	DiveComputerDiveID   string
+	DepthMax             Depth
+	DepthMean            Depth
+	TemperatureWaterMin  Temperature
+	TemperatureAir       Temperature
+	SurfacePressure      Pressure
+	Current              int // 0 to 5, 0 if not rated, as are WaveSize, Surge and Chill
+	WaveSize             int
+	Surge                int
+	Chill                int
+	Invalid              bool
+	DiveMode             DiveMode
+	OTU                  int
+	CNS                  int // percent
+	Samples              []Sample
+	Events               []Event
+	ExtraData            []ExtraData
+	DiveComputers        []DiveComputerDataHolder
+	Pictures             []Picture
 }
 
+// DiveComputerDataHolder holds the data recorded by a single dive computer.
+// Subsurface stores the primary computer first; the dive-level depth,
+// temperature, surface pressure, samples, events and extra data in
+// DiveDataHolder are its values, as is the dive mode unless the dive sets it.
+type DiveComputerDataHolder struct {
+	Primary             bool
+	Model               string
+	DeviceID            string
+	DiveID              string
+	DiveMode            DiveMode
+	DepthMax            Depth
+	DepthMean           Depth
+	TemperatureWaterMin Temperature
+	SurfacePressure     Pressure
+	Samples             []Sample
+	Events              []Event
+	ExtraData           []ExtraData
+}
+
+type CylinderDataHolder struct {
+	Size          Volume
+	WorkPressure  Pressure
+	Description   string
+	StartPressure Pressure
+	EndPressure   Pressure
+	O2            Fraction
+	He            Fraction
+	Use           string
+}
+
+// Settings holds the <settings> of a database: the dive computers the user has
+// downloaded dives from, the fingerprints of the last dive downloaded from each
+// of them, and whether dives are grouped into trips automatically.
+type Settings struct {
+	DiveComputers []DiveComputerID
+	Fingerprints  []Fingerprint
+	AutoGroup     bool
+}
+
+// DiveComputerID identifies a physical dive computer. DeviceID matches the
+// DeviceID of the dive computers of dives, and Nickname is the name given to
+// the computer by the user, e.g. "Perdix (backup)".
+type DiveComputerID struct {
+	Model    string
+	DeviceID string
+	Serial   string
+	Firmware string
+	Nickname string
+}
+
+// Fingerprint marks the last dive downloaded from a dive computer. Model,
+// Serial, DeviceID and DiveID are hexadecimal hashes, and Data is the
+// hex-encoded fingerprint reported by the computer.
+type Fingerprint struct {
+	Model    string
+	Serial   string
+	DeviceID string
+	DiveID   string
+	Data     string
+}
+
+// DecodeSubsurfaceDatabase decodes the database and reports its contents to the handler.
+// It is a wrapper over Reader which maps record indices to the IDs returned by the handler.
 func DecodeSubsurfaceDatabase(r io.Reader, h Handler) error {
 	if r == nil {
 		return ErrNilReader
@@ -78,137 +155,192 @@ func DecodeSubsurfaceDatabase(r io.Reader, h Handler) error {
 		return ErrNilHandler
 	}
 
+	return ReportRecords(NewReader(r).Next, h)
+}
+
+// ReportRecords reports records to the handler until next returns io.EOF,
+// mapping record indices to the IDs returned by the handler. Decoders of other
+// formats use it to report their contents in the same way.
+func ReportRecords(next func() (Record, error), h Handler) error {
 	var (
-		decoder = &Decoder{
-			XMLDecoder: xml.NewDecoder(r),
-		}
-		startTag *xml.StartElement
-		err      error
+		siteIDs = make(map[int]int)
+		tripIDs = map[int]int{IntNull: IntNull}
 	)
 
-	// <divelog ...>
-	if startTag, err = decoder.ExpectStart("divelog"); err != nil {
-		return err
+	for {
+		record, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch rec := record.(type) {
+		case *HeaderRecord:
+			h.HandleBegin()
+			h.HandleHeader(rec.Program, rec.Version)
+		case *SettingsRecord:
+			h.HandleSettings(rec.Settings)
+		case *SkipRecord:
+			h.HandleSkip(rec.Element)
+		case *SiteRecord:
+			siteIDs[rec.Index] = h.HandleDiveSite(rec.UUID, rec.Name, rec.Coords, rec.Description)
+		case *GeoRecord:
+			h.HandleGeoData(siteIDs[rec.SiteIndex], rec.Cat, rec.Label)
+		case *TripRecord:
+			tripIDs[rec.Index] = h.HandleDiveTrip(rec.Label)
+		case *DiveRecord:
+			ddh := rec.DiveDataHolder
+			ddh.DiveTripID = tripIDs[ddh.DiveTripID]
+			h.HandleDive(ddh)
+		}
 	}
-	h.HandleBegin()
 
-	program, _ := FindAttribute(startTag, "program")
-	version, _ := FindAttribute(startTag, "version")
-	h.HandleHeader(program, version)
+	h.HandleEnd()
 
-	// <settings>
-	if err = decoder.SkipElement("settings"); err != nil {
-		return err
+	return nil
+}
+
+// ReportRecordSlice reports records that were decoded in advance, as
+// ReportRecords does.
+func ReportRecordSlice(records []Record, h Handler) error {
+	return ReportRecords(func() (Record, error) {
+		if len(records) == 0 {
+			return nil, io.EOF
+		}
+		record := records[0]
+		records = records[1:]
+		return record, nil
+	}, h)
+}
+
+// DecodeDocument decodes a whole XML document of another format into v. An
+// error is reported as a DecodeError at the root element, with the position in
+// the input where decoding stopped.
+func DecodeDocument(r io.Reader, root string, v any) error {
+	decoder := xml.NewDecoder(r)
+	if err := decoder.Decode(v); err != nil {
+		line, column := decoder.InputPos()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return &DecodeError{
+			Path:   root,
+			Line:   line,
+			Column: column,
+			Offset: decoder.InputOffset(),
+			Err:    err,
+		}
 	}
-	h.HandleSkip("settings")
-	// </settings>
+	return nil
+}
 
-	// <divesites>
-	if _, err = decoder.ExpectStart("divesites"); err != nil {
-		// DEVNOTE: the database may contain no dive site entries, but this
-		// decoder will report it as a format error
-		return err
+// ValueParser converts the values of documents of other formats. Decoders keep
+// values as strings in their XML structs and convert them with a ValueParser,
+// so that an invalid value can be reported with its path. The first invalid
+// value is kept as Err, after which values convert to zero.
+type ValueParser struct {
+	Err error
+}
+
+// Number parses a decimal value. An empty string yields zero.
+func (p *ValueParser) Number(path string, s string) float64 {
+	trimmed := strings.TrimSpace(s)
+	if trimmed == "" || p.Err != nil {
+		return 0
+	}
+	v, err := strconv.ParseFloat(trimmed, 64)
+	if err != nil {
+		p.Err = &DecodeError{Path: path, Err: fmt.Errorf("%w: %q", ErrInvalidValue, s)}
+		return 0
 	}
+	return v
+}
 
-	for {
-		if startTag, err = decoder.NextOrEnd("site", "divesites"); err != nil {
-			return err
-		}
-		if startTag != nil {
-			// <site ...> 1..N
-			if siteXML, err := DecodeSiteXML(decoder, startTag); err != nil {
-				return err
-			} else {
-				// DEVNOTE: this could have been parsed the same way the dive data was parsed
-				// it was left like this to demonstrate how powerful Go's XML parser can be
-				siteID := h.HandleDiveSite(siteXML.UUID, siteXML.Name, siteXML.GPS, siteXML.Description)
-				for _, geoData := range siteXML.Geos {
-					if cat, err := strconv.Atoi(geoData.Cat); err != nil {
-						return ErrInvalidFormat
-					} else {
-						h.HandleGeoData(siteID, cat, geoData.Value)
-					}
-				}
-			}
-			// </site>
-		} else {
-			// </divesites>
-			break
+// DateTime parses a date and time in the first of the layouts that fits. It
+// is read as UTC when it has no time zone, like Subsurface dates.
+func (p *ValueParser) DateTime(path string, s string, layouts []string) time.Time {
+	trimmed := strings.TrimSpace(s)
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, trimmed); err == nil {
+			return t
 		}
 	}
+	if p.Err == nil {
+		p.Err = &DecodeError{Path: path, Err: fmt.Errorf("%w: date %q", ErrInvalidValue, s)}
+	}
+	return time.Time{}
+}
 
-	// <dives>
-	if _, err = decoder.ExpectStart("dives"); err != nil {
-		// DEVNOTE: the database may contain no dive entries, or only dive entries,
-		// or combined trip and dive entries, but this decoder will report it as a format error
-		return err
+// Seconds converts a number of seconds to a duration, to the whole second.
+func Seconds(v float64) time.Duration {
+	return time.Duration(v * float64(time.Second)).Round(time.Second)
+}
+
+// PascalToBar converts a pressure in pascal, the SI unit other formats use.
+func PascalToBar(v float64) Pressure {
+	return Pressure(v / 1e5)
+}
+
+// MeanDepth is the time-weighted mean depth of the samples, for formats that
+// do not record it.
+func MeanDepth(samples []Sample) Depth {
+	if len(samples) < 2 {
+		return 0
+	}
+	var area float64
+	for i := 1; i < len(samples); i++ {
+		dt := (samples[i].Time - samples[i-1].Time).Seconds()
+		area += dt * float64(samples[i].Depth+samples[i-1].Depth) / 2
 	}
+	total := (samples[len(samples)-1].Time - samples[0].Time).Seconds()
+	if total <= 0 {
+		return 0
+	}
+	// to the millimeter, as Subsurface stores depths
+	return Depth(math.Round(area/total*1000) / 1000)
+}
 
+// RootElement returns the name of the root element of the XML document in the
+// buffer, or an empty string if there is none. It is used to tell formats apart
+// by content. The input is not consumed.
+func RootElement(br *bufio.Reader) string {
+	head, _ := br.Peek(br.Size())
+	d := xml.NewDecoder(bytes.NewReader(head))
 	for {
-		if startTag, err = decoder.NextOrEnd("trip", "dives"); err != nil {
-			return err
+		tok, err := d.Token()
+		if err != nil {
+			return ""
 		}
-		if startTag != nil {
-			// <trip ...> 1..N
-			location, _ := FindAttribute(startTag, "location")
-			tripID := h.HandleDiveTrip(location)
-			for {
-				if startTag, err = decoder.NextOrEnd("dive", "trip"); err != nil {
-					return err
-				}
-				if startTag != nil {
-					// <dive ...> 1..N
-					if diveXML, err := DecodeDiveXML(decoder, startTag); err != nil {
-						return err
-					} else {
-						if err := FlattenAndReport(diveXML, tripID, h); err != nil {
-							return err
-						}
-					}
-				} else {
-					// </trip>
-					break
-				}
-			}
-		} else {
-			// </dives>
-			break
+		if start, ok := tok.(xml.StartElement); ok {
+			return start.Name.Local
 		}
 	}
+}
 
-	h.HandleEnd()
-	// </divelog>
-
+// FlattenAndReport reports a decoded dive to the handler. Invalid values are
+// reported as a DecodeError with a path relative to the <dive> element.
+func FlattenAndReport(diveXML *DiveXML, tripID int, h Handler) error {
+	ddh, err := Flatten(diveXML, tripID)
+	if err != nil {
+		return err
+	}
+	h.HandleDive(ddh)
 	return nil
 }
 
-func FlattenAndReport(diveXML *DiveXML, tripID int, h Handler) error {
+// Flatten converts a decoded dive into a DiveDataHolder. Invalid values are
+// reported as a DecodeError with a path relative to the <dive> element.
+func Flatten(diveXML *DiveXML, tripID int) (DiveDataHolder, error) {
 	var (
 		ddh = DiveDataHolder{
-			DiveTripID:            tripID,
-			DiveSiteUUID:          diveXML.DiveSiteUUID,
-			SAC:                   diveXML.SAC,
-			WaterSalinity:         diveXML.WaterSalinity,
-			Duration:              diveXML.Duration,
-			DiveMasterOrOperator:  diveXML.DiveMaster,
-			Buddy:                 diveXML.Buddy,
-			Notes:                 diveXML.Notes,
-			Suit:                  diveXML.Suit,
-			CylinderSize:          diveXML.Cylinder.Size,
-			CylinderWorkPressure:  diveXML.Cylinder.WorkPressure,
-			CylinderDescription:   diveXML.Cylinder.Description,
-			CylinderStartPressure: diveXML.Cylinder.Start,
-			CylinderEndPressure:   diveXML.Cylinder.End,
-			CylinderGas:           diveXML.Cylinder.O2,
-			Weight:                diveXML.WeightSystem.Weight,
-			WeightType:            diveXML.WeightSystem.Description,
-			DiveComputerModel:     diveXML.DiveComputer.Model,
-			DiveComputerDeviceID:  diveXML.DiveComputer.DeviceID,
-			DiveComputerDiveID:    diveXML.DiveComputer.DiveID,
-			DepthMax:              diveXML.DiveComputer.DepthInfo.Max,
-			DepthMean:             diveXML.DiveComputer.DepthInfo.Mean,
-			TemperatureAir:        diveXML.TemperatureManual.Air,
-			SurfacePressure:       diveXML.DiveComputer.SurfaceInfo.Pressure,
+			DiveTripID:           tripID,
+			DiveSiteUUID:         diveXML.DiveSiteUUID,
+			DiveMasterOrOperator: diveXML.DiveMaster,
+			Buddy:                diveXML.Buddy,
+			Notes:                diveXML.Notes,
+			Suit:                 diveXML.Suit,
+			WeightType:           diveXML.WeightSystem.Description,
 		}
 		err error
 	)
@@ -216,12 +348,12 @@ func FlattenAndReport(diveXML *DiveXML, tripID int, h Handler) error {
 	if diveXML.Number == "" {
 		ddh.DiveNumber = IntNull
 	} else if ddh.DiveNumber, err = strconv.Atoi(diveXML.Number); err != nil {
-		return ErrInvalidFormat
+		return ddh, fieldError("@number", err)
 	}
 
 	if diveXML.Rating != "" {
 		if ddh.Rating, err = strconv.Atoi(diveXML.Rating); err != nil {
-			return ErrInvalidFormat
+			return ddh, fieldError("@rating", err)
 		}
 	} else {
 		ddh.Rating = IntNull
@@ -229,12 +361,83 @@ func FlattenAndReport(diveXML *DiveXML, tripID int, h Handler) error {
 
 	if diveXML.Visibility != "" {
 		if ddh.Visibility, err = strconv.Atoi(diveXML.Visibility); err != nil {
-			return ErrInvalidFormat
+			return ddh, fieldError("@visibility", err)
 		}
 	} else {
 		ddh.Visibility = IntNull
 	}
 
+	if ddh.SAC, err = ParseVolumeRate(diveXML.SAC); err != nil {
+		return ddh, fieldError("@sac", err)
+	}
+	if ddh.WaterSalinity, err = ParseDensity(diveXML.WaterSalinity); err != nil {
+		return ddh, fieldError("@watersalinity", err)
+	}
+	if ddh.Duration, err = ParseDuration(diveXML.Duration); err != nil {
+		return ddh, fieldError("@duration", err)
+	}
+	if ddh.Weight, err = ParseWeight(diveXML.WeightSystem.Weight); err != nil {
+		return ddh, fieldError("weightsystem@weight", err)
+	}
+	if ddh.TemperatureAir, err = ParseTemperature(diveXML.TemperatureManual.Air); err != nil {
+		return ddh, fieldError("divetemperature@air", err)
+	}
+	if ddh.Current, err = ParseConditions(diveXML.Current); err != nil {
+		return ddh, fieldError("@current", err)
+	}
+	if ddh.WaveSize, err = ParseConditions(diveXML.WaveSize); err != nil {
+		return ddh, fieldError("@wavesize", err)
+	}
+	if ddh.Surge, err = ParseConditions(diveXML.Surge); err != nil {
+		return ddh, fieldError("@surge", err)
+	}
+	if ddh.Chill, err = ParseConditions(diveXML.Chill); err != nil {
+		return ddh, fieldError("@chill", err)
+	}
+	if ddh.Invalid, err = parseFlag(diveXML.Invalid); err != nil {
+		return ddh, fieldError("@invalid", err)
+	}
+	if ddh.OTU, err = parseOptionalInt(diveXML.OTU); err != nil {
+		return ddh, fieldError("@otu", err)
+	}
+	if ddh.CNS, err = ParseCNS(diveXML.CNS); err != nil {
+		return ddh, fieldError("@cns", err)
+	}
+	if ddh.DiveMode, err = ParseDiveMode(diveXML.DiveMode); err != nil {
+		return ddh, fieldError("@divemode", err)
+	}
+
+	for i, cylinderXML := range diveXML.Cylinders {
+		cyl := CylinderDataHolder{
+			Description: cylinderXML.Description,
+			Use:         cylinderXML.Use,
+		}
+		path := indexedPath("cylinder", i+1)
+		if cyl.Size, err = ParseVolume(cylinderXML.Size); err != nil {
+			return ddh, fieldError(path+"@size", err)
+		}
+		if cyl.WorkPressure, err = ParsePressure(cylinderXML.WorkPressure); err != nil {
+			return ddh, fieldError(path+"@workpressure", err)
+		}
+		if cyl.StartPressure, err = ParsePressure(cylinderXML.Start); err != nil {
+			return ddh, fieldError(path+"@start", err)
+		}
+		if cyl.EndPressure, err = ParsePressure(cylinderXML.End); err != nil {
+			return ddh, fieldError(path+"@end", err)
+		}
+		if cyl.O2, err = ParseFraction(cylinderXML.O2); err != nil {
+			return ddh, fieldError(path+"@o2", err)
+		}
+		if cyl.He, err = ParseFraction(cylinderXML.He); err != nil {
+			return ddh, fieldError(path+"@he", err)
+		}
+		ddh.Cylinders = append(ddh.Cylinders, cyl)
+	}
+
+	if ddh.Pictures, err = DecodePictures(diveXML.Pictures); err != nil {
+		return ddh, err
+	}
+
 	for _, tag := range strings.Split(diveXML.Tags, ",") {
 		if trimmed := strings.TrimSpace(tag); trimmed != "" {
 			ddh.Tags = append(ddh.Tags, trimmed)
@@ -251,18 +454,107 @@ func FlattenAndReport(diveXML *DiveXML, tripID int, h Handler) error {
 			dateTimeStr = diveXML.Date + "T00:00:00Z"
 		}
 		if ddh.DateTime, err = time.Parse(time.RFC3339, dateTimeStr); err != nil {
-			return ErrInvalidFormat
+			return ddh, fieldError("@date", err)
 		}
 	}
 
-	if diveXML.DiveComputer.TemperatureInfo.WaterMin != "" {
-		ddh.TemperatureWaterMin = diveXML.DiveComputer.TemperatureInfo.WaterMin
-	} else {
-		ddh.TemperatureWaterMin = diveXML.TemperatureManual.Water
+	for i, dcXML := range diveXML.DiveComputers {
+		dc := DiveComputerDataHolder{
+			Primary:  i == 0,
+			Model:    dcXML.Model,
+			DeviceID: dcXML.DeviceID,
+			DiveID:   dcXML.DiveID,
+
+			ExtraData: DecodeExtraData(dcXML.ExtraData),
+		}
+		path := indexedPath("divecomputer", i+1)
+		if dc.DiveMode, err = ParseDiveMode(dcXML.DiveMode); err != nil {
+			return ddh, fieldError(path+"@dctype", err)
+		}
+		if dc.DepthMax, err = ParseDepth(dcXML.DepthInfo.Max); err != nil {
+			return ddh, fieldError(path+"/depth@max", err)
+		}
+		if dc.DepthMean, err = ParseDepth(dcXML.DepthInfo.Mean); err != nil {
+			return ddh, fieldError(path+"/depth@mean", err)
+		}
+		if dc.TemperatureWaterMin, err = ParseTemperature(dcXML.TemperatureInfo.WaterMin); err != nil {
+			return ddh, fieldError(path+"/temperature@water", err)
+		}
+		if dc.SurfacePressure, err = ParsePressure(dcXML.SurfaceInfo.Pressure); err != nil {
+			return ddh, fieldError(path+"/surface@pressure", err)
+		}
+		if dc.Samples, err = DecodeSamples(dcXML.Samples); err != nil {
+			return ddh, prefixPath(err, path)
+		}
+		if dc.Events, err = DecodeEvents(dcXML.Events); err != nil {
+			return ddh, prefixPath(err, path)
+		}
+		ddh.DiveComputers = append(ddh.DiveComputers, dc)
 	}
 
-	h.HandleDive(ddh)
-	return nil
+	if len(ddh.DiveComputers) > 0 {
+		primary := ddh.DiveComputers[0]
+		ddh.DiveComputerModel = primary.Model
+		ddh.DiveComputerDeviceID = primary.DeviceID
+		ddh.DiveComputerDiveID = primary.DiveID
+		ddh.DepthMax = primary.DepthMax
+		ddh.DepthMean = primary.DepthMean
+		ddh.TemperatureWaterMin = primary.TemperatureWaterMin
+		ddh.SurfacePressure = primary.SurfacePressure
+		ddh.Samples = primary.Samples
+		ddh.Events = primary.Events
+		ddh.ExtraData = primary.ExtraData
+		if strings.TrimSpace(diveXML.DiveMode) == "" {
+			ddh.DiveMode = primary.DiveMode
+		}
+	}
+
+	if ddh.TemperatureWaterMin == 0 {
+		if ddh.TemperatureWaterMin, err = ParseTemperature(diveXML.TemperatureManual.Water); err != nil {
+			return ddh, fieldError("divetemperature@water", err)
+		}
+	}
+
+	return ddh, nil
+}
+
+// FlattenSettings converts decoded settings into Settings. Invalid values are
+// reported as a DecodeError with a path relative to the <settings> element.
+func FlattenSettings(settingsXML *SettingsXML) (Settings, error) {
+	var settings Settings
+	for _, dcXML := range settingsXML.DiveComputerIDs {
+		settings.DiveComputers = append(settings.DiveComputers, DiveComputerID{
+			Model:    dcXML.Model,
+			DeviceID: dcXML.DeviceID,
+			Serial:   dcXML.Serial,
+			Firmware: dcXML.Firmware,
+			Nickname: dcXML.Nickname,
+		})
+	}
+	for _, fpXML := range settingsXML.Fingerprints {
+		settings.Fingerprints = append(settings.Fingerprints, Fingerprint{
+			Model:    fpXML.Model,
+			Serial:   fpXML.Serial,
+			DeviceID: fpXML.DeviceID,
+			DiveID:   fpXML.DiveID,
+			Data:     fpXML.Data,
+		})
+	}
+	if settingsXML.AutoGroup != nil {
+		// <autogroup state='1' /> is written only when it is enabled
+		state, err := strconv.Atoi(settingsXML.AutoGroup.State)
+		if err != nil {
+			return settings, fieldError("autogroup@state", err)
+		}
+		settings.AutoGroup = state != 0
+	}
+	return settings, nil
+}
+
+func DecodeSettingsXML(decoder *Decoder, tok *xml.StartElement) (*SettingsXML, error) {
+	settingsXML := &SettingsXML{}
+	err := decoder.XMLDecoder.DecodeElement(settingsXML, tok)
+	return settingsXML, err
 }
 
 func DecodeSiteXML(decoder *Decoder, tok *xml.StartElement) (*SiteXML, error) {
@@ -277,6 +569,53 @@ func DecodeDiveXML(decoder *Decoder, tok *xml.StartElement) (*DiveXML, error) {
 	return diveXML, err
 }
 
+// Enter appends an element to the path used for error reporting.
+func (d *Decoder) Enter(element string) {
+	d.path = append(d.path, element)
+}
+
+// Leave removes the last element from the path used for error reporting.
+func (d *Decoder) Leave() {
+	if len(d.path) > 0 {
+		d.path = d.path[:len(d.path)-1]
+	}
+}
+
+// Path returns the path of the element being decoded, e.g. "divelog/dives/trip[3]".
+func (d *Decoder) Path() string {
+	return strings.Join(d.path, "/")
+}
+
+// Fail returns a DecodeError located at the current input position. The path is
+// relative to the element being decoded and can be empty.
+func (d *Decoder) Fail(path string, cause error) error {
+	return d.failAt(d.position(), path, cause)
+}
+
+type inputPosition struct {
+	line   int
+	column int
+	offset int64
+}
+
+func (d *Decoder) position() inputPosition {
+	line, column := d.XMLDecoder.InputPos()
+	return inputPosition{line: line, column: column, offset: d.XMLDecoder.InputOffset()}
+}
+
+func (d *Decoder) failAt(pos inputPosition, path string, cause error) error {
+	if cause == io.EOF {
+		cause = io.ErrUnexpectedEOF
+	}
+	return &DecodeError{
+		Path:   joinPath(d.Path(), path),
+		Line:   pos.line,
+		Column: pos.column,
+		Offset: pos.offset,
+		Err:    cause,
+	}
+}
+
 func (d *Decoder) Token() (tok xml.Token, err error) {
 	for {
 		tok, err = d.XMLDecoder.Token()
@@ -288,6 +627,8 @@ func (d *Decoder) Token() (tok xml.Token, err error) {
 			if len(strings.TrimSpace(string(t))) > 0 {
 				return
 			}
+		case xml.Comment, xml.ProcInst, xml.Directive:
+			// not part of the data model
 		default:
 			return
 		}
@@ -297,7 +638,7 @@ func (d *Decoder) Token() (tok xml.Token, err error) {
 func (d *Decoder) ExpectStart(tag string) (*xml.StartElement, error) {
 	tok, err := d.Token()
 	if err != nil {
-		return nil, ErrInvalidFormat
+		return nil, d.Fail("", err)
 	}
 	switch tok := tok.(type) {
 	case xml.StartElement:
@@ -305,25 +646,25 @@ func (d *Decoder) ExpectStart(tag string) (*xml.StartElement, error) {
 			return &tok, nil
 		}
 	}
-	return nil, ErrInvalidFormat
+	return nil, d.unexpected(tok)
 }
 
 func (d *Decoder) ExpectAnyStart() (*xml.StartElement, error) {
 	tok, err := d.Token()
 	if err != nil {
-		return nil, ErrInvalidFormat
+		return nil, d.Fail("", err)
 	}
 	switch tok := tok.(type) {
 	case xml.StartElement:
 		return &tok, nil
 	}
-	return nil, ErrInvalidFormat
+	return nil, d.unexpected(tok)
 }
 
 func (d *Decoder) ExpectEnd(tag string) (*xml.EndElement, error) {
 	tok, err := d.Token()
 	if err != nil {
-		return nil, ErrInvalidFormat
+		return nil, d.Fail("", err)
 	}
 	switch tok := tok.(type) {
 	case xml.EndElement:
@@ -331,13 +672,13 @@ func (d *Decoder) ExpectEnd(tag string) (*xml.EndElement, error) {
 			return &tok, nil
 		}
 	}
-	return nil, ErrInvalidFormat
+	return nil, d.unexpected(tok)
 }
 
 func (d *Decoder) NextOrEnd(next string, end string) (*xml.StartElement, error) {
 	tok, err := d.Token()
 	if err != nil {
-		return nil, ErrInvalidFormat
+		return nil, d.Fail("", err)
 	}
 	switch tok := tok.(type) {
 	case xml.StartElement:
@@ -349,14 +690,37 @@ func (d *Decoder) NextOrEnd(next string, end string) (*xml.StartElement, error)
 			return nil, nil
 		}
 	}
-	return nil, ErrInvalidFormat
+	return nil, d.unexpected(tok)
+}
+
+func (d *Decoder) NextAnyOrEnd(end string) (*xml.StartElement, error) {
+	tok, err := d.Token()
+	if err != nil {
+		return nil, d.Fail("", err)
+	}
+	switch tok := tok.(type) {
+	case xml.StartElement:
+		return &tok, nil
+	case xml.EndElement:
+		if tok.Name.Local == end {
+			return nil, nil
+		}
+	}
+	return nil, d.unexpected(tok)
 }
 
 func (d *Decoder) SkipElement(tag string) error {
 	if _, err := d.ExpectStart(tag); err != nil {
 		return err
 	}
-	return d.XMLDecoder.Skip()
+	if err := d.XMLDecoder.Skip(); err != nil {
+		return d.Fail(tag, err)
+	}
+	return nil
+}
+
+func (d *Decoder) unexpected(tok xml.Token) error {
+	return d.Fail("", errors.New("unexpected "+describeToken(tok)))
 }
 
 func FindAttribute(tok *xml.StartElement, name string) (val string, ok bool) {
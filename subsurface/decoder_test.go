@@ -0,0 +1,222 @@
+package subsurface
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readFixture(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// recorder is a Handler that logs the calls it gets. The IDs it returns are
+// offset from the record indices, so that their mapping can be checked.
+type recorder struct {
+	calls    []string
+	settings Settings
+	sites    int
+	trips    int
+	dives    []DiveDataHolder
+}
+
+func (h *recorder) log(format string, args ...any) {
+	h.calls = append(h.calls, fmt.Sprintf(format, args...))
+}
+
+func (h *recorder) HandleBegin() { h.log("begin") }
+func (h *recorder) HandleEnd()   { h.log("end") }
+
+func (h *recorder) HandleHeader(program string, version string) {
+	h.log("header %s %s", program, version)
+}
+
+func (h *recorder) HandleSettings(settings Settings) {
+	h.settings = settings
+	h.log("settings")
+}
+
+func (h *recorder) HandleSkip(element string) { h.log("skip %s", element) }
+
+func (h *recorder) HandleDiveSite(uuid string, name string, coords string, description string) int {
+	h.log("site %s %q %q %q", uuid, name, coords, description)
+	h.sites++
+	return 100 + h.sites
+}
+
+func (h *recorder) HandleGeoData(siteID int, cat int, label string) {
+	h.log("geo %d %d %s", siteID, cat, label)
+}
+
+func (h *recorder) HandleDiveTrip(label string) int {
+	h.log("trip %s", label)
+	h.trips++
+	return 200 + h.trips
+}
+
+func (h *recorder) HandleDive(ddh DiveDataHolder) int {
+	h.dives = append(h.dives, ddh)
+	h.log("dive %d trip %d site %s", ddh.DiveNumber, ddh.DiveTripID, ddh.DiveSiteUUID)
+	return len(h.dives)
+}
+
+func TestDecodeSubsurfaceDatabase(t *testing.T) {
+	h := &recorder{}
+	if err := DecodeSubsurfaceDatabase(strings.NewReader(readFixture(t, "dives.xml")), h); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"begin",
+		"header subsurface 3",
+		"settings",
+		`site 1a2b3c4d "Blue Hole" "28.572000 34.537000" "Deep sinkhole"`,
+		"geo 101 2 Egypt",
+		"geo 101 5 Dahab",
+		`site 5e6f7a8b "Lake Ohrid" "41.040000 20.720000" ""`,
+		"geo 102 2 North Macedonia",
+		"trip Dahab",
+		"dive 1 trip 201 site 1a2b3c4d",
+		"dive 2 trip 201 site 1a2b3c4d",
+		"dive 3 trip 0 site 5e6f7a8b",
+		"end",
+	}
+	if got := strings.Join(h.calls, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("calls:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+
+	if len(h.settings.DiveComputers) != 1 || h.settings.DiveComputers[0].Nickname != "Perdix" || !h.settings.AutoGroup {
+		t.Errorf("settings = %+v", h.settings)
+	}
+	if len(h.dives) != 3 {
+		t.Fatalf("%d dives, want 3", len(h.dives))
+	}
+
+	first := h.dives[0]
+	if !first.DateTime.Equal(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)) || first.Duration != 45*time.Minute+30*time.Second {
+		t.Errorf("dive 1: date %v, duration %v", first.DateTime, first.Duration)
+	}
+	if first.Rating != 4 || first.Visibility != 3 || first.Buddy != "Ana" || first.Notes != "Arch at 55 m" || first.Weight != 6 {
+		t.Errorf("dive 1: rating %d, visibility %d, buddy %q, notes %q, weight %v",
+			first.Rating, first.Visibility, first.Buddy, first.Notes, first.Weight)
+	}
+	if first.DepthMax != 30.5 || first.DepthMean != 18.2 || first.TemperatureWaterMin != 24+zeroCelsius {
+		t.Errorf("dive 1: depth %v/%v, water %v", first.DepthMax, first.DepthMean, first.TemperatureWaterMin)
+	}
+	if len(first.Cylinders) != 2 {
+		t.Fatalf("dive 1: %d cylinders, want 2", len(first.Cylinders))
+	}
+	if c := first.Cylinders[0]; c.Size != 11.1 || c.WorkPressure != 207 || c.StartPressure != 200 || c.EndPressure != 60 || c.O2 != 32 || c.Description != "AL80" {
+		t.Errorf("dive 1: cylinder 1 = %+v", c)
+	}
+	if c := first.Cylinders[1]; c.O2 != 50 || c.Use != "oxygen" {
+		t.Errorf("dive 1: cylinder 2 = %+v", c)
+	}
+	if len(first.Samples) != 3 || first.Samples[1].Depth != 30.5 || first.Samples[1].Pressure != 150 {
+		t.Errorf("dive 1: samples = %+v", first.Samples)
+	}
+	if len(first.Events) != 1 || first.Events[0].Time != 20*time.Minute {
+		t.Errorf("dive 1: events = %+v", first.Events)
+	}
+	if len(first.DiveComputers) != 1 || first.DiveComputers[0].DeviceID != "aabbccdd" {
+		t.Errorf("dive 1: dive computers = %+v", first.DiveComputers)
+	}
+
+	last := h.dives[2]
+	if len(last.Cylinders) != 1 || last.Cylinders[0].Size != 12 || last.TemperatureAir != 28+zeroCelsius {
+		t.Errorf("dive 3: cylinders %+v, air %v", last.Cylinders, last.TemperatureAir)
+	}
+	if last.DiveComputerModel != "Manually added dive" {
+		t.Errorf("dive 3: dive computer %q", last.DiveComputerModel)
+	}
+}
+
+func TestDecodeSubsurfaceDatabaseSections(t *testing.T) {
+	// sections are optional, may come in any order, and unknown ones are skipped
+	input := `<divelog program='subsurface' version='3'>
+<dives>
+<dive number='1' divesiteid='1a2b' date='2024-05-01' time='10:00:00' duration='30:00 min'/>
+</dives>
+<filterpresets><filterpreset name='deep'/></filterpresets>
+<divesites>
+<site uuid='1a2b' name='Reef'/>
+</divesites>
+</divelog>`
+	h := &recorder{}
+	if err := DecodeSubsurfaceDatabase(strings.NewReader(input), h); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"begin",
+		"header subsurface 3",
+		"dive 1 trip 0 site 1a2b",
+		"skip filterpresets",
+		`site 1a2b "Reef" "" ""`,
+		"end",
+	}
+	if got := strings.Join(h.calls, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("calls:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+
+	h = &recorder{}
+	if err := DecodeSubsurfaceDatabase(strings.NewReader("<divelog program='subsurface' version='3'/>"), h); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(h.calls, ", "); got != "begin, header subsurface 3, end" {
+		t.Errorf("calls of an empty database: %s", got)
+	}
+}
+
+func TestDecodeSubsurfaceDatabaseErrors(t *testing.T) {
+	fixture := readFixture(t, "dives.xml")
+	for _, tc := range []struct {
+		name  string
+		input string
+		path  string
+		cause error
+	}{
+		{
+			name:  "invalid value",
+			input: strings.Replace(fixture, "<depth max='12.0 m'", "<depth max='twelve'", 1),
+			path:  "divelog/dives/dive[1]/divecomputer[1]/depth@max",
+			cause: ErrInvalidValue,
+		},
+		{
+			name:  "truncated",
+			input: fixture[:len(fixture)/2],
+		},
+		{
+			name:  "not a database",
+			input: "<uddf version='3.2.0'/>",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := DecodeSubsurfaceDatabase(strings.NewReader(tc.input), &recorder{})
+			if !errors.Is(err, ErrInvalidFormat) {
+				t.Fatalf("err = %v, want an invalid format", err)
+			}
+			var decodeErr *DecodeError
+			if tc.path != "" && (!errors.As(err, &decodeErr) || decodeErr.Path != tc.path) {
+				t.Errorf("err = %v, want path %q", err, tc.path)
+			}
+			if tc.cause != nil && !errors.Is(err, tc.cause) {
+				t.Errorf("err = %v, want %v", err, tc.cause)
+			}
+		})
+	}
+
+	if err := DecodeSubsurfaceDatabase(nil, &recorder{}); err != ErrNilReader {
+		t.Errorf("err = %v, want %v", err, ErrNilReader)
+	}
+	if err := DecodeSubsurfaceDatabase(strings.NewReader(fixture), nil); err != ErrNilHandler {
+		t.Errorf("err = %v, want %v", err, ErrNilHandler)
+	}
+}
@@ -0,0 +1,411 @@
+package subsurface
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrRecordOrder = errors.New("record is out of order")
+
+// Encoder writes records, in the order Reader produces them, as a Subsurface
+// XML database. Sites are written with the geo records that follow them, and
+// dives whose DiveTripID matches the index of the last trip are written inside
+// that trip. Skipped elements are not reproduced.
+type Encoder struct {
+	xmlEncoder *xml.Encoder
+	state      readerState
+	siteOpen   bool
+	siteIndex  int
+	tripIndex  int
+	err        error
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	e := &Encoder{
+		xmlEncoder: xml.NewEncoder(w),
+	}
+	e.xmlEncoder.Indent("", "  ")
+	return e
+}
+
+// Encode writes a single record. The first record must be a *HeaderRecord.
+func (e *Encoder) Encode(record Record) error {
+	if e.err != nil {
+		return e.err
+	}
+
+	_, isHeader := record.(*HeaderRecord)
+	if isHeader != (e.state == stateStart) {
+		return ErrRecordOrder
+	}
+
+	switch rec := record.(type) {
+	case *HeaderRecord:
+		e.start("divelog", "program", rec.Program, "version", rec.Version)
+		e.state = stateDiveLog
+	case *SettingsRecord:
+		e.enter(stateDiveLog)
+		e.encodeSettings(&rec.Settings)
+	case *SkipRecord:
+		// the contents of skipped elements are not known
+	case *SiteRecord:
+		e.enter(stateDiveSites)
+		e.start("site",
+			"uuid", rec.UUID,
+			"name", rec.Name,
+			"gps", rec.Coords,
+			"description", rec.Description,
+		)
+		e.siteOpen = true
+		e.siteIndex = rec.Index
+	case *GeoRecord:
+		if !e.siteOpen || rec.SiteIndex != e.siteIndex {
+			return ErrRecordOrder
+		}
+		e.element("geo", "cat", strconv.Itoa(rec.Cat), "value", rec.Label)
+	case *TripRecord:
+		e.enter(stateDives)
+		e.start("trip", "location", rec.Label)
+		e.state = stateTrip
+		e.tripIndex = rec.Index
+	case *DiveRecord:
+		if rec.DiveTripID == IntNull {
+			e.enter(stateDives)
+		} else if e.state != stateTrip || rec.DiveTripID != e.tripIndex {
+			return ErrRecordOrder
+		}
+		e.encodeDive(&rec.DiveDataHolder)
+	}
+
+	return e.err
+}
+
+// Close ends all open elements and flushes the output.
+func (e *Encoder) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	if e.state == stateStart {
+		return ErrRecordOrder
+	}
+	e.enter(stateDiveLog)
+	e.end("divelog")
+	e.state = stateEnd
+	if e.err == nil {
+		e.err = e.xmlEncoder.Flush()
+	}
+	return e.err
+}
+
+// enter closes the open elements until the encoder is in the target section,
+// and then opens it.
+func (e *Encoder) enter(target readerState) {
+	if e.siteOpen {
+		e.end("site")
+		e.siteOpen = false
+	}
+	for e.state != target && e.err == nil {
+		switch e.state {
+		case stateTrip:
+			e.end("trip")
+			e.state = stateDives
+		case stateDives:
+			e.end("dives")
+			e.state = stateDiveLog
+		case stateDiveSites:
+			e.end("divesites")
+			e.state = stateDiveLog
+		case stateDiveLog:
+			if target == stateDiveSites {
+				e.start("divesites")
+			} else {
+				e.start("dives")
+			}
+			e.state = target
+		}
+	}
+}
+
+func (e *Encoder) encodeSettings(settings *Settings) {
+	e.start("settings")
+	for _, fp := range settings.Fingerprints {
+		e.element("fingerprint",
+			"model", fp.Model,
+			"serial", fp.Serial,
+			"deviceid", fp.DeviceID,
+			"diveid", fp.DiveID,
+			"data", fp.Data,
+		)
+	}
+	for _, dc := range settings.DiveComputers {
+		e.element("divecomputerid",
+			"model", dc.Model,
+			"deviceid", dc.DeviceID,
+			"serial", dc.Serial,
+			"firmware", dc.Firmware,
+			"nickname", dc.Nickname,
+		)
+	}
+	if settings.AutoGroup {
+		e.element("autogroup", "state", "1")
+	}
+	e.end("settings")
+}
+
+func (e *Encoder) encodeDive(ddh *DiveDataHolder) {
+	attrs := []string{
+		"number", formatInt(ddh.DiveNumber),
+		"rating", formatInt(ddh.Rating),
+		"visibility", formatInt(ddh.Visibility),
+		"sac", ddh.SAC.String(),
+		"tags", strings.Join(ddh.Tags, ", "),
+		"divesiteid", ddh.DiveSiteUUID,
+		"watersalinity", ddh.WaterSalinity.String(),
+	}
+	if IsValidDateTime(ddh.DateTime) {
+		attrs = append(attrs,
+			"date", ddh.DateTime.Format(time.DateOnly),
+			"time", ddh.DateTime.Format(time.TimeOnly),
+		)
+	}
+	attrs = append(attrs,
+		"duration", FormatDuration(ddh.Duration),
+		"current", formatRating(ddh.Current),
+		"wavesize", formatRating(ddh.WaveSize),
+		"surge", formatRating(ddh.Surge),
+		"chill", formatRating(ddh.Chill),
+		"otu", formatRating(ddh.OTU),
+	)
+	if ddh.CNS != 0 {
+		attrs = append(attrs, "cns", strconv.Itoa(ddh.CNS)+"%")
+	}
+	if ddh.Invalid {
+		attrs = append(attrs, "invalid", "1")
+	}
+	// the dive mode is that of the primary dive computer, unless the dive sets it
+	if len(ddh.DiveComputers) > 0 && ddh.DiveMode != "" && ddh.DiveMode != ddh.DiveComputers[0].DiveMode {
+		attrs = append(attrs, "divemode", string(ddh.DiveMode))
+	}
+	e.start("dive", attrs...)
+
+	e.text("divemaster", ddh.DiveMasterOrOperator)
+	e.text("buddy", ddh.Buddy)
+	e.text("notes", ddh.Notes)
+	e.text("suit", ddh.Suit)
+
+	for _, cyl := range ddh.Cylinders {
+		e.element("cylinder",
+			"size", cyl.Size.String(),
+			"workpressure", cyl.WorkPressure.String(),
+			"description", cyl.Description,
+			"start", cyl.StartPressure.String(),
+			"end", cyl.EndPressure.String(),
+			"o2", formatFraction(cyl.O2),
+			"he", formatFraction(cyl.He),
+			"use", cyl.Use,
+		)
+	}
+
+	if ddh.Weight != 0 || ddh.WeightType != "" {
+		e.element("weightsystem", "weight", ddh.Weight.String(), "description", ddh.WeightType)
+	}
+
+	dcs := ddh.DiveComputers
+	if len(dcs) == 0 && (ddh.DiveComputerModel != "" || ddh.DepthMax != 0 || len(ddh.Samples) > 0 || len(ddh.Events) > 0) {
+		dcs = []DiveComputerDataHolder{{
+			Primary:             true,
+			Model:               ddh.DiveComputerModel,
+			DeviceID:            ddh.DiveComputerDeviceID,
+			DiveID:              ddh.DiveComputerDiveID,
+			DiveMode:            ddh.DiveMode,
+			DepthMax:            ddh.DepthMax,
+			DepthMean:           ddh.DepthMean,
+			TemperatureWaterMin: ddh.TemperatureWaterMin,
+			SurfacePressure:     ddh.SurfacePressure,
+			Samples:             ddh.Samples,
+			Events:              ddh.Events,
+			ExtraData:           ddh.ExtraData,
+		}}
+	}
+
+	// the water temperature was entered manually if no dive computer recorded it
+	var waterManual Temperature
+	if len(dcs) == 0 || dcs[0].TemperatureWaterMin == 0 {
+		waterManual = ddh.TemperatureWaterMin
+	}
+	if ddh.TemperatureAir != 0 || waterManual != 0 {
+		e.element("divetemperature",
+			"air", formatTemperature(ddh.TemperatureAir),
+			"water", formatTemperature(waterManual),
+		)
+	}
+
+	for _, picture := range ddh.Pictures {
+		e.element("picture",
+			"filename", picture.Filename,
+			"offset", formatOffset(picture.Offset),
+			"gps", picture.Coords,
+		)
+	}
+
+	// the primary dive computer is always written first
+	for _, dc := range dcs {
+		if dc.Primary {
+			e.encodeDiveComputer(&dc)
+		}
+	}
+	for _, dc := range dcs {
+		if !dc.Primary {
+			e.encodeDiveComputer(&dc)
+		}
+	}
+
+	e.end("dive")
+}
+
+func (e *Encoder) encodeDiveComputer(dc *DiveComputerDataHolder) {
+	// open circuit is the default, and is not written
+	dcType := ""
+	if dc.DiveMode != "" && dc.DiveMode != DiveModeOC {
+		dcType = string(dc.DiveMode)
+	}
+	e.start("divecomputer", "model", dc.Model, "deviceid", dc.DeviceID, "diveid", dc.DiveID, "dctype", dcType)
+	if dc.DepthMax != 0 || dc.DepthMean != 0 {
+		e.element("depth", "max", dc.DepthMax.String(), "mean", dc.DepthMean.String())
+	}
+	if dc.TemperatureWaterMin != 0 {
+		e.element("temperature", "water", formatTemperature(dc.TemperatureWaterMin))
+	}
+	if dc.SurfacePressure != 0 {
+		e.element("surface", "pressure", dc.SurfacePressure.String())
+	}
+	for _, event := range dc.Events {
+		cylinder := ""
+		if event.Cylinder > 0 {
+			cylinder = strconv.Itoa(event.Cylinder - 1)
+		}
+		e.element("event",
+			"time", formatMinutes(event.Time),
+			"type", formatInt(event.Type),
+			"flags", formatInt(event.Flags),
+			"value", formatInt(event.Value),
+			"name", event.Name,
+			"cylinder", cylinder,
+		)
+	}
+	for _, ed := range dc.ExtraData {
+		e.element("extradata", "key", ed.Key, "value", ed.Value)
+	}
+	e.encodeSamples(dc.Samples)
+	e.end("divecomputer")
+}
+
+// encodeSamples writes NDL, TTS, ceiling, deco state and ppO2 only when they
+// change, mirroring DecodeSamples.
+func (e *Encoder) encodeSamples(samples []Sample) {
+	var prev Sample
+	for _, sample := range samples {
+		attrs := []string{
+			"time", formatMinutes(sample.Time),
+			"depth", formatDecimal(float64(sample.Depth)) + " m",
+			"temp", formatTemperature(sample.Temperature),
+			"pressure", sample.Pressure.String(),
+		}
+		if sample.NDL != prev.NDL {
+			attrs = append(attrs, "ndl", formatMinutes(sample.NDL))
+		}
+		if sample.TTS != prev.TTS {
+			attrs = append(attrs, "tts", formatMinutes(sample.TTS))
+		}
+		if sample.Ceiling != prev.Ceiling {
+			attrs = append(attrs, "stopdepth", formatDecimal(float64(sample.Ceiling))+" m")
+		}
+		if sample.InDeco != prev.InDeco {
+			attrs = append(attrs, "in_deco", formatBool(sample.InDeco))
+		}
+		if sample.PO2 != prev.PO2 {
+			attrs = append(attrs, "po2", formatDecimal(float64(sample.PO2))+" bar")
+		}
+		e.element("sample", attrs...)
+		prev = sample
+	}
+}
+
+// start writes a start tag. Attributes are given as name and value pairs,
+// and attributes with empty values are left out.
+func (e *Encoder) start(name string, attrs ...string) {
+	if e.err != nil {
+		return
+	}
+	tok := xml.StartElement{Name: xml.Name{Local: name}}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		if attrs[i+1] != "" {
+			tok.Attr = append(tok.Attr, xml.Attr{Name: xml.Name{Local: attrs[i]}, Value: attrs[i+1]})
+		}
+	}
+	e.err = e.xmlEncoder.EncodeToken(tok)
+}
+
+func (e *Encoder) end(name string) {
+	if e.err != nil {
+		return
+	}
+	e.err = e.xmlEncoder.EncodeToken(xml.EndElement{Name: xml.Name{Local: name}})
+}
+
+// element writes an element without content.
+func (e *Encoder) element(name string, attrs ...string) {
+	e.start(name, attrs...)
+	e.end(name)
+}
+
+// text writes an element with text content, unless the text is empty.
+func (e *Encoder) text(name string, value string) {
+	if value == "" || e.err != nil {
+		return
+	}
+	e.err = e.xmlEncoder.EncodeElement(value, xml.StartElement{Name: xml.Name{Local: name}})
+}
+
+func formatInt(v int) string {
+	if v == IntNull {
+		return ""
+	}
+	return strconv.Itoa(v)
+}
+
+// formatRating formats a value that is not written when it is 0.
+func formatRating(v int) string {
+	if v == 0 {
+		return ""
+	}
+	return strconv.Itoa(v)
+}
+
+func formatBool(v bool) string {
+	if v {
+		return "1"
+	}
+	return "0"
+}
+
+// formatTemperature formats a temperature in degrees Celsius with millikelvin
+// precision, which is what Subsurface stores internally.
+func formatTemperature(t Temperature) string {
+	if t == 0 {
+		return ""
+	}
+	return formatDecimal(math.Round(t.Celsius()*1000)/1000) + " C"
+}
+
+func formatFraction(f Fraction) string {
+	if f == 0 {
+		return ""
+	}
+	return formatDecimal(float64(f)) + "%"
+}
@@ -0,0 +1,53 @@
+package subsurface
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func readRecords(t *testing.T, r io.Reader) []Record {
+	t.Helper()
+	reader := NewReader(r)
+	var records []Record
+	for {
+		record, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return records
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+}
+
+// A decode followed by an encode keeps everything the decoder understands, so
+// the encoded database reads back as the same records.
+func TestEncodeRoundTrip(t *testing.T) {
+	records := readRecords(t, strings.NewReader(readFixture(t, "dives.xml")))
+
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	again := readRecords(t, &buf)
+	if len(again) != len(records) {
+		t.Fatalf("read back %d records, want %d:\n%s", len(again), len(records), buf.String())
+	}
+	for i := range records {
+		if !reflect.DeepEqual(again[i], records[i]) {
+			t.Errorf("record %d:\n%+v\nwant:\n%+v", i, again[i], records[i])
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package subsurface
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DecodeError describes a decoding problem and where in the input it was found.
+// It matches ErrInvalidFormat through errors.Is, and unwraps to its cause.
+type DecodeError struct {
+	Path   string // element or file path, e.g. "divelog/dives/trip[3]/dive[12]@rating"
+	Line   int
+	Column int
+	Offset int64
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	var b strings.Builder
+	b.WriteString(ErrInvalidFormat.Error())
+	if e.Path != "" {
+		b.WriteString(": ")
+		b.WriteString(e.Path)
+	}
+	if e.Line > 0 && e.Column > 0 {
+		fmt.Fprintf(&b, " (line %d, column %d)", e.Line, e.Column)
+	} else if e.Line > 0 {
+		fmt.Fprintf(&b, " (line %d)", e.Line)
+	}
+	if e.Err != nil {
+		b.WriteString(": ")
+		b.WriteString(e.Err.Error())
+	}
+	return b.String()
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+func (e *DecodeError) Is(target error) bool {
+	return target == ErrInvalidFormat
+}
+
+// fieldError reports an invalid value at a path relative to the element being decoded,
+// e.g. "@rating" or "cylinder[2]@size". The decoder completes the path and the position.
+func fieldError(path string, cause error) error {
+	return &DecodeError{Path: path, Err: cause}
+}
+
+// prefixPath prepends parent to the path of a relative DecodeError.
+func prefixPath(err error, parent string) error {
+	var decodeErr *DecodeError
+	if errors.As(err, &decodeErr) {
+		decodeErr.Path = joinPath(parent, decodeErr.Path)
+	}
+	return err
+}
+
+func joinPath(parent string, child string) string {
+	switch {
+	case parent == "":
+		return child
+	case child == "" || strings.HasPrefix(child, "@"):
+		return parent + child
+	default:
+		return parent + "/" + child
+	}
+}
+
+// indexedPath formats an element name with its 1-based position among
+// its siblings of the same name, e.g. "dive[12]".
+func indexedPath(element string, index int) string {
+	return fmt.Sprintf("%s[%d]", element, index)
+}
+
+func describeToken(tok xml.Token) string {
+	switch tok := tok.(type) {
+	case xml.StartElement:
+		return fmt.Sprintf("element <%s>", tok.Name.Local)
+	case xml.EndElement:
+		return fmt.Sprintf("end of element <%s>", tok.Name.Local)
+	case xml.CharData:
+		return "text content"
+	default:
+		return fmt.Sprintf("token %T", tok)
+	}
+}
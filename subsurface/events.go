@@ -0,0 +1,198 @@
+package subsurface
+
+import (
+	"cmp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event types, as numbered by libdivecomputer and stored by Subsurface.
+const (
+	EventNone                = 0
+	EventDecoStop            = 1
+	EventRBT                 = 2
+	EventAscent              = 3
+	EventCeiling             = 4
+	EventWorkload            = 5
+	EventTransmitter         = 6
+	EventViolation           = 7
+	EventBookmark            = 8
+	EventSurface             = 9
+	EventSafetyStop          = 10
+	EventGasChange           = 11
+	EventSafetyStopVoluntary = 12
+	EventSafetyStopMandatory = 13
+	EventDeepStop            = 14
+	EventCeilingSafetyStop   = 15
+	EventFloor               = 16
+	EventDiveTime            = 17
+	EventMaxDepth            = 18
+	EventOLF                 = 19
+	EventPO2                 = 20
+	EventAirTime             = 21
+	EventRGBM                = 22
+	EventHeading             = 23
+	EventTissueLevel         = 24
+	EventGasChange2          = 25
+)
+
+const (
+	eventTypeCount = 26
+
+	// flags: begin and end bits, then the severity
+	eventFlagSeverityShift = 2
+	eventFlagSeverityMask  = 7
+
+	// EventGasChange2 stores the helium percentage in the upper 16 bits
+	eventHeliumUnit = 1 << 16
+
+	eventNameGasChange = "gaschange"
+	eventNameBookmark  = "bookmark"
+	eventNameHeading   = "heading"
+)
+
+// Event severities, encoded in the flags of an event.
+const (
+	SeverityNone  = 0
+	SeverityState = 1
+	SeverityInfo  = 2
+	SeverityWarn  = 3
+	SeverityAlarm = 4
+)
+
+// eventNames are the names Subsurface gives to events of each type.
+var eventNames = [eventTypeCount]string{
+	"none", "deco stop", "rbt", "ascent", "ceiling", "workload", "transmitter",
+	"violation", "bookmark", "surface", "safety stop", "gaschange",
+	"safety stop (voluntary)", "safety stop (mandatory)", "deepstop",
+	"ceiling (safety stop)", "below floor", "divetime", "maxdepth", "OLF", "pO₂",
+	"airtime", "rgbm", "heading", "tissue level warning", "gaschange",
+}
+
+// Event is something a dive computer reported at a point of the dive, e.g. a
+// gas change, a bookmark or an alarm. Value depends on the type: the oxygen
+// percentage for gas changes (with the helium percentage in the upper 16 bits
+// for EventGasChange2), the compass heading in degrees for EventHeading.
+// Cylinder is the 1-based index of the cylinder switched to, or 0.
+type Event struct {
+	Time     time.Duration
+	Type     int
+	Flags    int
+	Value    int
+	Name     string
+	Cylinder int
+}
+
+// Severity returns the severity encoded in the flags of the event.
+func (e *Event) Severity() int {
+	return (e.Flags >> eventFlagSeverityShift) & eventFlagSeverityMask
+}
+
+// IsGasChange reports whether the event is a switch to another gas.
+func (e *Event) IsGasChange() bool {
+	return e.Type == EventGasChange || e.Type == EventGasChange2 || e.Name == eventNameGasChange
+}
+
+// IsBookmark reports whether the event is a bookmark set by the diver.
+func (e *Event) IsBookmark() bool {
+	return e.Type == EventBookmark || e.Name == eventNameBookmark
+}
+
+// IsHeading reports whether the event is a compass heading.
+func (e *Event) IsHeading() bool {
+	return e.Type == EventHeading || e.Name == eventNameHeading
+}
+
+// IsAlarm reports whether the event warns about a safety issue. The severity
+// is used when the dive computer reports it; otherwise events of the types
+// that are always warnings are alarms (e.g. fast ascents, deco violations,
+// high ppO2).
+func (e *Event) IsAlarm() bool {
+	switch e.Severity() {
+	case SeverityWarn, SeverityAlarm:
+		return true
+	case SeverityState, SeverityInfo:
+		return false
+	}
+	switch e.Type {
+	case EventRBT, EventAscent, EventCeiling, EventViolation, EventFloor,
+		EventOLF, EventPO2, EventAirTime, EventTissueLevel:
+		return true
+	}
+	return false
+}
+
+// GasMix returns the oxygen and helium fractions of a gas change event.
+func (e *Event) GasMix() (o2 Fraction, he Fraction) {
+	if e.Type == EventGasChange2 {
+		return Fraction(e.Value % eventHeliumUnit), Fraction(e.Value / eventHeliumUnit)
+	}
+	return Fraction(e.Value), 0
+}
+
+// TypeName returns the name of the event, or the name Subsurface gives to
+// events of its type if it has none.
+func (e *Event) TypeName() string {
+	if e.Name != "" {
+		return e.Name
+	}
+	if e.Type >= 0 && e.Type < eventTypeCount {
+		return eventNames[e.Type]
+	}
+	return "event " + strconv.Itoa(e.Type)
+}
+
+// DecodeEvents converts the event elements of a dive computer, in the order of
+// their time. Invalid values are reported with a path relative to the dive
+// computer.
+func DecodeEvents(eventsXML []EventXML) ([]Event, error) {
+	if len(eventsXML) == 0 {
+		return nil, nil
+	}
+
+	var (
+		events = make([]Event, 0, len(eventsXML))
+		err    error
+	)
+	for i, eventXML := range eventsXML {
+		event := Event{Name: strings.TrimSpace(eventXML.Name)}
+		path := indexedPath("event", i+1)
+
+		if event.Time, err = ParseDuration(eventXML.Time); err != nil {
+			return nil, fieldError(path+"@time", err)
+		}
+		if event.Type, err = parseOptionalInt(eventXML.Type); err != nil {
+			return nil, fieldError(path+"@type", err)
+		}
+		if event.Flags, err = parseOptionalInt(eventXML.Flags); err != nil {
+			return nil, fieldError(path+"@flags", err)
+		}
+		if event.Value, err = parseOptionalInt(eventXML.Value); err != nil {
+			return nil, fieldError(path+"@value", err)
+		}
+		if eventXML.Cylinder != "" {
+			// Subsurface numbers cylinders from 0
+			if event.Cylinder, err = strconv.Atoi(strings.TrimSpace(eventXML.Cylinder)); err != nil {
+				return nil, fieldError(path+"@cylinder", err)
+			}
+			event.Cylinder++
+		}
+
+		events = append(events, event)
+	}
+
+	slices.SortStableFunc(events, func(a, b Event) int {
+		return cmp.Compare(a.Time, b.Time)
+	})
+	return events, nil
+}
+
+func parseOptionalInt(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(s)
+}
@@ -0,0 +1,705 @@
+package subsurface
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The git object database is read directly, so that the storage can be loaded
+// from a bare repository (e.g. Subsurface's cloud storage cache) without git
+// being installed. Loose objects and version 2 pack files, including
+// delta-compressed objects, are supported. Objects are read from the pack files
+// at their offsets, and kept in memory once read, for as long as the repository
+// is open: the storage is read once per load, and walking it reads the same
+// trees and delta bases over and over.
+
+var ErrGitObjectNotFound = errors.New("git object not found")
+
+const (
+	gitObjectCommit = 1
+	gitObjectTree   = 2
+	gitObjectBlob   = 3
+	gitObjectTag    = 4
+
+	gitObjectOfsDelta = 6
+	gitObjectRefDelta = 7
+
+	// delta chains are short in practice; this only guards against corrupt packs
+	maxGitDeltaDepth = 64
+
+	// the header of a loose object is its kind and its size in decimal
+	maxGitLooseHeader = 32
+
+	// an object is never larger than a database that Decompress accepts; this
+	// guards against corrupt sizes, which are read before the data
+	maxGitObjectSize = MaxDecompressedSize
+
+	// a pack index ends with the checksums of the pack and of the index
+	gitIndexTrailer = 2 * 20
+)
+
+var gitObjectKinds = map[string]int{
+	"commit": gitObjectCommit,
+	"tree":   gitObjectTree,
+	"blob":   gitObjectBlob,
+	"tag":    gitObjectTag,
+}
+
+type gitHash [20]byte
+
+func (h gitHash) String() string {
+	return hex.EncodeToString(h[:])
+}
+
+func parseGitHash(s string) (h gitHash, err error) {
+	if len(s) != 2*len(h) {
+		return h, fmt.Errorf("invalid git object name %q", s)
+	}
+	_, err = hex.Decode(h[:], []byte(s))
+	return
+}
+
+// gitRepository is a read-only fs.FS over the tree of a single commit. It is
+// not safe for concurrent use, and must be closed to release its pack files.
+type gitRepository struct {
+	dir   string
+	packs []*gitPack
+	root  gitHash
+
+	objects map[gitHash]gitObject
+	trees   map[gitHash][]gitTreeEntry
+}
+
+type gitPack struct {
+	name  string
+	index []byte
+	count int // objects in the pack
+	large int // entries in the table of large offsets
+	file  *os.File
+	size  int64
+
+	// objects read at their offsets, which are the bases of offset deltas
+	objects map[int64]gitObject
+}
+
+type gitObject struct {
+	kind int
+	data []byte
+}
+
+type gitTreeEntry struct {
+	name  string
+	mode  fs.FileMode
+	hash  gitHash
+	isDir bool
+}
+
+// openGitRepository opens the git directory dir (".git" of a working tree, or
+// a bare repository) at the commit that ref points to. An empty ref means HEAD.
+func openGitRepository(dir string, ref string) (*gitRepository, error) {
+	repo := &gitRepository{
+		dir:     dir,
+		objects: make(map[gitHash]gitObject),
+		trees:   make(map[gitHash][]gitTreeEntry),
+	}
+	if err := repo.open(ref); err != nil {
+		repo.Close()
+		return nil, err
+	}
+	return repo, nil
+}
+
+func (repo *gitRepository) open(ref string) error {
+	indexFiles, err := filepath.Glob(filepath.Join(repo.dir, "objects", "pack", "pack-*.idx"))
+	if err != nil {
+		return err
+	}
+	for _, indexFile := range indexFiles {
+		pack, err := openGitPack(indexFile)
+		if err != nil {
+			return err
+		}
+		repo.packs = append(repo.packs, pack)
+	}
+
+	if ref == "" {
+		ref = "HEAD"
+	}
+	hash, err := repo.resolveRef(ref, 0)
+	if err != nil {
+		return err
+	}
+
+	// peel annotated tags down to the commit, and the commit down to its tree
+	for {
+		kind, data, err := repo.readObject(hash)
+		if err != nil {
+			return err
+		}
+		var header string
+		switch kind {
+		case gitObjectTag:
+			header = "object "
+		case gitObjectCommit:
+			header = "tree "
+		case gitObjectTree:
+			repo.root = hash
+			return nil
+		default:
+			return fmt.Errorf("git ref %q does not point to a commit", ref)
+		}
+		line, _, _ := strings.Cut(string(data), "\n")
+		name, ok := strings.CutPrefix(line, header)
+		if !ok {
+			return fmt.Errorf("git object %s is malformed", hash)
+		}
+		if hash, err = parseGitHash(name); err != nil {
+			return err
+		}
+	}
+}
+
+// Close closes the pack files of the repository.
+func (repo *gitRepository) Close() error {
+	var errs []error
+	for _, pack := range repo.packs {
+		errs = append(errs, pack.file.Close())
+	}
+	repo.packs = nil
+	return errors.Join(errs...)
+}
+
+func openGitPack(indexFile string) (*gitPack, error) {
+	index, err := os.ReadFile(indexFile)
+	if err != nil {
+		return nil, err
+	}
+	// version 2: magic, version, fan-out table, then names, CRCs and offsets
+	if len(index) < 8+256*4 || !bytes.Equal(index[:8], []byte{0xff, 't', 'O', 'c', 0, 0, 0, 2}) {
+		return nil, fmt.Errorf("unsupported git pack index %s", filepath.Base(indexFile))
+	}
+	name := filepath.Base(indexFile)
+
+	// the fan-out table counts the objects whose names start with each byte or
+	// a lower one, so it must not decrease, and its last entry is the count
+	count, prev := 0, 0
+	for i := 0; i < 256; i++ {
+		n := int(binary.BigEndian.Uint32(index[8+i*4:]))
+		if n < prev {
+			return nil, fmt.Errorf("git pack index %s is corrupt", name)
+		}
+		count, prev = n, n
+	}
+	tables := 8 + 256*4 + count*(20+4+4)
+	if count > len(index) || len(index) < tables+gitIndexTrailer {
+		return nil, fmt.Errorf("git pack index %s is truncated", name)
+	}
+	large := (len(index) - tables - gitIndexTrailer) / 8
+
+	file, err := os.Open(strings.TrimSuffix(indexFile, ".idx") + ".pack")
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &gitPack{
+		name:    name,
+		index:   index,
+		count:   count,
+		large:   large,
+		file:    file,
+		size:    info.Size(),
+		objects: make(map[int64]gitObject),
+	}, nil
+}
+
+// find returns the offset of the object in the pack file. The fan-out table
+// and the size of the index were checked by openGitPack.
+func (p *gitPack) find(hash gitHash) (int64, bool, error) {
+	const fanout = 8
+	names := p.index[fanout+256*4:]
+
+	lo := 0
+	if hash[0] > 0 {
+		lo = int(binary.BigEndian.Uint32(p.index[fanout+(int(hash[0])-1)*4:]))
+	}
+	hi := int(binary.BigEndian.Uint32(p.index[fanout+int(hash[0])*4:]))
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(names[(lo+i)*20:(lo+i+1)*20], hash[:]) >= 0
+	})
+	if i >= hi || !bytes.Equal(names[i*20:(i+1)*20], hash[:]) {
+		return 0, false, nil
+	}
+
+	offsets := names[p.count*(20+4):]
+	offset := int64(binary.BigEndian.Uint32(offsets[i*4:]))
+	if offset&0x80000000 != 0 {
+		// the offset is stored in the table of large offsets
+		slot := int(offset & 0x7fffffff)
+		if slot >= p.large {
+			return 0, false, fmt.Errorf("git pack index %s is corrupt", p.name)
+		}
+		offset = int64(binary.BigEndian.Uint64(offsets[p.count*4+slot*8:]))
+	}
+	return offset, true, nil
+}
+
+func (repo *gitRepository) resolveRef(ref string, depth int) (gitHash, error) {
+	if hash, err := parseGitHash(ref); err == nil {
+		return hash, nil
+	}
+	if depth > 8 {
+		return gitHash{}, fmt.Errorf("git ref %q is a symbolic ref loop", ref)
+	}
+
+	candidates := []string{ref, "refs/heads/" + ref, "refs/tags/" + ref, "refs/remotes/" + ref}
+	for _, name := range candidates {
+		content, err := os.ReadFile(filepath.Join(repo.dir, filepath.FromSlash(name)))
+		if err != nil {
+			continue
+		}
+		value := strings.TrimSpace(string(content))
+		if target, ok := strings.CutPrefix(value, "ref: "); ok {
+			return repo.resolveRef(target, depth+1)
+		}
+		return parseGitHash(value)
+	}
+
+	// refs that are not loose are listed in packed-refs as "<hash> <name>"
+	packed, err := os.ReadFile(filepath.Join(repo.dir, "packed-refs"))
+	if err == nil {
+		for _, line := range strings.Split(string(packed), "\n") {
+			value, name, ok := strings.Cut(strings.TrimSpace(line), " ")
+			if !ok || strings.HasPrefix(value, "#") {
+				continue
+			}
+			for _, candidate := range candidates {
+				if name == candidate {
+					return parseGitHash(value)
+				}
+			}
+		}
+	}
+
+	return gitHash{}, fmt.Errorf("git ref %q not found in %s", ref, repo.dir)
+}
+
+func (repo *gitRepository) readObject(hash gitHash) (int, []byte, error) {
+	return repo.readObjectAt(hash, 0)
+}
+
+func (repo *gitRepository) readObjectAt(hash gitHash, depth int) (int, []byte, error) {
+	if obj, ok := repo.objects[hash]; ok {
+		return obj.kind, obj.data, nil
+	}
+
+	kind, data, err := repo.readLooseObject(hash)
+	if errors.Is(err, fs.ErrNotExist) {
+		err = fmt.Errorf("%w: %s", ErrGitObjectNotFound, hash)
+		for _, pack := range repo.packs {
+			offset, ok, findErr := pack.find(hash)
+			if findErr != nil {
+				err = findErr
+				break
+			}
+			if ok {
+				kind, data, err = repo.readPackedObject(pack, offset, depth)
+				break
+			}
+		}
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	repo.objects[hash] = gitObject{kind: kind, data: data}
+	return kind, data, nil
+}
+
+// readLooseObject inflates a loose object, which is stored as "<kind> <size>\x00<data>".
+func (repo *gitRepository) readLooseObject(hash gitHash) (int, []byte, error) {
+	name := hash.String()
+	file, err := os.Open(filepath.Join(repo.dir, "objects", name[:2], name[2:]))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer file.Close()
+
+	zr, err := zlib.NewReader(file)
+	if err != nil {
+		return 0, nil, fmt.Errorf("git object %s: %w", hash, err)
+	}
+	defer zr.Close()
+	br := bufio.NewReader(zr)
+	header, err := br.ReadSlice(0)
+	if err != nil || len(header) > maxGitLooseHeader {
+		return 0, nil, fmt.Errorf("git object %s is malformed", hash)
+	}
+	kindName, sizeText, _ := strings.Cut(string(header[:len(header)-1]), " ")
+	kind, ok := gitObjectKinds[kindName]
+	size, err := strconv.ParseUint(sizeText, 10, 63)
+	if !ok || err != nil {
+		return 0, nil, fmt.Errorf("git object %s is malformed", hash)
+	}
+	data, err := readInflated(br, size)
+	if err != nil {
+		return 0, nil, fmt.Errorf("git object %s: %w", hash, err)
+	}
+	return kind, data, nil
+}
+
+func (repo *gitRepository) readPackedObject(pack *gitPack, offset int64, depth int) (int, []byte, error) {
+	if obj, ok := pack.objects[offset]; ok {
+		return obj.kind, obj.data, nil
+	}
+	kind, data, err := repo.readPackedObjectAt(pack, offset, depth)
+	if err != nil {
+		return 0, nil, err
+	}
+	pack.objects[offset] = gitObject{kind: kind, data: data}
+	return kind, data, nil
+}
+
+func (repo *gitRepository) readPackedObjectAt(pack *gitPack, offset int64, depth int) (int, []byte, error) {
+	if depth > maxGitDeltaDepth {
+		return 0, nil, errors.New("git delta chain is too long")
+	}
+	if offset < 0 || offset >= pack.size {
+		return 0, nil, errors.New("git pack offset is out of range")
+	}
+
+	// the header is the object kind and the variable-length size of its data,
+	// which is followed by the compressed data
+	r := bufio.NewReader(io.NewSectionReader(pack.file, offset, pack.size-offset))
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	kind := int(c>>4) & 7
+	size := uint64(c & 0x0f)
+	for shift := 4; c&0x80 != 0; shift += 7 {
+		if c, err = r.ReadByte(); err != nil || shift > 56 {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		size |= uint64(c&0x7f) << shift
+	}
+
+	switch kind {
+	case gitObjectCommit, gitObjectTree, gitObjectBlob, gitObjectTag:
+		data, err := inflate(r, size)
+		return kind, data, err
+
+	case gitObjectOfsDelta, gitObjectRefDelta:
+		var (
+			baseKind int
+			base     []byte
+		)
+		if kind == gitObjectOfsDelta {
+			// the base object is at a negative offset, in a big-endian encoding
+			// where each continuation adds one before shifting
+			if c, err = r.ReadByte(); err != nil {
+				return 0, nil, io.ErrUnexpectedEOF
+			}
+			distance := int64(c & 0x7f)
+			for c&0x80 != 0 {
+				if c, err = r.ReadByte(); err != nil {
+					return 0, nil, io.ErrUnexpectedEOF
+				}
+				distance = (distance+1)<<7 | int64(c&0x7f)
+			}
+			baseKind, base, err = repo.readPackedObject(pack, offset-distance, depth+1)
+		} else {
+			var baseHash gitHash
+			if _, err = io.ReadFull(r, baseHash[:]); err != nil {
+				return 0, nil, io.ErrUnexpectedEOF
+			}
+			baseKind, base, err = repo.readObjectAt(baseHash, depth+1)
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		delta, err := inflate(r, size)
+		if err != nil {
+			return 0, nil, err
+		}
+		data, err := applyGitDelta(base, delta)
+		return baseKind, data, err
+
+	default:
+		return 0, nil, fmt.Errorf("unknown git object kind %d", kind)
+	}
+}
+
+// inflate decompresses the zlib stream in r, which must hold size bytes.
+func inflate(r io.Reader, size uint64) ([]byte, error) {
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return readInflated(zr, size)
+}
+
+// readInflated reads the size bytes of decompressed data, and no more, so that
+// a corrupt size or stream cannot make it allocate more than the object needs.
+func readInflated(r io.Reader, size uint64) ([]byte, error) {
+	if size > maxGitObjectSize {
+		return nil, errors.New("git object size is out of range")
+	}
+	data, err := io.ReadAll(io.LimitReader(r, int64(size)))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(data)) != size {
+		return nil, errors.New("git object size mismatch")
+	}
+	return data, nil
+}
+
+// applyGitDelta rebuilds an object from its base and a delta, which is a list
+// of instructions to copy a range of the base or to insert literal data.
+func applyGitDelta(base []byte, delta []byte) ([]byte, error) {
+	errCorrupt := errors.New("git delta is corrupt")
+
+	r := bytes.NewReader(delta)
+	readSize := func() (uint64, error) {
+		var size uint64
+		for shift := 0; ; shift += 7 {
+			c, err := r.ReadByte()
+			if err != nil {
+				return 0, errCorrupt
+			}
+			size |= uint64(c&0x7f) << shift
+			if c&0x80 == 0 {
+				return size, nil
+			}
+		}
+	}
+
+	baseSize, err := readSize()
+	if err != nil || baseSize != uint64(len(base)) {
+		return nil, errCorrupt
+	}
+	size, err := readSize()
+	if err != nil {
+		return nil, errCorrupt
+	}
+	if size > maxGitObjectSize {
+		return nil, errors.New("git object size is out of range")
+	}
+
+	// the size is not trusted with an allocation of its own; the output grows
+	// as the instructions are applied, and may not outgrow the size
+	out := make([]byte, 0, min(size, uint64(len(base))))
+	for r.Len() > 0 {
+		op, _ := r.ReadByte()
+		switch {
+		case op&0x80 != 0:
+			// the bits of op tell which bytes of the offset and size follow
+			var offset, length uint64
+			for i := 0; i < 7; i++ {
+				if op&(1<<i) == 0 {
+					continue
+				}
+				c, err := r.ReadByte()
+				if err != nil {
+					return nil, errCorrupt
+				}
+				if i < 4 {
+					offset |= uint64(c) << (8 * i)
+				} else {
+					length |= uint64(c) << (8 * (i - 4))
+				}
+			}
+			if length == 0 {
+				length = 0x10000
+			}
+			if offset+length > uint64(len(base)) || uint64(len(out))+length > size {
+				return nil, errCorrupt
+			}
+			out = append(out, base[offset:offset+length]...)
+		case op != 0:
+			if uint64(len(out))+uint64(op) > size {
+				return nil, errCorrupt
+			}
+			literal := make([]byte, op)
+			if _, err := io.ReadFull(r, literal); err != nil {
+				return nil, errCorrupt
+			}
+			out = append(out, literal...)
+		default:
+			return nil, errCorrupt
+		}
+	}
+	if uint64(len(out)) != size {
+		return nil, errCorrupt
+	}
+	return out, nil
+}
+
+func (repo *gitRepository) readTree(hash gitHash) ([]gitTreeEntry, error) {
+	if entries, ok := repo.trees[hash]; ok {
+		return entries, nil
+	}
+	kind, data, err := repo.readObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	if kind != gitObjectTree {
+		return nil, fmt.Errorf("git object %s is not a tree", hash)
+	}
+
+	// each entry is "<octal mode> <name>\x00<20-byte hash>"
+	var entries []gitTreeEntry
+	for len(data) > 0 {
+		header, rest, ok := bytes.Cut(data, []byte{0})
+		if !ok || len(rest) < 20 {
+			return nil, fmt.Errorf("git tree %s is malformed", hash)
+		}
+		mode, name, _ := strings.Cut(string(header), " ")
+		entry := gitTreeEntry{name: name, mode: 0o444}
+		copy(entry.hash[:], rest[:20])
+		data = rest[20:]
+
+		switch mode {
+		case "40000":
+			entry.isDir = true
+			entry.mode = fs.ModeDir | 0o555
+		case "100644", "100755":
+		default:
+			// symbolic links and submodules are not part of the storage format
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	repo.trees[hash] = entries
+	return entries, nil
+}
+
+func (repo *gitRepository) lookup(name string) (gitTreeEntry, error) {
+	entry := gitTreeEntry{name: ".", mode: fs.ModeDir | 0o555, hash: repo.root, isDir: true}
+	if name == "." {
+		return entry, nil
+	}
+	for _, part := range strings.Split(name, "/") {
+		if !entry.isDir {
+			return entry, fs.ErrNotExist
+		}
+		entries, err := repo.readTree(entry.hash)
+		if err != nil {
+			return entry, err
+		}
+		found := false
+		for _, e := range entries {
+			if e.name == part {
+				entry, found = e, true
+				break
+			}
+		}
+		if !found {
+			return entry, fs.ErrNotExist
+		}
+	}
+	return entry, nil
+}
+
+func (repo *gitRepository) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	entry, err := repo.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	if entry.isDir {
+		entries, err := repo.readTree(entry.hash)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		dir := &gitDir{info: gitFileInfo{name: path.Base(name), mode: entry.mode}}
+		for _, e := range entries {
+			// sizes of the files in a directory listing are not known without reading them
+			dir.entries = append(dir.entries, fs.FileInfoToDirEntry(gitFileInfo{name: e.name, mode: e.mode}))
+		}
+		return dir, nil
+	}
+
+	kind, data, err := repo.readObject(entry.hash)
+	if err == nil && kind != gitObjectBlob {
+		err = fmt.Errorf("git object %s is not a blob", entry.hash)
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &gitFile{
+		Reader: bytes.NewReader(data),
+		info:   gitFileInfo{name: path.Base(name), mode: entry.mode, size: int64(len(data))},
+	}, nil
+}
+
+type gitFileInfo struct {
+	name string
+	mode fs.FileMode
+	size int64
+}
+
+func (fi gitFileInfo) Name() string       { return fi.name }
+func (fi gitFileInfo) Size() int64        { return fi.size }
+func (fi gitFileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi gitFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi gitFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi gitFileInfo) Sys() any           { return nil }
+
+type gitFile struct {
+	*bytes.Reader
+	info gitFileInfo
+}
+
+func (f *gitFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *gitFile) Close() error               { return nil }
+
+type gitDir struct {
+	info    gitFileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *gitDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *gitDir) Close() error               { return nil }
+
+func (d *gitDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+func (d *gitDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.offset += n
+	return rest[:n], nil
+}
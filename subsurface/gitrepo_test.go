@@ -0,0 +1,227 @@
+package subsurface
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// delta builds a git delta from the sizes and the encoded instructions.
+func delta(baseSize uint64, size uint64, ops ...[]byte) []byte {
+	var buf []byte
+	buf = binary.AppendUvarint(buf, baseSize)
+	buf = binary.AppendUvarint(buf, size)
+	for _, op := range ops {
+		buf = append(buf, op...)
+	}
+	return buf
+}
+
+// deltaCopy encodes a copy instruction with a one-byte offset and size.
+func deltaCopy(offset byte, length byte) []byte {
+	return []byte{0x80 | 0x01 | 0x10, offset, length}
+}
+
+// deltaInsert encodes an instruction to insert literal data.
+func deltaInsert(data string) []byte {
+	return append([]byte{byte(len(data))}, data...)
+}
+
+func TestApplyGitDelta(t *testing.T) {
+	base := []byte("rating 4\nbuddy \"Ana\"\n")
+	large := bytes.Repeat([]byte{'x'}, 0x10000)
+
+	for _, tc := range []struct {
+		name  string
+		base  []byte
+		delta []byte
+		want  string // empty if the delta is corrupt
+	}{
+		{
+			name:  "copy and insert",
+			base:  base,
+			delta: delta(uint64(len(base)), 20, deltaCopy(0, 9), deltaInsert("buddy \"Ivo\"")),
+			want:  "rating 4\nbuddy \"Ivo\"",
+		},
+		{
+			name:  "insert only",
+			base:  base,
+			delta: delta(uint64(len(base)), 3, deltaInsert("new")),
+			want:  "new",
+		},
+		{
+			name:  "copy without an offset or size",
+			base:  large,
+			delta: delta(uint64(len(large)), uint64(len(large)), []byte{0x80}),
+			want:  string(large),
+		},
+		{
+			name:  "base size mismatch",
+			base:  base,
+			delta: delta(uint64(len(base))+1, 3, deltaInsert("new")),
+		},
+		{
+			name:  "result shorter than its size",
+			base:  base,
+			delta: delta(uint64(len(base)), 10, deltaInsert("new")),
+		},
+		{
+			name:  "result longer than its size",
+			base:  base,
+			delta: delta(uint64(len(base)), 2, deltaInsert("new")),
+		},
+		{
+			name:  "copy past the end of the base",
+			base:  base,
+			delta: delta(uint64(len(base)), 10, deltaCopy(20, 10)),
+		},
+		{
+			name:  "copy past the size",
+			base:  base,
+			delta: delta(uint64(len(base)), 2, deltaCopy(0, 9)),
+		},
+		{
+			name:  "truncated copy",
+			base:  base,
+			delta: delta(uint64(len(base)), 9, deltaCopy(0, 9)[:2]),
+		},
+		{
+			name:  "truncated insert",
+			base:  base,
+			delta: delta(uint64(len(base)), 3, deltaInsert("new")[:2]),
+		},
+		{
+			name:  "reserved instruction",
+			base:  base,
+			delta: delta(uint64(len(base)), 3, []byte{0}),
+		},
+		{
+			name:  "huge size",
+			base:  base,
+			delta: delta(uint64(len(base)), 1<<62, deltaCopy(0, 9)),
+		},
+		{
+			name:  "truncated size",
+			base:  base,
+			delta: []byte{byte(len(base)), 0x80},
+		},
+		{
+			name:  "empty",
+			base:  base,
+			delta: nil,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := applyGitDelta(tc.base, tc.delta)
+			switch {
+			case tc.want == "" && err == nil:
+				t.Errorf("applied to %q", got)
+			case tc.want != "" && err != nil:
+				t.Error(err)
+			case string(got) != tc.want:
+				t.Errorf("applied to %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// copyStorage copies the storage fixture, so that a test can damage it.
+func copyStorage(t *testing.T) string {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "storage.git")
+	err := filepath.WalkDir(storageFixture, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, strings.TrimPrefix(name, storageFixture))
+		if d.IsDir() {
+			return os.MkdirAll(target, 0o755)
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, 0o644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestGitPackIndexCorrupt(t *testing.T) {
+	const (
+		fanout = 8
+		names  = fanout + 256*4
+	)
+	for _, tc := range []struct {
+		name   string
+		damage func(index []byte) []byte
+	}{
+		{
+			name:   "truncated",
+			damage: func(index []byte) []byte { return index[:len(index)/2] },
+		},
+		{
+			name:   "no trailer",
+			damage: func(index []byte) []byte { return index[:len(index)-gitIndexTrailer] },
+		},
+		{
+			name: "decreasing fan-out",
+			damage: func(index []byte) []byte {
+				binary.BigEndian.PutUint32(index[fanout+0x10*4:], 0xffff)
+				return index
+			},
+		},
+		{
+			name: "count past the end",
+			damage: func(index []byte) []byte {
+				binary.BigEndian.PutUint32(index[fanout+255*4:], 1<<30)
+				return index
+			},
+		},
+		{
+			name: "large offset past the end",
+			damage: func(index []byte) []byte {
+				// every object is moved to a large offset that is not in the table
+				count := int(binary.BigEndian.Uint32(index[fanout+255*4:]))
+				offsets := index[names+count*(20+4):]
+				for i := 0; i < count; i++ {
+					binary.BigEndian.PutUint32(offsets[i*4:], 0x80000007)
+				}
+				return index
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := copyStorage(t)
+			indexFiles, err := filepath.Glob(filepath.Join(dir, "objects", "pack", "*.idx"))
+			if err != nil || len(indexFiles) == 0 {
+				t.Fatalf("no pack index: %v", err)
+			}
+			for _, indexFile := range indexFiles {
+				index, err := os.ReadFile(indexFile)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err = os.WriteFile(indexFile, tc.damage(index), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// v1 is made of packed objects only
+			fsys, err := OpenGitStorage(dir + "[v1]")
+			if err == nil {
+				err = DecodeGitStorage(fsys, &recorder{})
+				CloseGitStorage(fsys)
+			}
+			if err == nil {
+				t.Error("a damaged pack index was read")
+			}
+		})
+	}
+}
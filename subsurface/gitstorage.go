@@ -0,0 +1,859 @@
+package subsurface
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Subsurface's git storage keeps one small text file per object:
+//
+//	00-Subsurface                               format version and settings
+//	01-Divesites/Site-<uuid>                    one file per dive site
+//	<yyyy>/<mm>/<dd>-<location>/00-Trip         a trip, with its dives in subdirectories
+//	<yyyy>/<mm>/[<dd>-<location>/]<dd>-<weekday>-<hh>=<mm>=<ss>/Dive[-<number>]
+//	                                            a dive, with Divecomputer[-<n>] files next to it
+//	.../Pictures/Picture-<+|-><hh>=<mm>=<ss>    a picture of the dive, named by its offset
+//
+// Every line of a file is a keyword followed by its values. Strings are quoted,
+// may span several lines, and escape quotes and backslashes with a backslash.
+// The date and time of a dive are encoded in the names of its directories.
+
+const (
+	gitHeaderFile    = "00-Subsurface"
+	gitSitesDir      = "01-Divesites"
+	gitTripFile      = "00-Trip"
+	gitSitePrefix    = "Site-"
+	gitDiveFile      = "Dive"
+	gitDCFile        = "Divecomputer"
+	gitPicturesDir   = "Pictures"
+	gitPicturePrefix = "Picture-"
+	gitProgramName   = "subsurface"
+)
+
+var ErrNilStorage = errors.New("git storage fs.FS is nil")
+
+// IsGitStorage reports whether the location names a directory, which is then
+// expected to hold Subsurface git storage rather than an XML database.
+func IsGitStorage(location string) bool {
+	dir, _ := splitGitLocation(location)
+	info, err := os.Stat(dir)
+	return err == nil && info.IsDir()
+}
+
+// OpenGitStorage opens the git storage at location, which is a checked-out
+// repository or a git directory. As in Subsurface, a branch can be selected by
+// appending it in square brackets, e.g. "/path/to/repo[user@example.com]", and
+// its files are then read from the git objects. Without a branch, the checked-out
+// files are read if there are any, and the files of HEAD otherwise.
+func OpenGitStorage(location string) (fs.FS, error) {
+	dir, branch := splitGitLocation(location)
+	if isCheckedOut(dir, branch) {
+		return os.DirFS(dir), nil
+	}
+	repo, err := openGitRepository(gitDirectory(dir), branch)
+	if err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+// GitStorageVersion returns a string that changes when the git storage at
+// location does, without reading the storage itself: the commit that is read,
+// or a digest of the names, sizes and modification times of the checked-out
+// files if those are read.
+func GitStorageVersion(location string) (string, error) {
+	dir, branch := splitGitLocation(location)
+	if isCheckedOut(dir, branch) {
+		return checkoutVersion(dir)
+	}
+	if branch == "" {
+		branch = "HEAD"
+	}
+	repo := &gitRepository{dir: gitDirectory(dir)}
+	hash, err := repo.resolveRef(branch, 0)
+	if err != nil {
+		return "", err
+	}
+	return hash.String(), nil
+}
+
+// isCheckedOut reports whether the storage is read from its checked-out files.
+func isCheckedOut(dir string, branch string) bool {
+	if branch != "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(dir, gitHeaderFile))
+	return err == nil
+}
+
+// gitDirectory returns the git directory of a working tree, or dir itself if
+// it is a bare repository.
+func gitDirectory(dir string) string {
+	if info, err := os.Stat(filepath.Join(dir, ".git")); err == nil && info.IsDir() {
+		return filepath.Join(dir, ".git")
+	}
+	return dir
+}
+
+func checkoutVersion(dir string) (string, error) {
+	h := sha256.New()
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00%d\n", name, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// CloseGitStorage releases the files that git storage opened by OpenGitStorage
+// holds open, once it has been decoded.
+func CloseGitStorage(fsys fs.FS) error {
+	if c, ok := fsys.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func splitGitLocation(location string) (dir string, branch string) {
+	if strings.HasSuffix(location, "]") {
+		if i := strings.LastIndex(location, "["); i > 0 {
+			return location[:i], location[i+1 : len(location)-1]
+		}
+	}
+	return location, ""
+}
+
+// DecodeGitStorage decodes Subsurface git storage and reports its contents to
+// the handler, in the same way DecodeSubsurfaceDatabase does for XML databases.
+// Invalid values are reported as a DecodeError whose path is the file path.
+func DecodeGitStorage(fsys fs.FS, h Handler) error {
+	if fsys == nil {
+		return ErrNilStorage
+	}
+	if h == nil {
+		return ErrNilHandler
+	}
+
+	g := &gitStorageReader{fsys: fsys}
+	if err := g.read(); err != nil {
+		return err
+	}
+	return ReportRecords(g.next, h)
+}
+
+type gitStorageReader struct {
+	fsys    fs.FS
+	records []Record
+	sites   int
+	trips   int
+}
+
+// gitLine is a line of a storage file. The first argument is the keyword.
+type gitLine struct {
+	number int
+	args   []string
+}
+
+// value returns the arguments after the keyword as a single string.
+func (l gitLine) value() string {
+	return strings.Join(l.args[1:], " ")
+}
+
+func (g *gitStorageReader) next() (Record, error) {
+	if len(g.records) == 0 {
+		return nil, io.EOF
+	}
+	record := g.records[0]
+	g.records = g.records[1:]
+	return record, nil
+}
+
+func (g *gitStorageReader) read() error {
+	lines, err := g.readFile(gitHeaderFile)
+	if err != nil {
+		return err
+	}
+	header := &HeaderRecord{Program: gitProgramName}
+	var (
+		settings    Settings
+		hasSettings bool
+	)
+	for _, line := range lines {
+		if line.args[0] == "version" {
+			header.Version = line.value()
+		} else {
+			hasSettings = true
+			decodeGitSettingsLine(&settings, line)
+		}
+	}
+	g.records = append(g.records, header)
+	if hasSettings {
+		g.records = append(g.records, &SettingsRecord{Settings: settings})
+	}
+
+	if err = g.readSites(); err != nil {
+		return err
+	}
+
+	years, err := g.readDir(".", dirNamed(isDigits(4)))
+	if err != nil {
+		return err
+	}
+	for _, year := range years {
+		months, err := g.readDir(year, dirNamed(isDigits(2)))
+		if err != nil {
+			return err
+		}
+		for _, month := range months {
+			if err = g.readMonth(path.Join(year, month)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (g *gitStorageReader) readSites() error {
+	names, err := g.readDir(gitSitesDir, func(entry fs.DirEntry) bool {
+		return !entry.IsDir() && strings.HasPrefix(entry.Name(), gitSitePrefix)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		file := path.Join(gitSitesDir, name)
+		lines, err := g.readFile(file)
+		if err != nil {
+			return err
+		}
+
+		g.sites++
+		site := &SiteRecord{
+			Index: g.sites,
+			UUID:  normalizeGitUUID(strings.TrimPrefix(name, gitSitePrefix)),
+		}
+		var geos []Record
+		for _, line := range lines {
+			switch line.args[0] {
+			case "name":
+				site.Name = line.value()
+			case "gps":
+				site.Coords = line.value()
+			case "description":
+				site.Description = line.value()
+			case "geo":
+				// geo cat <cat> origin <origin> "<label>"
+				if len(line.args) < 3 || line.args[1] != "cat" {
+					return gitFieldError(file, line, errors.New("malformed geo entry"))
+				}
+				cat, err := strconv.Atoi(line.args[2])
+				if err != nil {
+					return gitFieldError(file, line, err)
+				}
+				geos = append(geos, &GeoRecord{
+					SiteIndex: site.Index,
+					SiteUUID:  site.UUID,
+					Cat:       cat,
+					Label:     line.args[len(line.args)-1],
+				})
+			}
+		}
+		g.records = append(g.records, site)
+		g.records = append(g.records, geos...)
+	}
+
+	return nil
+}
+
+// readMonth reads the trips and dives in a month directory. Trips are
+// directories with a trip file, and every other directory is a dive.
+func (g *gitStorageReader) readMonth(dir string) error {
+	names, err := g.readDir(dir, fs.DirEntry.IsDir)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		entryDir := path.Join(dir, name)
+		if _, err := fs.Stat(g.fsys, path.Join(entryDir, gitTripFile)); err == nil {
+			if err = g.readTrip(entryDir); err != nil {
+				return err
+			}
+			continue
+		}
+		record, err := g.readDive(entryDir, IntNull)
+		if err != nil {
+			return err
+		}
+		if record != nil {
+			g.records = append(g.records, record)
+		}
+	}
+
+	return nil
+}
+
+func (g *gitStorageReader) readTrip(dir string) error {
+	file := path.Join(dir, gitTripFile)
+	lines, err := g.readFile(file)
+	if err != nil {
+		return err
+	}
+
+	g.trips++
+	trip := &TripRecord{Index: g.trips}
+	for _, line := range lines {
+		if line.args[0] == "location" {
+			trip.Label = line.value()
+		}
+	}
+	g.records = append(g.records, trip)
+
+	names, err := g.readDir(dir, fs.DirEntry.IsDir)
+	if err != nil {
+		return err
+	}
+	var dives []*DiveRecord
+	for _, name := range names {
+		record, err := g.readDive(path.Join(dir, name), trip.Index)
+		if err != nil {
+			return err
+		}
+		if record != nil {
+			dives = append(dives, record)
+		}
+	}
+
+	// directory names of dives in another month than the trip start with the
+	// month, so their order is not chronological
+	slices.SortStableFunc(dives, func(a, b *DiveRecord) int {
+		return a.DateTime.Compare(b.DateTime)
+	})
+	for _, dive := range dives {
+		g.records = append(g.records, dive)
+	}
+
+	return nil
+}
+
+// readDive reads the dive in dir. It returns nil if dir does not hold a dive.
+func (g *gitStorageReader) readDive(dir string, tripIndex int) (*DiveRecord, error) {
+	names, err := g.readDir(dir, func(entry fs.DirEntry) bool {
+		return !entry.IsDir()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		diveFile string
+		dcFiles  []string
+	)
+	for _, name := range names {
+		switch {
+		case name == gitDiveFile || strings.HasPrefix(name, gitDiveFile+"-"):
+			diveFile = name
+		case strings.HasPrefix(name, gitDCFile):
+			dcFiles = append(dcFiles, name)
+		}
+	}
+	if diveFile == "" {
+		return nil, nil
+	}
+
+	diveXML := &DiveXML{
+		Number: strings.TrimPrefix(strings.TrimPrefix(diveFile, gitDiveFile), "-"),
+	}
+	file := path.Join(dir, diveFile)
+	if diveXML.Date, diveXML.Time, err = gitDiveDateTime(dir); err != nil {
+		return nil, &DecodeError{Path: dir, Err: err}
+	}
+
+	lines, err := g.readFile(file)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		if err = decodeGitDiveLine(diveXML, line); err != nil {
+			return nil, gitFieldError(file, line, err)
+		}
+	}
+
+	// "Divecomputer" is the first computer, followed by "Divecomputer-1", ...
+	slices.SortFunc(dcFiles, func(a, b string) int {
+		if len(a) != len(b) {
+			return len(a) - len(b)
+		}
+		return strings.Compare(a, b)
+	})
+	for _, dcFile := range dcFiles {
+		dcXML := DiveComputerXML{}
+		file := path.Join(dir, dcFile)
+		lines, err := g.readFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			if err = decodeGitDiveComputerLine(&dcXML, line); err != nil {
+				return nil, gitFieldError(file, line, err)
+			}
+		}
+		diveXML.DiveComputers = append(diveXML.DiveComputers, dcXML)
+	}
+
+	if err = g.readPictures(path.Join(dir, gitPicturesDir), diveXML); err != nil {
+		return nil, err
+	}
+
+	ddh, err := Flatten(diveXML, tripIndex)
+	if err != nil {
+		return nil, prefixPath(err, file)
+	}
+	return &DiveRecord{DiveDataHolder: ddh}, nil
+}
+
+// readPictures reads the pictures of a dive. A picture file holds the file
+// name and the GPS tags of the picture, and its name encodes the offset,
+// e.g. "Picture-+00=12=30"; a suffix keeps the names of pictures taken at the
+// same time apart.
+func (g *gitStorageReader) readPictures(dir string, diveXML *DiveXML) error {
+	names, err := g.readDir(dir, func(entry fs.DirEntry) bool {
+		return !entry.IsDir() && strings.HasPrefix(entry.Name(), gitPicturePrefix)
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		file := path.Join(dir, name)
+		offset := strings.TrimPrefix(name, gitPicturePrefix)
+		if i := strings.IndexFunc(offset[min(1, len(offset)):], func(r rune) bool {
+			return r != '=' && !unicode.IsDigit(r)
+		}); i != -1 {
+			offset = offset[:i+1]
+		}
+		pictureXML := PictureXML{Offset: strings.ReplaceAll(offset, "=", ":")}
+
+		lines, err := g.readFile(file)
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			switch line.args[0] {
+			case "filename":
+				pictureXML.Filename = line.value()
+			case "gps":
+				pictureXML.GPS = line.value()
+			}
+		}
+		diveXML.Pictures = append(diveXML.Pictures, pictureXML)
+	}
+	return nil
+}
+
+// decodeGitSettingsLine decodes a settings line of the header file, e.g.
+//
+//	divecomputerid "Shearwater Perdix" deviceid=aabbccdd serial="1234" nickname="Perdix (backup)"
+//	fingerprint model=1a2b3c4d serial=5e6f7a8b deviceid=aabbccdd diveid=11223344 data="0011aabb"
+//	autogroup
+//
+// Other settings (e.g. userid and prefs) are not decoded.
+func decodeGitSettingsLine(settings *Settings, line gitLine) {
+	switch line.args[0] {
+	case "divecomputerid":
+		attrs := gitAttributes(line)
+		dc := DiveComputerID{
+			DeviceID: attrs["deviceid"],
+			Serial:   attrs["serial"],
+			Firmware: attrs["firmware"],
+			Nickname: attrs["nickname"],
+		}
+		if len(line.args) > 1 && !strings.Contains(line.args[1], "=") {
+			dc.Model = line.args[1]
+		}
+		settings.DiveComputers = append(settings.DiveComputers, dc)
+	case "fingerprint":
+		attrs := gitAttributes(line)
+		settings.Fingerprints = append(settings.Fingerprints, Fingerprint{
+			Model:    attrs["model"],
+			Serial:   attrs["serial"],
+			DeviceID: attrs["deviceid"],
+			DiveID:   attrs["diveid"],
+			Data:     attrs["data"],
+		})
+	case "autogroup":
+		settings.AutoGroup = true
+	}
+}
+
+func decodeGitDiveLine(diveXML *DiveXML, line gitLine) error {
+	switch line.args[0] {
+	case "duration":
+		diveXML.Duration = line.value()
+	case "rating":
+		diveXML.Rating = line.value()
+	case "visibility":
+		diveXML.Visibility = line.value()
+	case "sac":
+		diveXML.SAC = line.value()
+	case "tags":
+		diveXML.Tags = strings.Join(line.args[1:], ", ")
+	case "divesiteid":
+		diveXML.DiveSiteUUID = normalizeGitUUID(line.value())
+	case "divemaster":
+		diveXML.DiveMaster = line.value()
+	case "buddy":
+		diveXML.Buddy = line.value()
+	case "suit":
+		diveXML.Suit = line.value()
+	case "notes":
+		diveXML.Notes = line.value()
+	case "watersalinity":
+		diveXML.WaterSalinity = line.value()
+	case "airtemp":
+		diveXML.TemperatureManual.Air = line.value()
+	case "watertemp":
+		diveXML.TemperatureManual.Water = line.value()
+	case "current":
+		diveXML.Current = line.value()
+	case "wavesize":
+		diveXML.WaveSize = line.value()
+	case "surge":
+		diveXML.Surge = line.value()
+	case "chill":
+		diveXML.Chill = line.value()
+	case "invalid":
+		// a flag without a value
+		diveXML.Invalid = "1"
+	case "divemode":
+		diveXML.DiveMode = line.value()
+	case "otu":
+		diveXML.OTU = line.value()
+	case "cns":
+		diveXML.CNS = line.value()
+	case "cylinder":
+		cyl := CylinderXML{}
+		for key, value := range gitAttributes(line) {
+			switch key {
+			case "vol":
+				cyl.Size = value
+			case "workpressure":
+				cyl.WorkPressure = value
+			case "description":
+				cyl.Description = value
+			case "start":
+				cyl.Start = value
+			case "end":
+				cyl.End = value
+			case "o2":
+				cyl.O2 = value
+			case "he":
+				cyl.He = value
+			case "use":
+				cyl.Use = value
+			}
+		}
+		diveXML.Cylinders = append(diveXML.Cylinders, cyl)
+	case "weightsystem":
+		// only the first weight system is kept, as with the XML format
+		if diveXML.WeightSystem == (WeightSystemXML{}) {
+			attrs := gitAttributes(line)
+			diveXML.WeightSystem = WeightSystemXML{Weight: attrs["weight"], Description: attrs["description"]}
+		}
+	}
+	return nil
+}
+
+func decodeGitDiveComputerLine(dcXML *DiveComputerXML, line gitLine) error {
+	keyword := line.args[0]
+	if keyword != "" && unicode.IsDigit(rune(keyword[0])) {
+		sample, err := decodeGitSample(line)
+		if err != nil {
+			return err
+		}
+		dcXML.Samples = append(dcXML.Samples, sample)
+		return nil
+	}
+
+	switch keyword {
+	case "event":
+		dcXML.Events = append(dcXML.Events, decodeGitEvent(line))
+	case "model":
+		dcXML.Model = line.value()
+	case "deviceid":
+		dcXML.DeviceID = line.value()
+	case "diveid":
+		dcXML.DiveID = line.value()
+	case "dctype":
+		dcXML.DiveMode = line.value()
+	case "keyvalue":
+		// keyvalue "key" "value"
+		if len(line.args) == 3 {
+			dcXML.ExtraData = append(dcXML.ExtraData, ExtraDataXML{Key: line.args[1], Value: line.args[2]})
+		}
+	case "maxdepth":
+		dcXML.DepthInfo.Max = line.value()
+	case "meandepth":
+		dcXML.DepthInfo.Mean = line.value()
+	case "watertemp":
+		dcXML.TemperatureInfo.WaterMin = line.value()
+	case "surfacepressure":
+		dcXML.SurfaceInfo.Pressure = line.value()
+	}
+	return nil
+}
+
+// decodeGitEvent decodes an event line, e.g.
+// "event 12:30 type=25 flags=1 value=50 name=gaschange cylinder=1".
+func decodeGitEvent(line gitLine) EventXML {
+	attrs := gitAttributes(line)
+	event := EventXML{
+		Type:     attrs["type"],
+		Flags:    attrs["flags"],
+		Value:    attrs["value"],
+		Name:     attrs["name"],
+		Cylinder: attrs["cylinder"],
+	}
+	if len(line.args) > 1 && !strings.Contains(line.args[1], "=") {
+		event.Time = line.args[1]
+	}
+	return event
+}
+
+// decodeGitSample decodes a sample line, e.g. "1:30 12.5m 24.0°C 198.0bar ndl=45:00".
+// The depth, temperature and pressure are told apart by their units.
+func decodeGitSample(line gitLine) (SampleXML, error) {
+	sample := SampleXML{Time: line.args[0]}
+	for _, arg := range line.args[1:] {
+		if key, value, ok := strings.Cut(arg, "="); ok {
+			switch key {
+			case "ndl":
+				sample.NDL = value
+			case "tts":
+				sample.TTS = value
+			case "stopdepth":
+				sample.StopDepth = value
+			case "in_deco":
+				sample.InDeco = value
+			case "po2":
+				sample.PO2 = value
+			case "pressure", "pressure0":
+				sample.Pressure = value
+			}
+			continue
+		}
+		switch {
+		case strings.HasSuffix(arg, "bar"):
+			sample.Pressure = arg
+		case strings.HasSuffix(arg, "C") || strings.HasSuffix(arg, "K"):
+			sample.Temperature = arg
+		case strings.HasSuffix(arg, "m"):
+			sample.Depth = arg
+		default:
+			return sample, fmt.Errorf("%w: sample value %q", ErrInvalidValue, arg)
+		}
+	}
+	return sample, nil
+}
+
+// gitAttributes returns the key=value arguments of a line.
+func gitAttributes(line gitLine) map[string]string {
+	attrs := make(map[string]string)
+	for _, arg := range line.args[1:] {
+		if key, value, ok := strings.Cut(arg, "="); ok {
+			attrs[key] = value
+		}
+	}
+	return attrs
+}
+
+// gitDiveDateTime returns the date and time of the dive in dir, which ends with
+// "<yyyy>/<mm>/[<trip>/][[<yyyy>-]<mm>-]<dd>-<weekday>-<hh>=<mm>=<ss>".
+func gitDiveDateTime(dir string) (date string, clock string, err error) {
+	errName := errors.New("directory name does not encode the date and time of a dive")
+
+	elements := strings.Split(dir, "/")
+	if len(elements) < 3 {
+		return "", "", errName
+	}
+	year, month := elements[0], elements[1]
+
+	parts := strings.Split(elements[len(elements)-1], "-")
+	if len(parts) < 3 {
+		return "", "", errName
+	}
+	day, hms := parts[len(parts)-3], parts[len(parts)-1]
+	switch prefix := parts[:len(parts)-3]; len(prefix) {
+	case 0:
+	case 1:
+		month = prefix[0]
+	case 2:
+		year, month = prefix[0], prefix[1]
+	default:
+		return "", "", errName
+	}
+
+	if !isDigits(4)(year) || !isDigits(2)(month) || !isDigits(2)(day) {
+		return "", "", errName
+	}
+	clockParts := strings.Split(hms, "=")
+	if len(clockParts) != 3 {
+		return "", "", errName
+	}
+	for _, part := range clockParts {
+		if !isDigits(2)(part) {
+			return "", "", errName
+		}
+	}
+
+	return year + "-" + month + "-" + day, strings.Join(clockParts, ":"), nil
+}
+
+// readDir returns the sorted names of the entries in dir that match. A missing
+// directory has no entries.
+func (g *gitStorageReader) readDir(dir string, match func(entry fs.DirEntry) bool) ([]string, error) {
+	entries, err := fs.ReadDir(g.fsys, dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if match == nil || match(entry) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (g *gitStorageReader) readFile(file string) ([]gitLine, error) {
+	data, err := fs.ReadFile(g.fsys, file)
+	if err != nil {
+		return nil, err
+	}
+	return parseGitFile(file, string(data))
+}
+
+// parseGitFile splits a storage file into lines of arguments. Arguments are
+// separated by spaces or commas, and quoted strings are unquoted.
+func parseGitFile(file string, data string) ([]gitLine, error) {
+	var (
+		lines  []gitLine
+		line   gitLine
+		arg    strings.Builder
+		inArg  bool
+		quoted bool
+		escape bool
+		number = 1
+	)
+	endArg := func() {
+		if inArg {
+			line.args = append(line.args, arg.String())
+			arg.Reset()
+			inArg = false
+		}
+	}
+	endLine := func() {
+		endArg()
+		if len(line.args) > 0 {
+			lines = append(lines, line)
+		}
+		line = gitLine{number: number + 1}
+	}
+
+	line.number = number
+	for _, r := range data {
+		switch {
+		case escape:
+			arg.WriteRune(r)
+			escape = false
+		case quoted && r == '\\':
+			escape = true
+		case quoted && r == '"':
+			quoted = false
+		case quoted:
+			arg.WriteRune(r)
+		case r == '"':
+			quoted, inArg = true, true
+		case r == '\n':
+			endLine()
+		case r == ' ' || r == '\t' || r == '\r' || r == ',':
+			endArg()
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+		if r == '\n' {
+			number++
+		}
+	}
+	if quoted {
+		return nil, &DecodeError{Path: file, Line: line.number, Err: errors.New("unterminated string")}
+	}
+	endLine()
+
+	return lines, nil
+}
+
+func gitFieldError(file string, line gitLine, cause error) error {
+	return &DecodeError{Path: file + "@" + line.args[0], Line: line.number, Err: cause}
+}
+
+// normalizeGitUUID formats a site UUID as eight hex digits, the way it is
+// written in site file names.
+func normalizeGitUUID(uuid string) string {
+	v, err := strconv.ParseUint(strings.TrimSpace(uuid), 16, 32)
+	if err != nil {
+		return uuid
+	}
+	return fmt.Sprintf("%08x", v)
+}
+
+func dirNamed(match func(name string) bool) func(fs.DirEntry) bool {
+	return func(entry fs.DirEntry) bool {
+		return entry.IsDir() && match(entry.Name())
+	}
+}
+
+func isDigits(n int) func(string) bool {
+	return func(s string) bool {
+		if len(s) != n {
+			return false
+		}
+		for _, r := range s {
+			if r < '0' || r > '9' {
+				return false
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,223 @@
+package subsurface
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testdata/storage.git is a bare repository with five commits on main: the
+// first two are in a pack with ref deltas, and are tagged v1 in packed-refs;
+// the next two are in a pack with offset deltas; the last one is made of loose
+// objects, and main points to it in a loose ref.
+const (
+	storageFixture = "testdata/storage.git"
+	storageHead    = "02470d066e636d693dc5478b9e75dcc443ffc2e9"
+	storageV1      = "c761e82eb223b4d7134275376b0776e618bacfee"
+)
+
+func decodeStorage(t *testing.T, location string) *recorder {
+	t.Helper()
+	fsys, err := OpenGitStorage(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CloseGitStorage(fsys)
+	h := &recorder{}
+	if err = DecodeGitStorage(fsys, h); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestDecodeGitStorage(t *testing.T) {
+	header := []string{
+		"begin",
+		"header subsurface 3",
+		"settings",
+		`site 1a2b3c4d "Blue Hole" "28.572000 34.537000" "Deep \"sinkhole\"\\ arch"`,
+		"geo 101 2 Egypt",
+		"trip Dahab",
+		"dive 1 trip 201 site 1a2b3c4d",
+		"dive 2 trip 201 site 1a2b3c4d",
+	}
+	head := append(slices.Clone(header), "dive 3 trip 0 site 1a2b3c4d", "end")
+	v1 := append(slices.Clone(header), "end")
+	for _, tc := range []struct {
+		location string
+		calls    []string
+	}{
+		{storageFixture, head},
+		{storageFixture + "[main]", head},
+		{storageFixture + "[v1]", v1},
+		{storageFixture + "[" + storageV1 + "]", v1},
+	} {
+		t.Run(tc.location, func(t *testing.T) {
+			h := decodeStorage(t, tc.location)
+			if got := strings.Join(h.calls, "\n"); got != strings.Join(tc.calls, "\n") {
+				t.Fatalf("calls:\n%s\nwant:\n%s", got, strings.Join(tc.calls, "\n"))
+			}
+			if !h.settings.AutoGroup {
+				t.Errorf("settings = %+v", h.settings)
+			}
+
+			// the second version of the first dive is a ref delta
+			first := h.dives[0]
+			if first.Duration != 45*time.Minute+30*time.Second || first.Rating != 4 || first.Buddy != "Ana" {
+				t.Errorf("dive 1: duration %v, rating %d, buddy %q", first.Duration, first.Rating, first.Buddy)
+			}
+			if first.Notes != "Arch at 55 m\nsecond line" {
+				t.Errorf("dive 1: notes %q", first.Notes)
+			}
+			if len(first.Cylinders) != 1 || first.Cylinders[0].Size != 11.1 || first.Cylinders[0].O2 != 32 {
+				t.Errorf("dive 1: cylinders %+v", first.Cylinders)
+			}
+			if len(first.Samples) != 40 || first.Samples[0].Time != 10*time.Second || first.Samples[0].Depth != 1.5 {
+				t.Errorf("dive 1: %d samples, first %+v", len(first.Samples), first.Samples[0])
+			}
+		})
+	}
+
+	h := decodeStorage(t, storageFixture)
+	// the second dive was last changed in loose objects
+	if h.dives[1].Suit != "5mm" {
+		t.Errorf("dive 2: suit %q", h.dives[1].Suit)
+	}
+	// the second version of the last dive is an offset delta
+	last := h.dives[2]
+	if len(last.Samples) != 40 || last.Samples[1].Depth != 2.5 || last.TemperatureAir.Celsius() != 28 {
+		t.Errorf("dive 3: %d samples, second %+v, air %v", len(last.Samples), last.Samples[1], last.TemperatureAir)
+	}
+
+	h = decodeStorage(t, storageFixture+"[v1]")
+	if h.dives[1].Suit != "" {
+		t.Errorf("dive 2 at v1: suit %q", h.dives[1].Suit)
+	}
+}
+
+func TestOpenGitStorageErrors(t *testing.T) {
+	for _, location := range []string{
+		storageFixture + "[missing]",
+		storageFixture + "[0000000000000000000000000000000000000000]",
+		t.TempDir(),
+	} {
+		if fsys, err := OpenGitStorage(location); err == nil {
+			CloseGitStorage(fsys)
+			t.Errorf("%s: opened", location)
+		}
+	}
+}
+
+func TestGitStorageVersion(t *testing.T) {
+	for _, tc := range []struct {
+		location string
+		want     string
+	}{
+		{storageFixture, storageHead},
+		{storageFixture + "[main]", storageHead},
+		{storageFixture + "[v1]", storageV1},
+	} {
+		if got, err := GitStorageVersion(tc.location); err != nil || got != tc.want {
+			t.Errorf("%s: version %q, %v, want %q", tc.location, got, err, tc.want)
+		}
+	}
+	if _, err := GitStorageVersion(storageFixture + "[missing]"); err == nil {
+		t.Error("the version of a missing branch was read")
+	}
+
+	// checked-out files are versioned by their names, sizes and times, and the
+	// git directory next to them does not count
+	dir := t.TempDir()
+	write := func(name string, content string) {
+		t.Helper()
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	version := func() string {
+		t.Helper()
+		v, err := GitStorageVersion(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	write(gitHeaderFile, "version 3\n")
+	write("2024/05/01-Wed-10=00=00/Dive-1", "duration 30:00 min\n")
+	v1 := version()
+	if v := version(); v != v1 {
+		t.Errorf("version changed from %s to %s", v1, v)
+	}
+	write(".git/HEAD", "ref: refs/heads/main\n")
+	if v := version(); v != v1 {
+		t.Errorf("the git directory changed the version from %s to %s", v1, v)
+	}
+	write("2024/05/01-Wed-10=00=00/Dive-1", "duration 45:00 min\nrating 3\n")
+	if v := version(); v == v1 {
+		t.Error("a changed file did not change the version")
+	}
+}
+
+func TestParseGitFile(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input string
+		want  []gitLine
+	}{
+		{
+			name:  "keywords and values",
+			input: "duration 45:30 min\ninvalid\n",
+			want:  []gitLine{{1, []string{"duration", "45:30", "min"}}, {2, []string{"invalid"}}},
+		},
+		{
+			name:  "commas and blank lines",
+			input: "tags \"reef\", \"night dive\"\n\n\r\nrating 4",
+			want:  []gitLine{{1, []string{"tags", "reef", "night dive"}}, {4, []string{"rating", "4"}}},
+		},
+		{
+			name:  "escapes",
+			input: `description "a \"hole\" \\ b"`,
+			want:  []gitLine{{1, []string{"description", `a "hole" \ b`}}},
+		},
+		{
+			name:  "empty string",
+			input: `buddy ""`,
+			want:  []gitLine{{1, []string{"buddy", ""}}},
+		},
+		{
+			name:  "multi-line string",
+			input: "notes \"one\ntwo\"\nrating 2\n",
+			want:  []gitLine{{1, []string{"notes", "one\ntwo"}}, {3, []string{"rating", "2"}}},
+		},
+		{
+			name:  "equals in an argument",
+			input: "cylinder vol=11.1l description=\"AL 80\"",
+			want:  []gitLine{{1, []string{"cylinder", "vol=11.1l", "description=AL 80"}}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseGitFile("Dive", tc.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("lines = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+
+	_, err := parseGitFile("Dive", "rating 4\nnotes \"open\nstill open")
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || decodeErr.Path != "Dive" || decodeErr.Line != 2 {
+		t.Errorf("err = %v, want an unterminated string at Dive:2", err)
+	}
+}
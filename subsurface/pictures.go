@@ -0,0 +1,65 @@
+package subsurface
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Picture is a photo linked to a dive. Filename is the path of the file on the
+// computer Subsurface runs on. Offset is the time the picture was taken,
+// relative to the start of the dive, and is negative for pictures taken before
+// the dive. Coords are the GPS tags of the picture, in the format of dive site
+// coordinates, or an empty string.
+type Picture struct {
+	Filename string
+	Offset   time.Duration
+	Coords   string
+}
+
+// ParseOffset parses the offset of a picture, e.g. "+12:30 min" or "-1:05 min".
+func ParseOffset(s string) (time.Duration, error) {
+	trimmed := strings.TrimSpace(s)
+	sign := time.Duration(1)
+	if rest, ok := strings.CutPrefix(trimmed, "-"); ok {
+		trimmed, sign = rest, -1
+	} else {
+		trimmed = strings.TrimPrefix(trimmed, "+")
+	}
+	d, err := ParseDuration(trimmed)
+	if err != nil {
+		return 0, fmt.Errorf("%w: offset %q", ErrInvalidValue, s)
+	}
+	return sign * d, nil
+}
+
+// DecodePictures converts the picture elements of a dive. Invalid values are
+// reported with a path relative to the dive.
+func DecodePictures(picturesXML []PictureXML) ([]Picture, error) {
+	if len(picturesXML) == 0 {
+		return nil, nil
+	}
+
+	var (
+		pictures = make([]Picture, 0, len(picturesXML))
+		err      error
+	)
+	for i, pictureXML := range picturesXML {
+		picture := Picture{
+			Filename: pictureXML.Filename,
+			Coords:   strings.TrimSpace(pictureXML.GPS),
+		}
+		if picture.Offset, err = ParseOffset(pictureXML.Offset); err != nil {
+			return nil, fieldError(indexedPath("picture", i+1)+"@offset", err)
+		}
+		pictures = append(pictures, picture)
+	}
+	return pictures, nil
+}
+
+func formatOffset(d time.Duration) string {
+	if d < 0 {
+		return "-" + formatMinutes(-d)
+	}
+	return "+" + formatMinutes(d)
+}
@@ -0,0 +1,333 @@
+package subsurface
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// Record is a single item decoded from a Subsurface database by Reader.
+// Its dynamic type is one of *HeaderRecord, *SettingsRecord, *SkipRecord,
+// *SiteRecord, *GeoRecord, *TripRecord or *DiveRecord.
+type Record interface {
+	isRecord()
+}
+
+// HeaderRecord is always the first record.
+type HeaderRecord struct {
+	Program string
+	Version string
+}
+
+// SettingsRecord holds the settings of the database, which precede dive sites
+// and dives.
+type SettingsRecord struct {
+	Settings
+}
+
+// SkipRecord reports a top-level element that the reader does not decode.
+type SkipRecord struct {
+	Element string
+}
+
+// SiteRecord is a dive site. Index is its 1-based position in the database.
+type SiteRecord struct {
+	Index       int
+	UUID        string
+	Name        string
+	Coords      string
+	Description string
+}
+
+// GeoRecord is a geo taxonomy entry of the site that was read before it. Cat
+// is one of the Taxonomy categories.
+type GeoRecord struct {
+	SiteIndex int
+	SiteUUID  string
+	Cat       int
+	Label     string
+}
+
+// TripRecord is a dive trip. Index is its 1-based position in the database.
+type TripRecord struct {
+	Index int
+	Label string
+}
+
+// DiveRecord is a dive. DiveTripID holds the index of the trip the dive is
+// part of, or IntNull.
+type DiveRecord struct {
+	DiveDataHolder
+}
+
+func (*HeaderRecord) isRecord()   {}
+func (*SettingsRecord) isRecord() {}
+func (*SkipRecord) isRecord()     {}
+func (*SiteRecord) isRecord()     {}
+func (*GeoRecord) isRecord()      {}
+func (*TripRecord) isRecord()     {}
+func (*DiveRecord) isRecord()     {}
+
+type readerState int
+
+const (
+	stateStart readerState = iota
+	stateDiveLog
+	stateDiveSites
+	stateDives
+	stateTrip
+	stateEnd
+)
+
+// Reader decodes a Subsurface XML database one record at a time.
+type Reader struct {
+	decoder *Decoder
+	state   readerState
+	pending []Record
+	err     error
+
+	sites int
+	trips int
+
+	// 1-based positions of elements within their parent, used in error paths
+	siteIndex     int
+	tripIndex     int
+	diveIndex     int
+	tripDiveIndex int
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		decoder: &Decoder{
+			XMLDecoder: xml.NewDecoder(r),
+		},
+	}
+}
+
+// Next returns the next record. It returns io.EOF after the end of the database
+// has been reached, and keeps returning the first error it encountered.
+func (r *Reader) Next() (Record, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.pending) > 0 {
+		record := r.pending[0]
+		r.pending = r.pending[1:]
+		return record, nil
+	}
+	record, err := r.next()
+	if err != nil {
+		r.err = err
+	}
+	return record, err
+}
+
+// Records returns an iterator over the remaining records, which can be used as
+// an iter.Seq2[Record, error]. The iteration stops after the first error; io.EOF
+// is not reported.
+func (r *Reader) Records() func(yield func(Record, error) bool) {
+	return func(yield func(Record, error) bool) {
+		for {
+			record, err := r.Next()
+			if err == io.EOF {
+				return
+			}
+			if !yield(record, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (r *Reader) next() (Record, error) {
+	d := r.decoder
+	for {
+		switch r.state {
+		case stateStart:
+			// <divelog ...>
+			startTag, err := d.ExpectStart("divelog")
+			if err != nil {
+				return nil, err
+			}
+			d.Enter("divelog")
+			r.state = stateDiveLog
+			program, _ := FindAttribute(startTag, "program")
+			version, _ := FindAttribute(startTag, "version")
+			return &HeaderRecord{Program: program, Version: version}, nil
+
+		case stateDiveLog:
+			startTag, err := d.NextAnyOrEnd("divelog")
+			if err != nil {
+				return nil, err
+			}
+			if startTag == nil {
+				// </divelog>
+				d.Leave()
+				r.state = stateEnd
+				continue
+			}
+			// all top-level sections are optional and may appear in any order
+			switch startTag.Name.Local {
+			case "divesites":
+				// <divesites>
+				d.Enter("divesites")
+				r.state = stateDiveSites
+				r.siteIndex = 0
+			case "dives":
+				// <dives>
+				d.Enter("dives")
+				r.state = stateDives
+				r.tripIndex, r.diveIndex = 0, 0
+			case "settings":
+				// <settings>
+				return r.readSettings(startTag)
+			default:
+				// e.g. <filterpresets>
+				if err = d.XMLDecoder.Skip(); err != nil {
+					return nil, d.Fail(startTag.Name.Local, err)
+				}
+				return &SkipRecord{Element: startTag.Name.Local}, nil
+			}
+
+		case stateDiveSites:
+			startTag, err := d.NextOrEnd("site", "divesites")
+			if err != nil {
+				return nil, err
+			}
+			if startTag == nil {
+				// </divesites>
+				d.Leave()
+				r.state = stateDiveLog
+				continue
+			}
+			// <site ...> 0..N
+			r.siteIndex++
+			return r.readSite(startTag)
+
+		case stateDives:
+			startTag, err := d.NextAnyOrEnd("dives")
+			if err != nil {
+				return nil, err
+			}
+			if startTag == nil {
+				// </dives>
+				d.Leave()
+				r.state = stateDiveLog
+				continue
+			}
+			switch startTag.Name.Local {
+			case "dive":
+				// <dive ...> 0..N, not part of any trip
+				r.diveIndex++
+				return r.readDive(startTag, indexedPath("dive", r.diveIndex), IntNull)
+			case "trip":
+				// <trip ...> 0..N
+				r.tripIndex++
+				r.tripDiveIndex = 0
+				r.trips++
+				d.Enter(indexedPath("trip", r.tripIndex))
+				r.state = stateTrip
+				location, _ := FindAttribute(startTag, "location")
+				return &TripRecord{Index: r.trips, Label: location}, nil
+			default:
+				return nil, d.unexpected(*startTag)
+			}
+
+		case stateTrip:
+			startTag, err := d.NextOrEnd("dive", "trip")
+			if err != nil {
+				return nil, err
+			}
+			if startTag == nil {
+				// </trip>
+				d.Leave()
+				r.state = stateDives
+				continue
+			}
+			// <dive ...> 0..N
+			r.tripDiveIndex++
+			return r.readDive(startTag, indexedPath("dive", r.tripDiveIndex), r.trips)
+
+		default:
+			return nil, io.EOF
+		}
+	}
+}
+
+func (r *Reader) readSettings(startTag *xml.StartElement) (Record, error) {
+	d := r.decoder
+	d.Enter("settings")
+	defer d.Leave()
+
+	pos := d.position()
+	settingsXML, err := DecodeSettingsXML(d, startTag)
+	if err != nil {
+		return nil, d.Fail("", err)
+	}
+	settings, err := FlattenSettings(settingsXML)
+	if err != nil {
+		var decodeErr *DecodeError
+		if errors.As(err, &decodeErr) {
+			return nil, d.failAt(pos, decodeErr.Path, decodeErr.Err)
+		}
+		return nil, d.failAt(pos, "", err)
+	}
+	return &SettingsRecord{Settings: settings}, nil
+}
+
+func (r *Reader) readSite(startTag *xml.StartElement) (Record, error) {
+	d := r.decoder
+	d.Enter(indexedPath("site", r.siteIndex))
+	defer d.Leave()
+
+	pos := d.position()
+	siteXML, err := DecodeSiteXML(d, startTag)
+	if err != nil {
+		return nil, d.Fail("", err)
+	}
+	r.sites++
+
+	for i, geoData := range siteXML.Geos {
+		cat, err := strconv.Atoi(geoData.Cat)
+		if err != nil {
+			return nil, d.failAt(pos, indexedPath("geo", i+1)+"@cat", err)
+		}
+		r.pending = append(r.pending, &GeoRecord{
+			SiteIndex: r.sites,
+			SiteUUID:  siteXML.UUID,
+			Cat:       cat,
+			Label:     geoData.Value,
+		})
+	}
+
+	return &SiteRecord{
+		Index:       r.sites,
+		UUID:        siteXML.UUID,
+		Name:        siteXML.Name,
+		Coords:      siteXML.GPS,
+		Description: siteXML.Description,
+	}, nil
+}
+
+func (r *Reader) readDive(startTag *xml.StartElement, path string, tripIndex int) (Record, error) {
+	d := r.decoder
+	d.Enter(path)
+	defer d.Leave()
+
+	// field errors are reported at the position of the dive's start tag
+	pos := d.position()
+	diveXML, err := DecodeDiveXML(d, startTag)
+	if err != nil {
+		return nil, d.Fail("", err)
+	}
+	ddh, err := Flatten(diveXML, tripIndex)
+	if err != nil {
+		var decodeErr *DecodeError
+		if errors.As(err, &decodeErr) {
+			return nil, d.failAt(pos, decodeErr.Path, decodeErr.Err)
+		}
+		return nil, d.failAt(pos, "", err)
+	}
+	return &DiveRecord{DiveDataHolder: ddh}, nil
+}
@@ -0,0 +1,90 @@
+package subsurface
+
+import (
+	"time"
+)
+
+// Sample is a single dive computer reading. Zero values mean that the quantity
+// was not recorded at that point of the dive.
+type Sample struct {
+	Time        time.Duration
+	Depth       Depth
+	Temperature Temperature
+	Pressure    Pressure // first cylinder sensor
+	NDL         time.Duration
+	TTS         time.Duration
+	Ceiling     Depth // deco stop depth reported by the computer
+	InDeco      bool
+	PO2         Pressure
+}
+
+// DecodeSamples converts the sample elements of a dive computer into a typed
+// series. Subsurface writes NDL, TTS, ceiling, deco state and ppO2 only when
+// they change, so those values are carried forward from the previous sample.
+// Invalid values are reported with a path relative to the dive computer.
+func DecodeSamples(samplesXML []SampleXML) ([]Sample, error) {
+	if len(samplesXML) == 0 {
+		return nil, nil
+	}
+
+	var (
+		samples = make([]Sample, 0, len(samplesXML))
+		prev    Sample
+		err     error
+	)
+	for i, sampleXML := range samplesXML {
+		sample := Sample{
+			NDL:     prev.NDL,
+			TTS:     prev.TTS,
+			Ceiling: prev.Ceiling,
+			InDeco:  prev.InDeco,
+			PO2:     prev.PO2,
+		}
+		path := indexedPath("sample", i+1)
+
+		if sample.Time, err = ParseDuration(sampleXML.Time); err != nil {
+			return nil, fieldError(path+"@time", err)
+		}
+		if sample.Depth, err = ParseDepth(sampleXML.Depth); err != nil {
+			return nil, fieldError(path+"@depth", err)
+		}
+		if sample.Temperature, err = ParseTemperature(sampleXML.Temperature); err != nil {
+			return nil, fieldError(path+"@temp", err)
+		}
+		pressure := sampleXML.Pressure
+		if pressure == "" {
+			pressure = sampleXML.Pressure0
+		}
+		if sample.Pressure, err = ParsePressure(pressure); err != nil {
+			return nil, fieldError(path+"@pressure", err)
+		}
+		if sampleXML.NDL != "" {
+			if sample.NDL, err = ParseDuration(sampleXML.NDL); err != nil {
+				return nil, fieldError(path+"@ndl", err)
+			}
+		}
+		if sampleXML.TTS != "" {
+			if sample.TTS, err = ParseDuration(sampleXML.TTS); err != nil {
+				return nil, fieldError(path+"@tts", err)
+			}
+		}
+		if sampleXML.StopDepth != "" {
+			if sample.Ceiling, err = ParseDepth(sampleXML.StopDepth); err != nil {
+				return nil, fieldError(path+"@stopdepth", err)
+			}
+		}
+		if sampleXML.InDeco != "" {
+			sample.InDeco = sampleXML.InDeco == "1"
+		}
+		if sampleXML.PO2 != "" {
+			if sample.PO2, err = ParsePressure(sampleXML.PO2); err != nil {
+				return nil, fieldError(path+"@po2", err)
+			}
+		}
+
+		samples = append(samples, sample)
+		prev = sample
+	}
+
+	return samples, nil
+}
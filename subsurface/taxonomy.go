@@ -0,0 +1,31 @@
+package subsurface
+
+import "strconv"
+
+// Taxonomy categories of the geo data of a dive site, as numbered by
+// Subsurface. The administrative levels are from the largest (a state or
+// province) to the smallest; the local name is the town or village.
+const (
+	TaxonomyNone      = 0
+	TaxonomyOcean     = 1
+	TaxonomyCountry   = 2
+	TaxonomyAdminL1   = 3
+	TaxonomyAdminL2   = 4
+	TaxonomyLocalName = 5
+	TaxonomyAdminL3   = 6
+
+	taxonomyCategoryCount = 7
+)
+
+// taxonomyCategoryNames are the names Subsurface gives to the categories.
+var taxonomyCategoryNames = [taxonomyCategoryCount]string{
+	"None", "Ocean", "Country", "State", "County", "Town", "City",
+}
+
+// TaxonomyCategoryName returns the name of a taxonomy category.
+func TaxonomyCategoryName(cat int) string {
+	if cat >= 0 && cat < taxonomyCategoryCount {
+		return taxonomyCategoryNames[cat]
+	}
+	return "category " + strconv.Itoa(cat)
+}
@@ -0,0 +1,219 @@
+package subsurface
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Typed quantities are stored in the units Subsurface uses in its XML files.
+// The zero value of every quantity means that the value was not recorded.
+
+var ErrInvalidValue = errors.New("invalid value")
+
+// Depth in meters.
+type Depth float64
+
+// Pressure in bar.
+type Pressure float64
+
+// Temperature in kelvin. Kelvin is used so that 0 °C can be told apart
+// from a missing reading.
+type Temperature float64
+
+// Volume in liters.
+type Volume float64
+
+// VolumeRate in liters per minute, used for SAC rates.
+type VolumeRate float64
+
+// Weight in kilograms.
+type Weight float64
+
+// Density in grams per liter, used for water salinity.
+type Density float64
+
+// Fraction of a gas in a mix, in percent.
+type Fraction float64
+
+const (
+	zeroCelsius = 273.15
+
+	DensityFreshWater Density = 1000
+	DensitySaltWater  Density = 1030
+)
+
+func ParseDepth(s string) (Depth, error) {
+	v, err := parseQuantity(s, "depth", "m")
+	return Depth(v), err
+}
+
+func ParsePressure(s string) (Pressure, error) {
+	v, err := parseQuantity(s, "pressure", "bar")
+	return Pressure(v), err
+}
+
+// ParseTemperature accepts degrees Celsius ("24.0 C") and kelvin ("297.15 K").
+func ParseTemperature(s string) (Temperature, error) {
+	if strings.HasSuffix(strings.TrimSpace(s), "K") {
+		v, err := parseQuantity(s, "temperature", "K")
+		return Temperature(v), err
+	}
+	v, err := parseQuantity(s, "temperature", "°C", "C")
+	if err != nil || strings.TrimSpace(s) == "" {
+		return 0, err
+	}
+	return Temperature(v + zeroCelsius), nil
+}
+
+func ParseVolume(s string) (Volume, error) {
+	v, err := parseQuantity(s, "volume", "l")
+	return Volume(v), err
+}
+
+func ParseVolumeRate(s string) (VolumeRate, error) {
+	v, err := parseQuantity(s, "volume rate", "l/min")
+	return VolumeRate(v), err
+}
+
+func ParseWeight(s string) (Weight, error) {
+	v, err := parseQuantity(s, "weight", "kg")
+	return Weight(v), err
+}
+
+func ParseDensity(s string) (Density, error) {
+	v, err := parseQuantity(s, "density", "g/l")
+	return Density(v), err
+}
+
+func ParseFraction(s string) (Fraction, error) {
+	v, err := parseQuantity(s, "fraction", "%")
+	return Fraction(v), err
+}
+
+// ParseDuration parses Subsurface durations such as "45:30 min", "1:05:30 min"
+// or "12 min". An empty string yields a zero duration.
+func ParseDuration(s string) (time.Duration, error) {
+	trimmed := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), "min"))
+	if trimmed == "" {
+		return 0, nil
+	}
+
+	parts := strings.Split(trimmed, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("%w: duration %q", ErrInvalidValue, s)
+	}
+	// the first part is minutes for "mm:ss" and hours for "hh:mm:ss"
+	units := []time.Duration{time.Minute, time.Second}
+	if len(parts) == 3 {
+		units = []time.Duration{time.Hour, time.Minute, time.Second}
+	}
+
+	var d time.Duration
+	for i, part := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("%w: duration %q", ErrInvalidValue, s)
+		}
+		d += time.Duration(n) * units[i]
+	}
+	return d, nil
+}
+
+// FormatDuration formats a duration the way Subsurface does, e.g. "45:30 min".
+// A zero duration is formatted as an empty string.
+func FormatDuration(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return formatMinutes(d)
+}
+
+func formatMinutes(d time.Duration) string {
+	seconds := int(d.Round(time.Second).Seconds())
+	return fmt.Sprintf("%d:%02d min", seconds/60, seconds%60)
+}
+
+func (d Depth) String() string {
+	return formatQuantity(float64(d), "m")
+}
+
+func (p Pressure) String() string {
+	return formatQuantity(float64(p), "bar")
+}
+
+func (t Temperature) Celsius() float64 {
+	return float64(t) - zeroCelsius
+}
+
+func (t Temperature) String() string {
+	if t == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%.1f °C", t.Celsius())
+}
+
+func (v Volume) String() string {
+	return formatQuantity(float64(v), "l")
+}
+
+func (r VolumeRate) String() string {
+	return formatQuantity(float64(r), "l/min")
+}
+
+func (w Weight) String() string {
+	return formatQuantity(float64(w), "kg")
+}
+
+func (d Density) String() string {
+	if d == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(float64(d), 'f', 0, 64) + " g/l"
+}
+
+func (f Fraction) String() string {
+	if f == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(float64(f), 'f', -1, 64) + "%"
+}
+
+// parseQuantity parses a decimal value followed by one of the optional unit
+// suffixes, e.g. "30.5 m". An empty string yields zero.
+func parseQuantity(s string, kind string, suffixes ...string) (float64, error) {
+	trimmed := strings.TrimSpace(s)
+	for _, suffix := range suffixes {
+		if after, ok := strings.CutSuffix(trimmed, suffix); ok {
+			trimmed = strings.TrimSpace(after)
+			break
+		}
+	}
+	if trimmed == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseFloat(trimmed, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s %q", ErrInvalidValue, kind, s)
+	}
+	return v, nil
+}
+
+// formatQuantity formats a value with at least one decimal, e.g. "200.0 bar"
+// or "1.013 bar". Zero values are formatted as an empty string.
+func formatQuantity(v float64, unit string) string {
+	if v == 0 {
+		return ""
+	}
+	return formatDecimal(v) + " " + unit
+}
+
+func formatDecimal(v float64) string {
+	s := strconv.FormatFloat(v, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
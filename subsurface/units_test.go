@@ -0,0 +1,158 @@
+package subsurface
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseQuantities(t *testing.T) {
+	parsers := map[string]func(string) (float64, error){
+		"depth": func(s string) (float64, error) {
+			v, err := ParseDepth(s)
+			return float64(v), err
+		},
+		"pressure": func(s string) (float64, error) {
+			v, err := ParsePressure(s)
+			return float64(v), err
+		},
+		"temperature": func(s string) (float64, error) {
+			v, err := ParseTemperature(s)
+			return float64(v), err
+		},
+		"volume": func(s string) (float64, error) {
+			v, err := ParseVolume(s)
+			return float64(v), err
+		},
+		"volume rate": func(s string) (float64, error) {
+			v, err := ParseVolumeRate(s)
+			return float64(v), err
+		},
+		"weight": func(s string) (float64, error) {
+			v, err := ParseWeight(s)
+			return float64(v), err
+		},
+		"density": func(s string) (float64, error) {
+			v, err := ParseDensity(s)
+			return float64(v), err
+		},
+		"fraction": func(s string) (float64, error) {
+			v, err := ParseFraction(s)
+			return float64(v), err
+		},
+	}
+
+	for _, tc := range []struct {
+		kind  string
+		input string
+		want  float64
+		fails bool
+	}{
+		{kind: "depth", input: "30.5 m", want: 30.5},
+		{kind: "depth", input: "30.5m", want: 30.5},
+		{kind: "depth", input: " 12 ", want: 12},
+		{kind: "depth", input: "", want: 0},
+		{kind: "depth", input: " m", want: 0},
+		{kind: "depth", input: "30.5 ft", fails: true},
+		{kind: "depth", input: "deep", fails: true},
+		{kind: "pressure", input: "200.0 bar", want: 200},
+		{kind: "pressure", input: "1.013bar", want: 1.013},
+		{kind: "pressure", input: "200 psi", fails: true},
+		{kind: "temperature", input: "24.0 C", want: 24 + zeroCelsius},
+		{kind: "temperature", input: "24 °C", want: 24 + zeroCelsius},
+		{kind: "temperature", input: "0.0 C", want: zeroCelsius},
+		{kind: "temperature", input: "-1.5 C", want: -1.5 + zeroCelsius},
+		{kind: "temperature", input: "297.15 K", want: 297.15},
+		{kind: "temperature", input: "", want: 0},
+		{kind: "temperature", input: "75 F", fails: true},
+		{kind: "temperature", input: "warm K", fails: true},
+		{kind: "volume", input: "11.1 l", want: 11.1},
+		{kind: "volume", input: "11.1 cuft", fails: true},
+		{kind: "volume rate", input: "15.25 l/min", want: 15.25},
+		{kind: "volume rate", input: "15.25 l", fails: true},
+		{kind: "weight", input: "6.0 kg", want: 6},
+		{kind: "weight", input: "6 lb", fails: true},
+		{kind: "density", input: "1030 g/l", want: 1030},
+		{kind: "density", input: "salt", fails: true},
+		{kind: "fraction", input: "32.0%", want: 32},
+		{kind: "fraction", input: "32", want: 32},
+		{kind: "fraction", input: "0.32 ratio", fails: true},
+	} {
+		got, err := parsers[tc.kind](tc.input)
+		switch {
+		case tc.fails:
+			if !errors.Is(err, ErrInvalidValue) {
+				t.Errorf("%s %q: err = %v, want %v", tc.kind, tc.input, err, ErrInvalidValue)
+			}
+		case err != nil:
+			t.Errorf("%s %q: %v", tc.kind, tc.input, err)
+		case math.Abs(got-tc.want) > 1e-9:
+			t.Errorf("%s %q = %v, want %v", tc.kind, tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		want  time.Duration
+		fails bool
+	}{
+		{input: "45:30 min", want: 45*time.Minute + 30*time.Second},
+		{input: "1:05:30 min", want: time.Hour + 5*time.Minute + 30*time.Second},
+		{input: "12 min", want: 12 * time.Minute},
+		{input: "0:07", want: 7 * time.Second},
+		{input: "", want: 0},
+		{input: " min", want: 0},
+		{input: "1:2:3:4 min", fails: true},
+		{input: "ab:00 min", fails: true},
+		{input: "-1:00 min", fails: true},
+		{input: "45.5 min", fails: true},
+	} {
+		got, err := ParseDuration(tc.input)
+		switch {
+		case tc.fails:
+			if !errors.Is(err, ErrInvalidValue) {
+				t.Errorf("%q: err = %v, want %v", tc.input, err, ErrInvalidValue)
+			}
+		case err != nil:
+			t.Errorf("%q: %v", tc.input, err)
+		case got != tc.want:
+			t.Errorf("%q = %v, want %v", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestFormatQuantities(t *testing.T) {
+	for _, tc := range []struct {
+		got  string
+		want string
+	}{
+		{formatDecimal(200), "200.0"},
+		{formatDecimal(1.013), "1.013"},
+		{formatDecimal(-2), "-2.0"},
+		{formatDecimal(0), "0.0"},
+		{Depth(30.5).String(), "30.5 m"},
+		{Depth(0).String(), ""},
+		{Pressure(200).String(), "200.0 bar"},
+		{Temperature(24 + zeroCelsius).String(), "24.0 °C"},
+		{Temperature(zeroCelsius).String(), "0.0 °C"},
+		{Temperature(0).String(), ""},
+		{Volume(11.1).String(), "11.1 l"},
+		{VolumeRate(15).String(), "15.0 l/min"},
+		{Weight(6).String(), "6.0 kg"},
+		{Density(1030).String(), "1030 g/l"},
+		{Density(0).String(), ""},
+		{Fraction(32).String(), "32%"},
+		{Fraction(0).String(), ""},
+		{FormatDuration(45*time.Minute + 30*time.Second), "45:30 min"},
+		{FormatDuration(65 * time.Minute), "65:00 min"},
+		{FormatDuration(59600 * time.Millisecond), "1:00 min"},
+		{FormatDuration(0), ""},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("got %q, want %q", tc.got, tc.want)
+		}
+	}
+}
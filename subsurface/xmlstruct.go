@@ -4,6 +4,32 @@ import (
 	"encoding/xml"
 )
 
+type SettingsXML struct {
+	DiveComputerIDs []DiveComputerIDXML `xml:"divecomputerid"`
+	Fingerprints    []FingerprintXML    `xml:"fingerprint"`
+	AutoGroup       *AutoGroupXML       `xml:"autogroup"`
+}
+
+type DiveComputerIDXML struct {
+	Model    string `xml:"model,attr"`
+	DeviceID string `xml:"deviceid,attr"`
+	Serial   string `xml:"serial,attr"`
+	Firmware string `xml:"firmware,attr"`
+	Nickname string `xml:"nickname,attr"`
+}
+
+type FingerprintXML struct {
+	Model    string `xml:"model,attr"`
+	Serial   string `xml:"serial,attr"`
+	DeviceID string `xml:"deviceid,attr"`
+	DiveID   string `xml:"diveid,attr"`
+	Data     string `xml:"data,attr"`
+}
+
+type AutoGroupXML struct {
+	State string `xml:"state,attr"`
+}
+
 type SiteXML struct {
 	XMLName     xml.Name `xml:"site"`
 	UUID        string   `xml:"uuid,attr"`
@@ -29,14 +55,23 @@ type DiveXML struct {
 	Date              string               `xml:"date,attr"`
 	Time              string               `xml:"time,attr"`
 	Duration          string               `xml:"duration,attr"`
+	Current           string               `xml:"current,attr"`
+	WaveSize          string               `xml:"wavesize,attr"`
+	Surge             string               `xml:"surge,attr"`
+	Chill             string               `xml:"chill,attr"`
+	Invalid           string               `xml:"invalid,attr"`
+	DiveMode          string               `xml:"divemode,attr"`
+	OTU               string               `xml:"otu,attr"`
+	CNS               string               `xml:"cns,attr"`
 	DiveMaster        string               `xml:"divemaster"`
 	Buddy             string               `xml:"buddy"`
 	Notes             string               `xml:"notes"`
 	Suit              string               `xml:"suit"`
-	Cylinder          CylinderXML          `xml:"cylinder"`
+	Cylinders         []CylinderXML        `xml:"cylinder"`
 	WeightSystem      WeightSystemXML      `xml:"weightsystem"`
 	TemperatureManual TemperatureManualXML `xml:"divetemperature"`
-	DiveComputer      DiveComputerXML      `xml:"divecomputer"`
+	DiveComputers     []DiveComputerXML    `xml:"divecomputer"`
+	Pictures          []PictureXML         `xml:"picture"`
 }
 
 type CylinderXML struct {
@@ -46,6 +81,8 @@ type CylinderXML struct {
 	Start        string `xml:"start,attr"`
 	End          string `xml:"end,attr"`
 	O2           string `xml:"o2,attr"`
+	He           string `xml:"he,attr"`
+	Use          string `xml:"use,attr"`
 }
 
 type WeightSystemXML struct {
@@ -62,9 +99,13 @@ type DiveComputerXML struct {
 	Model           string             `xml:"model,attr"`
 	DeviceID        string             `xml:"deviceid,attr"`
 	DiveID          string             `xml:"diveid,attr"`
+	DiveMode        string             `xml:"dctype,attr"`
 	DepthInfo       DepthInfoXML       `xml:"depth"`
 	TemperatureInfo TemperatureInfoXML `xml:"temperature"`
 	SurfaceInfo     SurfaceInfoXML     `xml:"surface"`
+	Events          []EventXML         `xml:"event"`
+	ExtraData       []ExtraDataXML     `xml:"extradata"`
+	Samples         []SampleXML        `xml:"sample"`
 }
 
 type DepthInfoXML struct {
@@ -79,3 +120,36 @@ type TemperatureInfoXML struct {
 type SurfaceInfoXML struct {
 	Pressure string `xml:"pressure,attr"`
 }
+
+type SampleXML struct {
+	Time        string `xml:"time,attr"`
+	Depth       string `xml:"depth,attr"`
+	Temperature string `xml:"temp,attr"`
+	Pressure    string `xml:"pressure,attr"`
+	Pressure0   string `xml:"pressure0,attr"`
+	NDL         string `xml:"ndl,attr"`
+	TTS         string `xml:"tts,attr"`
+	StopDepth   string `xml:"stopdepth,attr"`
+	InDeco      string `xml:"in_deco,attr"`
+	PO2         string `xml:"po2,attr"`
+}
+
+type EventXML struct {
+	Time     string `xml:"time,attr"`
+	Type     string `xml:"type,attr"`
+	Flags    string `xml:"flags,attr"`
+	Value    string `xml:"value,attr"`
+	Name     string `xml:"name,attr"`
+	Cylinder string `xml:"cylinder,attr"`
+}
+
+type ExtraDataXML struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type PictureXML struct {
+	Filename string `xml:"filename,attr"`
+	Offset   string `xml:"offset,attr"`
+	GPS      string `xml:"gps,attr"`
+}
@@ -0,0 +1,183 @@
+package suunto
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"src.acicovic.me/divelog/subsurface"
+)
+
+// Program is reported in the header, as SML files do not name the program
+// that wrote them.
+const Program = "Suunto SML"
+
+// SML files hold a single dive without a dive site, so the dive is reported at
+// a site of its own.
+const (
+	siteUUID = "sml"
+	siteName = "Unknown site"
+)
+
+var dateTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+}
+
+// Detect reports whether the buffered input is a Suunto SML document, by looking
+// for its root element in the buffer. The input is not consumed.
+func Detect(br *bufio.Reader) bool {
+	return subsurface.RootElement(br) == "sml"
+}
+
+// Decode decodes a Suunto SML document and reports its contents to the handler,
+// in the same way subsurface.DecodeSubsurfaceDatabase does for Subsurface databases.
+func Decode(r io.Reader, h subsurface.Handler) error {
+	if r == nil {
+		return subsurface.ErrNilReader
+	}
+	if h == nil {
+		return subsurface.ErrNilHandler
+	}
+
+	records, err := ReadRecords(r)
+	if err != nil {
+		return err
+	}
+	return subsurface.ReportRecordSlice(records, h)
+}
+
+// ReadRecords decodes a Suunto SML document (as exported by Suunto DM5 and
+// the Suunto app) into the records that subsurface.Reader produces for
+// Subsurface databases: a header, a dive site and the dive. Invalid values are
+// reported as a subsurface.DecodeError.
+func ReadRecords(r io.Reader) ([]subsurface.Record, error) {
+	var doc SMLXML
+	if err := subsurface.DecodeDocument(r, "sml", &doc); err != nil {
+		return nil, err
+	}
+
+	c := &converter{}
+	dive := c.convertDive("sml/DeviceLog", &doc.DeviceLog)
+	if c.Err != nil {
+		return nil, c.Err
+	}
+	return []subsurface.Record{
+		&subsurface.HeaderRecord{Program: Program},
+		&subsurface.SiteRecord{Index: 1, UUID: siteUUID, Name: siteName},
+		dive,
+	}, nil
+}
+
+type converter struct {
+	subsurface.ValueParser
+}
+
+func (c *converter) convertDive(path string, log *DeviceLogXML) *subsurface.DiveRecord {
+	var (
+		header = &log.Header
+		ddh    = subsurface.DiveDataHolder{
+			DiveTripID:           subsurface.IntNull,
+			DiveSiteUUID:         siteUUID,
+			Notes:                strings.TrimSpace(header.Notes),
+			DiveComputerModel:    strings.TrimSpace(log.Device.Name),
+			DiveComputerDeviceID: strings.TrimSpace(log.Device.SerialNumber),
+		}
+	)
+
+	if header.DateTime != "" {
+		ddh.DateTime = c.DateTime(path+"/Header/DateTime", header.DateTime, dateTimeLayouts)
+	}
+	ddh.Duration = subsurface.Seconds(c.Number(path+"/Header/Duration", header.Duration))
+	ddh.DepthMax = subsurface.Depth(c.Number(path+"/Header/Depth/Max", header.DepthMax))
+	ddh.DepthMean = subsurface.Depth(c.Number(path+"/Header/Depth/Avg", header.DepthAvg))
+	ddh.SurfacePressure = subsurface.PascalToBar(c.Number(path+"/Header/Diving/SurfacePressure", header.Diving.SurfacePressure))
+
+	// cylinder index by gas number, for the pressures in samples
+	var (
+		cylinders   = make(map[int]int)
+		endInHeader []bool // end pressure is in the header
+	)
+	for i, gas := range header.Diving.Gases {
+		gasPath := fmt.Sprintf("%s/Header/Diving/Gases/Gas[%d]", path, i+1)
+		if strings.EqualFold(strings.TrimSpace(gas.State), "Off") {
+			continue
+		}
+		cylinders[i] = len(ddh.Cylinders)
+		endInHeader = append(endInHeader, strings.TrimSpace(gas.EndPressure) != "")
+		ddh.Cylinders = append(ddh.Cylinders, subsurface.CylinderDataHolder{
+			Size:          cubicMetersToLiters(c.Number(gasPath+"/TankSize", gas.TankSize)),
+			WorkPressure:  subsurface.PascalToBar(c.Number(gasPath+"/TankFillPressure", gas.TankFillPressure)),
+			StartPressure: subsurface.PascalToBar(c.Number(gasPath+"/StartPressure", gas.StartPressure)),
+			EndPressure:   subsurface.PascalToBar(c.Number(gasPath+"/EndPressure", gas.EndPressure)),
+			O2:            subsurface.Fraction(100 * c.Number(gasPath+"/Oxygen", gas.Oxygen)),
+			He:            subsurface.Fraction(100 * c.Number(gasPath+"/Helium", gas.Helium)),
+		})
+	}
+
+	for i, sampleXML := range log.Samples {
+		samplePath := fmt.Sprintf("%s/Samples/Sample[%d]", path, i+1)
+		if strings.TrimSpace(sampleXML.Depth) == "" {
+			// samples with events only
+			continue
+		}
+		sample := subsurface.Sample{
+			Time:        subsurface.Seconds(c.Number(samplePath+"/Time", sampleXML.Time)),
+			Depth:       subsurface.Depth(c.Number(samplePath+"/Depth", sampleXML.Depth)),
+			Temperature: subsurface.Temperature(c.Number(samplePath+"/Temperature", sampleXML.Temperature)),
+		}
+		for j, cylXML := range sampleXML.Cylinders {
+			cylPath := fmt.Sprintf("%s/Cylinders/Cylinder[%d]", samplePath, j+1)
+			pressure := subsurface.PascalToBar(c.Number(cylPath+"/Pressure", cylXML.Pressure))
+			index, ok := cylinders[int(c.Number(cylPath+"/GasNumber", cylXML.GasNumber))]
+			if !ok || pressure == 0 {
+				continue
+			}
+			if index == 0 {
+				sample.Pressure = pressure
+			}
+			cyl := &ddh.Cylinders[index]
+			if cyl.StartPressure == 0 {
+				cyl.StartPressure = pressure
+			}
+			if !endInHeader[index] {
+				cyl.EndPressure = pressure
+			}
+		}
+		ddh.Samples = append(ddh.Samples, sample)
+	}
+
+	for _, sample := range ddh.Samples {
+		if sample.Depth > ddh.DepthMax {
+			ddh.DepthMax = sample.Depth
+		}
+		if sample.Temperature != 0 && (ddh.TemperatureWaterMin == 0 || sample.Temperature < ddh.TemperatureWaterMin) {
+			ddh.TemperatureWaterMin = sample.Temperature
+		}
+	}
+	if ddh.Duration == 0 && len(ddh.Samples) > 0 {
+		ddh.Duration = ddh.Samples[len(ddh.Samples)-1].Time
+	}
+
+	if len(ddh.Samples) > 0 || ddh.DepthMax != 0 {
+		ddh.DiveComputers = []subsurface.DiveComputerDataHolder{{
+			Primary:             true,
+			Model:               ddh.DiveComputerModel,
+			DeviceID:            ddh.DiveComputerDeviceID,
+			DepthMax:            ddh.DepthMax,
+			DepthMean:           ddh.DepthMean,
+			TemperatureWaterMin: ddh.TemperatureWaterMin,
+			SurfacePressure:     ddh.SurfacePressure,
+			Samples:             ddh.Samples,
+		}}
+	}
+
+	return &subsurface.DiveRecord{DiveDataHolder: ddh}
+}
+
+func cubicMetersToLiters(v float64) subsurface.Volume {
+	return subsurface.Volume(v * 1000)
+}
@@ -0,0 +1,61 @@
+package suunto
+
+import (
+	"encoding/xml"
+)
+
+// SML uses SI units: meters, kelvin, pascal, cubic meters and seconds; gas
+// contents are fractions of one.
+
+type SMLXML struct {
+	XMLName   xml.Name     `xml:"sml"`
+	DeviceLog DeviceLogXML `xml:"DeviceLog"`
+}
+
+type DeviceLogXML struct {
+	Header  HeaderXML   `xml:"Header"`
+	Device  DeviceXML   `xml:"Device"`
+	Samples []SampleXML `xml:"Samples>Sample"`
+}
+
+type HeaderXML struct {
+	DateTime string    `xml:"DateTime"`
+	Duration string    `xml:"Duration"`
+	DepthMax string    `xml:"Depth>Max"`
+	DepthAvg string    `xml:"Depth>Avg"`
+	Notes    string    `xml:"Notes"`
+	Diving   DivingXML `xml:"Diving"`
+}
+
+type DivingXML struct {
+	SurfacePressure string   `xml:"SurfacePressure"`
+	Gases           []GasXML `xml:"Gases>Gas"`
+}
+
+type GasXML struct {
+	State            string `xml:"State"`
+	Oxygen           string `xml:"Oxygen"`
+	Helium           string `xml:"Helium"`
+	TankSize         string `xml:"TankSize"`
+	TankFillPressure string `xml:"TankFillPressure"`
+	StartPressure    string `xml:"StartPressure"`
+	EndPressure      string `xml:"EndPressure"`
+}
+
+type DeviceXML struct {
+	Name         string `xml:"Name"`
+	SerialNumber string `xml:"SerialNumber"`
+	Software     string `xml:"Info>SW"`
+}
+
+type SampleXML struct {
+	Time        string              `xml:"Time"`
+	Depth       string              `xml:"Depth"`
+	Temperature string              `xml:"Temperature"`
+	Cylinders   []CylinderSampleXML `xml:"Cylinders>Cylinder"`
+}
+
+type CylinderSampleXML struct {
+	GasNumber string `xml:"GasNumber"`
+	Pressure  string `xml:"Pressure"`
+}
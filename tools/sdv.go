@@ -1,22 +1,42 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"os"
 	"path/filepath"
 	"time"
 
+	"src.acicovic.me/divelog/divecsv"
+	"src.acicovic.me/divelog/fit"
+	"src.acicovic.me/divelog/shearwater"
 	"src.acicovic.me/divelog/subsurface"
+	"src.acicovic.me/divelog/suunto"
+	"src.acicovic.me/divelog/uddf"
 )
 
 // Subsurface Decoder Validator
 
 func main() {
 	if len(os.Args) != 2 {
-		fmt.Println("provide file name as the first program argument")
+		fmt.Println("provide file name or git storage directory as the first program argument")
 		os.Exit(0x1)
 	}
 
+	if subsurface.IsGitStorage(os.Args[1]) {
+		storage, err := subsurface.OpenGitStorage(os.Args[1])
+		if err != nil {
+			fmt.Printf("failed to open git storage: %v\n", err)
+			os.Exit(0x2)
+		}
+		defer subsurface.CloseGitStorage(storage)
+		if err := subsurface.DecodeGitStorage(storage, Handler{fname: os.Args[1]}); err != nil {
+			fmt.Printf("decoding error: %v\n", err)
+			os.Exit(0x3)
+		}
+		return
+	}
+
 	file, err := os.Open(os.Args[1])
 	if err != nil {
 		fmt.Printf("failed to open file: %v\n", err)
@@ -24,7 +44,27 @@ func main() {
 	}
 	defer file.Close()
 
-	if err := subsurface.DecodeSubsurfaceDatabase(file, Handler{fname: os.Args[1]}); err != nil {
+	database, err := subsurface.Decompress(file, subsurface.MaxDecompressedSize)
+	if err != nil {
+		fmt.Printf("failed to read file: %v\n", err)
+		os.Exit(0x2)
+	}
+
+	br := bufio.NewReader(database)
+	if divecsv.IsCSV(os.Args[1]) {
+		err = divecsv.Decode(br, divecsv.DefaultMapping(), Handler{fname: os.Args[1]})
+	} else if fit.Detect(br) {
+		err = fit.Decode(br, Handler{fname: os.Args[1]})
+	} else if uddf.Detect(br) {
+		err = uddf.Decode(br, Handler{fname: os.Args[1]})
+	} else if suunto.Detect(br) {
+		err = suunto.Decode(br, Handler{fname: os.Args[1]})
+	} else if shearwater.Detect(br) {
+		err = shearwater.Decode(br, Handler{fname: os.Args[1]})
+	} else {
+		err = subsurface.DecodeSubsurfaceDatabase(br, Handler{fname: os.Args[1]})
+	}
+	if err != nil {
 		fmt.Printf("decoding error: %v\n", err)
 		os.Exit(0x3)
 	}
@@ -53,6 +93,21 @@ func (h Handler) HandleHeader(program string, version string) {
 
 }
 
+func (h Handler) HandleSettings(settings subsurface.Settings) {
+	fmt.Printf("\tSETTINGS\n")
+	for _, dc := range settings.DiveComputers {
+		fmt.Printf("\t\tDIVE_COMPUTER_ID\n")
+		fmt.Printf("\t\t\tMODEL = %q\n\t\t\tDEVICE_ID = %q\n\t\t\tSERIAL = %q\n\t\t\tFIRMWARE = %q\n\t\t\tNICKNAME = %q\n",
+			dc.Model, dc.DeviceID, dc.Serial, dc.Firmware, dc.Nickname)
+	}
+	for _, fp := range settings.Fingerprints {
+		fmt.Printf("\t\tFINGERPRINT\n")
+		fmt.Printf("\t\t\tMODEL = %q\n\t\t\tSERIAL = %q\n\t\t\tDEVICE_ID = %q\n\t\t\tDIVE_ID = %q\n\t\t\tDATA = %q\n",
+			fp.Model, fp.Serial, fp.DeviceID, fp.DiveID, fp.Data)
+	}
+	fmt.Printf("\t\tAUTOGROUP = %t\n", settings.AutoGroup)
+}
+
 func (h Handler) HandleDiveSite(uuid string, name string, coords string, description string) int {
 	fmt.Printf("\tDIVE_SITE\n")
 	fmt.Printf("\t\tUUID = %q\n\t\tNAME = %q\n\t\tCOORDS = %q\n\t\tDESCRIPTION = %q\n", uuid, name, coords, description)
@@ -61,7 +116,7 @@ func (h Handler) HandleDiveSite(uuid string, name string, coords string, descrip
 
 func (h Handler) HandleGeoData(id int, cat int, label string) {
 	fmt.Printf("\t\tGEO_DATA\n")
-	fmt.Printf("\t\t\tCATEGORY = %d\n\t\t\tLABEL = %q\n", cat, label)
+	fmt.Printf("\t\t\tCATEGORY = %d (%s)\n\t\t\tLABEL = %q\n", cat, subsurface.TaxonomyCategoryName(cat), label)
 }
 
 func (h Handler) HandleDiveTrip(label string) int {
@@ -83,17 +138,22 @@ func (h Handler) HandleDive(ddh subsurface.DiveDataHolder) int {
 	}
 	fmt.Printf("\t\t\tWATER_SALINITY = %q\n", ddh.WaterSalinity)
 	fmt.Printf("\t\t\tDATE_TIME = %s\n", ddh.DateTime.Format(time.RFC1123Z))
-	fmt.Printf("\t\t\tDURATION = %q\n", ddh.Duration)
+	fmt.Printf("\t\t\tDURATION = %q\n", subsurface.FormatDuration(ddh.Duration))
 	fmt.Printf("\t\t\tDIVE_OPERATOR = %q\n", ddh.DiveMasterOrOperator)
 	fmt.Printf("\t\t\tBUDDY = %q\n", ddh.Buddy)
 	fmt.Printf("\t\t\tNOTES = %q\n", ddh.Notes)
 	fmt.Printf("\t\t\tSUIT = %q\n", ddh.Suit)
-	fmt.Printf("\t\t\tCYL_SIZE = %q\n", ddh.CylinderSize)
-	fmt.Printf("\t\t\tCYL_WP = %q\n", ddh.CylinderWorkPressure)
-	fmt.Printf("\t\t\tCYL_DESC = %q\n", ddh.CylinderDescription)
-	fmt.Printf("\t\t\tCYL_START = %q\n", ddh.CylinderStartPressure)
-	fmt.Printf("\t\t\tCYL_END = %q\n", ddh.CylinderEndPressure)
-	fmt.Printf("\t\t\tCYL_GAS = %q\n", ddh.CylinderGas)
+	for i, cyl := range ddh.Cylinders {
+		fmt.Printf("\t\t\tCYLINDER %d\n", i)
+		fmt.Printf("\t\t\t\tSIZE = %q\n", cyl.Size)
+		fmt.Printf("\t\t\t\tWP = %q\n", cyl.WorkPressure)
+		fmt.Printf("\t\t\t\tDESC = %q\n", cyl.Description)
+		fmt.Printf("\t\t\t\tSTART = %q\n", cyl.StartPressure)
+		fmt.Printf("\t\t\t\tEND = %q\n", cyl.EndPressure)
+		fmt.Printf("\t\t\t\tO2 = %q\n", cyl.O2)
+		fmt.Printf("\t\t\t\tHE = %q\n", cyl.He)
+		fmt.Printf("\t\t\t\tUSE = %q\n", cyl.Use)
+	}
 	fmt.Printf("\t\t\tWEIGHT = %q\n", ddh.Weight)
 	fmt.Printf("\t\t\tWEIGHT_TYPE = %q\n", ddh.WeightType)
 	fmt.Printf("\t\t\tDC_MODEL = %q\n", ddh.DiveComputerModel)
@@ -104,5 +164,38 @@ func (h Handler) HandleDive(ddh subsurface.DiveDataHolder) int {
 	fmt.Printf("\t\t\tTEMP_WATER_MIN = %q\n", ddh.TemperatureWaterMin)
 	fmt.Printf("\t\t\tTEMP_AIR = %q\n", ddh.TemperatureAir)
 	fmt.Printf("\t\t\tSURFACE_PRESSURE = %q\n", ddh.SurfacePressure)
+	fmt.Printf("\t\t\tCURRENT = %d\n", ddh.Current)
+	fmt.Printf("\t\t\tWAVESIZE = %d\n", ddh.WaveSize)
+	fmt.Printf("\t\t\tSURGE = %d\n", ddh.Surge)
+	fmt.Printf("\t\t\tCHILL = %d\n", ddh.Chill)
+	fmt.Printf("\t\t\tINVALID = %t\n", ddh.Invalid)
+	fmt.Printf("\t\t\tDIVE_MODE = %q\n", ddh.DiveMode)
+	fmt.Printf("\t\t\tOTU = %d\n", ddh.OTU)
+	fmt.Printf("\t\t\tCNS = %d%%\n", ddh.CNS)
+	for _, ed := range ddh.ExtraData {
+		fmt.Printf("\t\t\tEXTRA_DATA %q = %q\n", ed.Key, ed.Value)
+	}
+	for _, event := range ddh.Events {
+		fmt.Printf("\t\t\tEVENT %s\n", event.Time)
+		fmt.Printf("\t\t\t\tNAME = %q\n\t\t\t\tTYPE = %d\n\t\t\t\tFLAGS = %d\n\t\t\t\tVALUE = %d\n\t\t\t\tCYLINDER = %d\n",
+			event.TypeName(), event.Type, event.Flags, event.Value, event.Cylinder)
+	}
+	for _, picture := range ddh.Pictures {
+		fmt.Printf("\t\t\tPICTURE %s\n", picture.Offset)
+		fmt.Printf("\t\t\t\tFILENAME = %q\n\t\t\t\tGPS = %q\n", picture.Filename, picture.Coords)
+	}
+	for i, dc := range ddh.DiveComputers {
+		fmt.Printf("\t\t\tDIVE_COMPUTER %d\n", i)
+		fmt.Printf("\t\t\t\tPRIMARY = %t\n", dc.Primary)
+		fmt.Printf("\t\t\t\tMODEL = %q\n", dc.Model)
+		fmt.Printf("\t\t\t\tDEVICE_ID = %q\n", dc.DeviceID)
+		fmt.Printf("\t\t\t\tDIVE_ID = %q\n", dc.DiveID)
+		fmt.Printf("\t\t\t\tDIVE_MODE = %q\n", dc.DiveMode)
+		fmt.Printf("\t\t\t\tDEPTH_MAX = %q\n", dc.DepthMax)
+		fmt.Printf("\t\t\t\tDEPTH_MEAN = %q\n", dc.DepthMean)
+		fmt.Printf("\t\t\t\tTEMP_WATER_MIN = %q\n", dc.TemperatureWaterMin)
+		fmt.Printf("\t\t\t\tSAMPLES = %d\n", len(dc.Samples))
+		fmt.Printf("\t\t\t\tEVENTS = %d\n", len(dc.Events))
+	}
 	return 0
 }
@@ -0,0 +1,349 @@
+package uddf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"src.acicovic.me/divelog/subsurface"
+)
+
+// Geo taxonomy categories, as Subsurface numbers them.
+const (
+	geoCountry   = 2
+	geoProvince  = 3
+	geoLocalName = 5
+)
+
+var dateTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	time.DateOnly,
+}
+
+// Detect reports whether the buffered input is a UDDF document, by looking for
+// its root element in the buffer. The input is not consumed.
+func Detect(br *bufio.Reader) bool {
+	return subsurface.RootElement(br) == "uddf"
+}
+
+// Decode decodes a UDDF document and reports its contents to the handler, in
+// the same way subsurface.DecodeSubsurfaceDatabase does for Subsurface databases.
+func Decode(r io.Reader, h subsurface.Handler) error {
+	if r == nil {
+		return subsurface.ErrNilReader
+	}
+	if h == nil {
+		return subsurface.ErrNilHandler
+	}
+
+	records, err := ReadRecords(r)
+	if err != nil {
+		return err
+	}
+	return subsurface.ReportRecordSlice(records, h)
+}
+
+// ReadRecords decodes a UDDF document into the records that subsurface.Reader
+// produces for Subsurface databases. Dive sites come first, followed by trips
+// and dives in chronological order; the dives of a trip follow the trip.
+// Invalid values are reported as a subsurface.DecodeError.
+func ReadRecords(r io.Reader) ([]subsurface.Record, error) {
+	var doc UDDFXML
+	if err := subsurface.DecodeDocument(r, "uddf", &doc); err != nil {
+		return nil, err
+	}
+
+	c := newConverter(&doc)
+	return c.convert()
+}
+
+type converter struct {
+	doc     *UDDFXML
+	mixes   map[string]MixXML
+	buddies map[string]string
+	sites   map[string]bool
+	trips   map[string]int // dive ID to trip index
+	subsurface.ValueParser
+}
+
+func newConverter(doc *UDDFXML) *converter {
+	c := &converter{
+		doc:     doc,
+		mixes:   make(map[string]MixXML),
+		buddies: make(map[string]string),
+		sites:   make(map[string]bool),
+		trips:   make(map[string]int),
+	}
+	for _, mix := range doc.GasDefinitions.Mixes {
+		c.mixes[mix.ID] = mix
+	}
+	for _, buddy := range doc.Diver.Buddies {
+		name := strings.Join(strings.Fields(buddy.FirstName+" "+buddy.MiddleName+" "+buddy.LastName), " ")
+		c.buddies[buddy.ID] = name
+	}
+	for _, site := range doc.DiveSite.Sites {
+		c.sites[site.ID] = true
+	}
+	for i, trip := range doc.DiveTrip.Trips {
+		for _, part := range trip.Parts {
+			for _, link := range part.RelatedDives {
+				c.trips[link.Ref] = i + 1
+			}
+		}
+	}
+	return c
+}
+
+// group is a trip with its dives, or a single dive that is not part of a trip.
+type group struct {
+	trip  *subsurface.TripRecord
+	dives []*subsurface.DiveRecord
+}
+
+func (g *group) start() time.Time {
+	if len(g.dives) == 0 {
+		return time.Time{}
+	}
+	return g.dives[0].DateTime
+}
+
+func (c *converter) convert() ([]subsurface.Record, error) {
+	records := []subsurface.Record{&subsurface.HeaderRecord{
+		Program: c.doc.Generator.Name,
+		Version: c.doc.Generator.Version,
+	}}
+	for _, other := range c.doc.Other {
+		records = append(records, &subsurface.SkipRecord{Element: other.XMLName.Local})
+	}
+
+	for i, site := range c.doc.DiveSite.Sites {
+		records = append(records, c.convertSite(i+1, &site)...)
+	}
+	if c.Err != nil {
+		return nil, c.Err
+	}
+
+	var (
+		groups []*group
+		trips  = make([]*group, len(c.doc.DiveTrip.Trips))
+	)
+	for i, trip := range c.doc.DiveTrip.Trips {
+		label := trip.Name
+		if label == "" && len(trip.Parts) > 0 {
+			label = trip.Parts[0].Name
+		}
+		trips[i] = &group{trip: &subsurface.TripRecord{Index: i + 1, Label: label}}
+		groups = append(groups, trips[i])
+	}
+
+	for i, rg := range c.doc.ProfileData.RepetitionGroups {
+		for j, dive := range rg.Dives {
+			path := fmt.Sprintf("uddf/profiledata/repetitiongroup[%d]/dive[%d]", i+1, j+1)
+			record := c.convertDive(path, &dive)
+			if c.Err != nil {
+				return nil, c.Err
+			}
+			if record.DiveTripID == subsurface.IntNull {
+				groups = append(groups, &group{dives: []*subsurface.DiveRecord{record}})
+			} else {
+				trip := trips[record.DiveTripID-1]
+				trip.dives = append(trip.dives, record)
+			}
+		}
+	}
+
+	for _, g := range groups {
+		slices.SortStableFunc(g.dives, func(a, b *subsurface.DiveRecord) int {
+			return a.DateTime.Compare(b.DateTime)
+		})
+	}
+	slices.SortStableFunc(groups, func(a, b *group) int {
+		return a.start().Compare(b.start())
+	})
+	for _, g := range groups {
+		if g.trip != nil {
+			records = append(records, g.trip)
+		}
+		for _, dive := range g.dives {
+			records = append(records, dive)
+		}
+	}
+
+	return records, nil
+}
+
+func (c *converter) convertSite(index int, site *SiteXML) []subsurface.Record {
+	path := fmt.Sprintf("uddf/divesite/site[%d]", index)
+	geography := &site.Geography
+
+	var coords string
+	if geography.Latitude != "" && geography.Longitude != "" {
+		lat := c.Number(path+"/geography/latitude", geography.Latitude)
+		lon := c.Number(path+"/geography/longitude", geography.Longitude)
+		coords = fmt.Sprintf("%.6f %.6f", lat, lon)
+	}
+
+	records := []subsurface.Record{&subsurface.SiteRecord{
+		Index:       index,
+		UUID:        site.ID,
+		Name:        site.Name,
+		Coords:      coords,
+		Description: joinParagraphs(site.Notes),
+	}}
+	for _, geo := range []struct {
+		cat   int
+		label string
+	}{
+		{geoCountry, geography.Address.Country},
+		{geoProvince, geography.Address.Province},
+		{geoLocalName, geography.Address.City},
+		{geoLocalName, geography.Location},
+	} {
+		if label := strings.TrimSpace(geo.label); label != "" {
+			records = append(records, &subsurface.GeoRecord{
+				SiteIndex: index,
+				SiteUUID:  site.ID,
+				Cat:       geo.cat,
+				Label:     label,
+			})
+		}
+	}
+	return records
+}
+
+func (c *converter) convertDive(path string, dive *DiveXML) *subsurface.DiveRecord {
+	var (
+		before = &dive.Before
+		after  = &dive.After
+		ddh    = subsurface.DiveDataHolder{
+			DiveTripID: c.trips[dive.ID],
+			Notes:      joinParagraphs(after.Notes),
+		}
+		buddies []string
+	)
+
+	if before.DiveNumber != "" {
+		ddh.DiveNumber = int(c.Number(path+"/informationbeforedive/divenumber", before.DiveNumber))
+	}
+	for _, link := range before.Links {
+		if c.sites[link.Ref] && ddh.DiveSiteUUID == "" {
+			ddh.DiveSiteUUID = link.Ref
+		} else if name, ok := c.buddies[link.Ref]; ok && name != "" {
+			buddies = append(buddies, name)
+		}
+	}
+	ddh.Buddy = strings.Join(buddies, ", ")
+
+	if before.DateTime != "" {
+		ddh.DateTime = c.DateTime(path+"/informationbeforedive/datetime", before.DateTime, dateTimeLayouts)
+	}
+	ddh.TemperatureAir = subsurface.Temperature(c.Number(path+"/informationbeforedive/airtemperature", before.AirTemperature))
+	ddh.SurfacePressure = subsurface.PascalToBar(c.Number(path+"/informationbeforedive/atmosphericpressure", before.AtmosphericPressure))
+
+	for i, tank := range dive.Tanks {
+		tankPath := fmt.Sprintf("%s/tankdata[%d]", path, i+1)
+		cyl := subsurface.CylinderDataHolder{
+			Size:          cubicMetersToLiters(c.Number(tankPath+"/tankvolume", tank.Volume)),
+			StartPressure: subsurface.PascalToBar(c.Number(tankPath+"/tankpressurebegin", tank.PressureBegin)),
+			EndPressure:   subsurface.PascalToBar(c.Number(tankPath+"/tankpressureend", tank.PressureEnd)),
+		}
+		for _, link := range tank.Links {
+			if mix, ok := c.mixes[link.Ref]; ok {
+				cyl.O2 = subsurface.Fraction(100 * c.Number(tankPath+"/mix/o2", mix.O2))
+				cyl.He = subsurface.Fraction(100 * c.Number(tankPath+"/mix/he", mix.He))
+			}
+		}
+		ddh.Cylinders = append(ddh.Cylinders, cyl)
+	}
+
+	ddh.DepthMax = subsurface.Depth(c.Number(path+"/informationafterdive/greatestdepth", after.GreatestDepth))
+	ddh.DepthMean = subsurface.Depth(c.Number(path+"/informationafterdive/averagedepth", after.AverageDepth))
+	ddh.Duration = subsurface.Seconds(c.Number(path+"/informationafterdive/diveduration", after.DiveDuration))
+	ddh.TemperatureWaterMin = subsurface.Temperature(c.Number(path+"/informationafterdive/lowesttemperature", after.LowestTemperature))
+	ddh.Weight = subsurface.Weight(c.Number(path+"/informationafterdive/equipmentused/leadquantity", after.LeadQuantity))
+	if after.Visibility != "" {
+		ddh.Visibility = visibilityStars(c.Number(path+"/informationafterdive/visibility", after.Visibility))
+	}
+	if after.Rating != "" {
+		// UDDF rates dives from 1 to 10, Subsurface from 1 to 5
+		rating := int(c.Number(path+"/informationafterdive/rating/ratingvalue", after.Rating))
+		ddh.Rating = (rating + 1) / 2
+	}
+
+	for i, point := range dive.Points {
+		ddh.Samples = append(ddh.Samples, c.convertWaypoint(fmt.Sprintf("%s/samples/waypoint[%d]", path, i+1), &point))
+	}
+
+	if len(ddh.Samples) > 0 || ddh.DepthMax != 0 {
+		ddh.DiveComputers = []subsurface.DiveComputerDataHolder{{
+			Primary:             true,
+			DepthMax:            ddh.DepthMax,
+			DepthMean:           ddh.DepthMean,
+			TemperatureWaterMin: ddh.TemperatureWaterMin,
+			SurfacePressure:     ddh.SurfacePressure,
+			Samples:             ddh.Samples,
+		}}
+	}
+
+	return &subsurface.DiveRecord{DiveDataHolder: ddh}
+}
+
+func (c *converter) convertWaypoint(path string, point *WaypointXML) subsurface.Sample {
+	sample := subsurface.Sample{
+		Time:        subsurface.Seconds(c.Number(path+"/divetime", point.DiveTime)),
+		Depth:       subsurface.Depth(c.Number(path+"/depth", point.Depth)),
+		Temperature: subsurface.Temperature(c.Number(path+"/temperature", point.Temperature)),
+		NDL:         subsurface.Seconds(c.Number(path+"/nodecotime", point.NoDecoTime)),
+		PO2:         subsurface.PascalToBar(c.Number(path+"/calculatedpo2", point.CalculatedPO2)),
+	}
+	if len(point.TankPressure) > 0 {
+		sample.Pressure = subsurface.PascalToBar(c.Number(path+"/tankpressure", point.TankPressure[0]))
+	}
+	if stop := point.DecoStop; stop != nil {
+		sample.InDeco = stop.Kind == "mandatory"
+		sample.Ceiling = subsurface.Depth(c.Number(path+"/decostop@decodepth", stop.Depth))
+	}
+	return sample
+}
+
+func joinParagraphs(notes NotesXML) string {
+	var paragraphs []string
+	for _, para := range notes.Paragraphs {
+		if trimmed := strings.TrimSpace(para); trimmed != "" {
+			paragraphs = append(paragraphs, trimmed)
+		}
+	}
+	return strings.Join(paragraphs, "\n")
+}
+
+// cubicMetersToLiters converts a tank volume. Some programs write liters
+// instead, which is easy to tell as no tank holds a cubic meter.
+func cubicMetersToLiters(v float64) subsurface.Volume {
+	if v >= 1 {
+		return subsurface.Volume(v)
+	}
+	return subsurface.Volume(v * 1000)
+}
+
+// visibilityStars maps visibility in meters to Subsurface's 1 to 5 stars.
+func visibilityStars(meters float64) int {
+	switch {
+	case meters <= 0:
+		return subsurface.IntNull
+	case meters < 3:
+		return 1
+	case meters < 6:
+		return 2
+	case meters < 12:
+		return 3
+	case meters < 20:
+		return 4
+	default:
+		return 5
+	}
+}
@@ -0,0 +1,176 @@
+package uddf
+
+import (
+	"bufio"
+	"errors"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"src.acicovic.me/divelog/subsurface"
+)
+
+func readFixture(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestDetect(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		want  bool
+	}{
+		{readFixture(t, "dives.uddf"), true},
+		{"<divelog program='subsurface' version='3'></divelog>", false},
+		{"not xml at all", false},
+	} {
+		if got := Detect(bufio.NewReader(strings.NewReader(tc.input))); got != tc.want {
+			t.Errorf("Detect(%.40q) = %v, want %v", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestReadRecords(t *testing.T) {
+	records, err := ReadRecords(strings.NewReader(readFixture(t, "dives.uddf")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		kinds []string
+		sites []*subsurface.SiteRecord
+		geo   []*subsurface.GeoRecord
+		trips []*subsurface.TripRecord
+		dives []*subsurface.DiveRecord
+	)
+	for _, record := range records {
+		switch rec := record.(type) {
+		case *subsurface.HeaderRecord:
+			kinds = append(kinds, "header")
+			if rec.Program != "Logbook" || rec.Version != "2.1" {
+				t.Errorf("header = %+v", rec)
+			}
+		case *subsurface.SkipRecord:
+			kinds = append(kinds, "skip")
+		case *subsurface.SiteRecord:
+			kinds = append(kinds, "site")
+			sites = append(sites, rec)
+		case *subsurface.GeoRecord:
+			kinds = append(kinds, "geo")
+			geo = append(geo, rec)
+		case *subsurface.TripRecord:
+			kinds = append(kinds, "trip")
+			trips = append(trips, rec)
+		case *subsurface.DiveRecord:
+			kinds = append(kinds, "dive")
+			dives = append(dives, rec)
+		}
+	}
+
+	// sites first, then the trip with its dives in chronological order, then
+	// the dive outside of the trip
+	want := "header site geo geo geo site trip dive dive dive"
+	if got := strings.Join(kinds, " "); got != want {
+		t.Fatalf("records = %s, want %s", got, want)
+	}
+
+	if sites[0].UUID != "site-bluehole" || sites[0].Name != "Blue Hole" ||
+		sites[0].Coords != "28.572000 34.537000" || sites[0].Description != "Deep sinkhole" {
+		t.Errorf("site 1 = %+v", sites[0])
+	}
+	if sites[1].Index != 2 || sites[1].Coords != "" {
+		t.Errorf("site 2 = %+v", sites[1])
+	}
+	if geo[0].Label != "Egypt" || geo[1].Label != "South Sinai" || geo[2].Label != "Dahab" || geo[2].SiteIndex != 1 {
+		t.Errorf("geo = %+v %+v %+v", geo[0], geo[1], geo[2])
+	}
+	if trips[0].Label != "Dahab" {
+		t.Errorf("trip = %+v", trips[0])
+	}
+
+	first := dives[0]
+	if first.DiveNumber != 1 || first.DiveTripID != 1 || first.DiveSiteUUID != "site-bluehole" {
+		t.Errorf("dive 1: number %d, trip %d, site %q", first.DiveNumber, first.DiveTripID, first.DiveSiteUUID)
+	}
+	if !first.DateTime.Equal(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("dive 1: date %v", first.DateTime)
+	}
+	if first.Buddy != "Ana Petrovic" || first.Notes != "Arch at 55 m" {
+		t.Errorf("dive 1: buddy %q, notes %q", first.Buddy, first.Notes)
+	}
+	if first.Duration != 45*time.Minute+30*time.Second || first.DepthMax != 30.5 || first.DepthMean != 18.2 {
+		t.Errorf("dive 1: duration %v, depth %v/%v", first.Duration, first.DepthMax, first.DepthMean)
+	}
+	if first.Rating != 4 || first.Visibility != 4 || first.Weight != 6 {
+		t.Errorf("dive 1: rating %d, visibility %d, weight %v", first.Rating, first.Visibility, first.Weight)
+	}
+	if first.TemperatureWaterMin.Celsius() != 24 || first.TemperatureAir.Celsius() != 30 || !near(float64(first.SurfacePressure), 1.013) {
+		t.Errorf("dive 1: water %v, air %v, surface %v", first.TemperatureWaterMin, first.TemperatureAir, first.SurfacePressure)
+	}
+
+	if len(first.Cylinders) != 2 {
+		t.Fatalf("dive 1: %d cylinders, want 2", len(first.Cylinders))
+	}
+	nitrox, air := first.Cylinders[0], first.Cylinders[1]
+	if !near(float64(nitrox.Size), 11.1) || nitrox.StartPressure != 200 || nitrox.EndPressure != 60 || nitrox.O2 != 32 {
+		t.Errorf("dive 1: cylinder 1 = %+v", nitrox)
+	}
+	if air.Size != 5.5 || air.EndPressure != 150 || air.O2 != 21 || air.He != 0 {
+		t.Errorf("dive 1: cylinder 2 = %+v", air)
+	}
+
+	if len(first.Samples) != 3 || len(first.DiveComputers) != 1 || len(first.DiveComputers[0].Samples) != 3 {
+		t.Fatalf("dive 1: %d samples, %d dive computers", len(first.Samples), len(first.DiveComputers))
+	}
+	if s := first.Samples[0]; s.Time != 10*time.Second || s.Depth != 2 || s.Temperature.Celsius() != 25 || s.Pressure != 200 {
+		t.Errorf("dive 1: sample 1 = %+v", s)
+	}
+	if s := first.Samples[1]; !s.InDeco || s.Ceiling != 6 || !near(float64(s.PO2), 1.3) {
+		t.Errorf("dive 1: sample 2 = %+v", s)
+	}
+
+	if dives[1].DiveNumber != 2 || dives[1].DiveTripID != 1 {
+		t.Errorf("dive 2: number %d, trip %d", dives[1].DiveNumber, dives[1].DiveTripID)
+	}
+	last := dives[2]
+	if last.DiveNumber != 3 || last.DiveTripID != subsurface.IntNull || last.DiveSiteUUID != "" {
+		t.Errorf("dive 3: number %d, trip %d, site %q", last.DiveNumber, last.DiveTripID, last.DiveSiteUUID)
+	}
+	if len(last.Cylinders) != 1 || last.Cylinders[0].Size != 12 || last.Cylinders[0].StartPressure != 0 {
+		t.Errorf("dive 3: cylinders = %+v", last.Cylinders)
+	}
+}
+
+func TestReadRecordsInvalidValue(t *testing.T) {
+	input := strings.Replace(readFixture(t, "dives.uddf"), "<greatestdepth>30.5<", "<greatestdepth>deep<", 1)
+	_, err := ReadRecords(strings.NewReader(input))
+
+	var decodeErr *subsurface.DecodeError
+	if !errors.As(err, &decodeErr) {
+		t.Fatalf("err = %v, want a DecodeError", err)
+	}
+	if want := "uddf/profiledata/repetitiongroup[1]/dive[2]/informationafterdive/greatestdepth"; decodeErr.Path != want {
+		t.Errorf("path = %q, want %q", decodeErr.Path, want)
+	}
+	if !errors.Is(err, subsurface.ErrInvalidValue) || !errors.Is(err, subsurface.ErrInvalidFormat) {
+		t.Errorf("err = %v, want an invalid value", err)
+	}
+}
+
+func TestReadRecordsMalformed(t *testing.T) {
+	input := readFixture(t, "dives.uddf")
+	_, err := ReadRecords(strings.NewReader(input[:len(input)/2]))
+	if !errors.Is(err, subsurface.ErrInvalidFormat) {
+		t.Errorf("err = %v, want an invalid format", err)
+	}
+}
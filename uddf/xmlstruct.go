@@ -0,0 +1,157 @@
+package uddf
+
+import (
+	"encoding/xml"
+)
+
+// UDDF uses SI units: meters, kelvin, pascal, cubic meters, seconds and
+// kilograms (see subsurface.ValueParser for why values are strings).
+
+type UDDFXML struct {
+	XMLName        xml.Name          `xml:"uddf"`
+	Version        string            `xml:"version,attr"`
+	Generator      GeneratorXML      `xml:"generator"`
+	Diver          DiverXML          `xml:"diver"`
+	GasDefinitions GasDefinitionsXML `xml:"gasdefinitions"`
+	DiveSite       DiveSiteXML       `xml:"divesite"`
+	ProfileData    ProfileDataXML    `xml:"profiledata"`
+	DiveTrip       DiveTripXML       `xml:"divetrip"`
+	Other          []OtherXML        `xml:",any"`
+}
+
+// OtherXML is a top-level element that is not decoded.
+type OtherXML struct {
+	XMLName xml.Name
+}
+
+type GeneratorXML struct {
+	Name    string `xml:"name"`
+	Version string `xml:"version"`
+}
+
+type DiverXML struct {
+	Buddies []PersonXML `xml:"buddy"`
+}
+
+type PersonXML struct {
+	ID         string `xml:"id,attr"`
+	FirstName  string `xml:"personal>firstname"`
+	MiddleName string `xml:"personal>middlename"`
+	LastName   string `xml:"personal>lastname"`
+}
+
+type GasDefinitionsXML struct {
+	Mixes []MixXML `xml:"mix"`
+}
+
+type MixXML struct {
+	ID   string `xml:"id,attr"`
+	Name string `xml:"name"`
+	O2   string `xml:"o2"`
+	He   string `xml:"he"`
+}
+
+type DiveSiteXML struct {
+	Sites []SiteXML `xml:"site"`
+}
+
+type SiteXML struct {
+	ID        string       `xml:"id,attr"`
+	Name      string       `xml:"name"`
+	Geography GeographyXML `xml:"geography"`
+	Notes     NotesXML     `xml:"notes"`
+}
+
+type GeographyXML struct {
+	Location  string     `xml:"location"`
+	Address   AddressXML `xml:"address"`
+	Latitude  string     `xml:"latitude"`
+	Longitude string     `xml:"longitude"`
+}
+
+type AddressXML struct {
+	Country  string `xml:"country"`
+	Province string `xml:"province"`
+	City     string `xml:"city"`
+}
+
+type NotesXML struct {
+	Paragraphs []string `xml:"para"`
+}
+
+type ProfileDataXML struct {
+	RepetitionGroups []RepetitionGroupXML `xml:"repetitiongroup"`
+}
+
+type RepetitionGroupXML struct {
+	Dives []DiveXML `xml:"dive"`
+}
+
+type DiveXML struct {
+	ID     string                   `xml:"id,attr"`
+	Before InformationBeforeDiveXML `xml:"informationbeforedive"`
+	Tanks  []TankDataXML            `xml:"tankdata"`
+	After  InformationAfterDiveXML  `xml:"informationafterdive"`
+	Points []WaypointXML            `xml:"samples>waypoint"`
+}
+
+type LinkXML struct {
+	Ref string `xml:"ref,attr"`
+}
+
+type InformationBeforeDiveXML struct {
+	Links               []LinkXML `xml:"link"`
+	DateTime            string    `xml:"datetime"`
+	DiveNumber          string    `xml:"divenumber"`
+	AirTemperature      string    `xml:"airtemperature"`
+	AtmosphericPressure string    `xml:"atmosphericpressure"`
+}
+
+type TankDataXML struct {
+	Links         []LinkXML `xml:"link"`
+	Volume        string    `xml:"tankvolume"`
+	PressureBegin string    `xml:"tankpressurebegin"`
+	PressureEnd   string    `xml:"tankpressureend"`
+}
+
+type InformationAfterDiveXML struct {
+	GreatestDepth     string   `xml:"greatestdepth"`
+	AverageDepth      string   `xml:"averagedepth"`
+	DiveDuration      string   `xml:"diveduration"`
+	LowestTemperature string   `xml:"lowesttemperature"`
+	Visibility        string   `xml:"visibility"`
+	Notes             NotesXML `xml:"notes"`
+	Rating            string   `xml:"rating>ratingvalue"`
+	LeadQuantity      string   `xml:"equipmentused>leadquantity"`
+}
+
+type WaypointXML struct {
+	DiveTime      string       `xml:"divetime"`
+	Depth         string       `xml:"depth"`
+	Temperature   string       `xml:"temperature"`
+	TankPressure  []string     `xml:"tankpressure"`
+	NoDecoTime    string       `xml:"nodecotime"`
+	CalculatedPO2 string       `xml:"calculatedpo2"`
+	DecoStop      *DecoStopXML `xml:"decostop"`
+}
+
+type DecoStopXML struct {
+	Kind     string `xml:"kind,attr"`
+	Depth    string `xml:"decodepth,attr"`
+	Duration string `xml:"duration,attr"`
+}
+
+type DiveTripXML struct {
+	Trips []TripXML `xml:"trip"`
+}
+
+type TripXML struct {
+	ID    string        `xml:"id,attr"`
+	Name  string        `xml:"name"`
+	Parts []TripPartXML `xml:"trippart"`
+}
+
+type TripPartXML struct {
+	Name         string    `xml:"name"`
+	RelatedDives []LinkXML `xml:"relateddives>link"`
+}